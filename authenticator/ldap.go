@@ -6,36 +6,156 @@ import (
 	"github.com/ca-gip/kubi/utils"
 	"github.com/pkg/errors"
 	"gopkg.in/ldap.v2"
+	"math"
+	"net"
+	"strconv"
+	"strings"
 )
 
 type Authenticator struct {
 }
 
+var (
+	ErrUserNotFound       = errors.New("user not found")
+	ErrAmbiguousUser      = errors.New("ambiguous user")
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	ErrAccountLocked      = errors.New("account locked")
+	ErrUnavailable        = errors.New("ldap unavailable")
+)
+
+// Classify an ldap error, network and server side failures
+// mean the directory is unavailable, not that the user is rejected
+func classifyError(err error, format string, args ...interface{}) error {
+	if err == nil {
+		return nil
+	}
+	message := fmt.Sprintf(format, args...)
+	// A request over LDAP_SEARCH_TIMEOUT only comes with this message
+	if strings.Contains(err.Error(), "ldap: connection timed out") {
+		return errors.Wrapf(ErrUnavailable, "%s: %v", message, err)
+	}
+	for _, code := range []uint8{ldap.ErrorNetwork, ldap.LDAPResultBusy, ldap.LDAPResultUnavailable, ldap.LDAPResultTimeLimitExceeded} {
+		if ldap.IsErrorWithCode(err, code) {
+			return errors.Wrapf(ErrUnavailable, "%s: %v", message, err)
+		}
+	}
+	return errors.Wrap(err, message)
+}
+
 // Authenticate a user throug LDAP or LDS
 // return if bind was ok, the userDN for next usage, and error if occured
 func GetUserGroups(userDN string) ([]string, error) {
 
 	// First TCP connect
-	conn, err := getBindedConnection()
+	conn, err := connect()
 	if err != nil {
 		return nil, err
 	}
 	defer conn.Close()
 
-	request := newUserGroupSearchRequest(userDN)
-	results, err := conn.Search(request)
+	return searchUserGroups(conn, userDN)
+}
 
-	if err != nil {
-		return nil, errors.Wrapf(err, "error searching for user's group for %s", userDN)
+// Search the groups of a user with a bound connection
+// With LDAP_SEARCH_ADMIN_GROUP_BASE, the admin group base is searched too
+// and groups found in both bases are kept once
+func searchUserGroups(conn searcher, userDN string) ([]string, error) {
+	bases := []string{utils.Config.Ldap.GroupBase}
+	adminBase := utils.Config.Ldap.AdminGroupBase
+	if utils.Config.Ldap.SearchAdminGroupBase && len(adminBase) > 0 && adminBase != bases[0] {
+		bases = append(bases, adminBase)
 	}
 
 	groups := []string{}
-	for _, entry := range results.Entries {
-		groups = append(groups, entry.GetAttributeValue("cn"))
+	seen := map[string]bool{}
+	for _, base := range bases {
+		results, err := conn.Search(newUserGroupSearchRequest(base, userDN))
+		if err != nil {
+			return nil, classifyError(err, "error searching for user's group for %s", utils.RedactUser(userDN))
+		}
+
+		for _, entry := range results.Entries {
+			group := attributeValue(entry, "cn")
+			if len(group) > 0 && !seen[group] {
+				seen[group] = true
+				groups = append(groups, group)
+			}
+		}
 	}
 	return groups, nil
 }
 
+// Authenticate a user and get its groups and admin access
+// With LDAP_SEARCH_AS_USER, the groups are searched with the connection bound
+// as the user, for directories hiding memberships from the bind account.
+// With LDAP_REUSE_CONNECTION, the connection is bound back as the bind account
+// for the lookups, instead of opening new connections.
+// The connection is specific to the login and closed once done
+func AuthenticateUserGroups(username string, password string) (*string, []string, bool, error) {
+	conn, err := connect()
+	if err != nil {
+		return nil, nil, false, err
+	}
+	defer conn.Close()
+
+	userDN, err := authenticateUser(conn, username, password)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	groups, hasAdminAccess, err := lookupAfterBind(conn, *userDN)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	checkGroupCount(*userDN, groups)
+	return userDN, groups, hasAdminAccess, nil
+}
+
+// Warn of an authenticated user without groups, with LDAP_WARN_NO_GROUPS,
+// or with more than LDAP_MAX_GROUPS groups, both likely a wrong group base
+// or filter. Only diagnostic, the login goes on
+func checkGroupCount(userDN string, groups []string) {
+	if len(groups) == 0 && utils.Config.Ldap.WarnNoGroups {
+		utils.Metrics.Add("ldap_no_groups", 1)
+		utils.Log.Warn().Msgf("No group found for %s in %s, check LDAP_GROUPBASE", utils.RedactUser(userDN), utils.Config.Ldap.GroupBase)
+	}
+	if maxGroups := utils.Config.Ldap.MaxGroups; maxGroups > 0 && len(groups) > maxGroups {
+		utils.Metrics.Add("ldap_too_many_groups", 1)
+		utils.Log.Warn().Msgf("%d groups found for %s, over LDAP_MAX_GROUPS %d, check LDAP_GROUPBASE", len(groups), utils.RedactUser(userDN), maxGroups)
+	}
+}
+
+// Search the groups and admin access of an authenticated user,
+// conn is still bound as the user
+func lookupAfterBind(conn ldapConn, userDN string) ([]string, bool, error) {
+	var groups []string
+	var err error
+	if utils.Config.Ldap.SearchAsUser {
+		if groups, err = searchUserGroups(conn, userDN); err != nil {
+			return nil, false, err
+		}
+	}
+
+	if !utils.Config.Ldap.ReuseConnection {
+		if groups == nil {
+			if groups, err = GetUserGroups(userDN); err != nil {
+				return nil, false, err
+			}
+		}
+		return groups, HasAdminAccess(userDN), nil
+	}
+
+	if err := conn.Bind(utils.Config.Ldap.BindDN, utils.Config.Ldap.BindPassword); err != nil {
+		return nil, false, errors.Wrapf(ErrUnavailable, "unable to bind back with the bind account: %v", err)
+	}
+	if groups == nil {
+		if groups, err = searchUserGroups(conn, userDN); err != nil {
+			return nil, false, err
+		}
+	}
+	return groups, isAdminConfigured() && hasAdminAccess(conn, userDN), nil
+}
+
 // Authenticate a user throug LDAP or LDS
 // return if bind was ok, the userDN for next usage, and error if occured
 func GetAllGroups() ([]string, error) {
@@ -47,8 +167,7 @@ func GetAllGroups() ([]string, error) {
 	}
 	defer conn.Close()
 
-	request := newGroupSearchRequest()
-	results, err := conn.Search(request)
+	results, err := pagedSearch(conn, newGroupSearchRequest(), groupPageSize)
 
 	if err != nil {
 		return nil, errors.Wrap(err, "Error searching all groups")
@@ -56,137 +175,433 @@ func GetAllGroups() ([]string, error) {
 
 	groups := []string{}
 	for _, entry := range results.Entries {
-		groups = append(groups, entry.GetAttributeValue("cn"))
+		if group := attributeValue(entry, "cn"); len(group) > 0 {
+			groups = append(groups, group)
+		}
 	}
 	return groups, nil
 }
 
+// Size of the pages requested for the group list
+const groupPageSize = 500
+
+// Search with the paged results control. A directory sending pages
+// forever, or never clearing its cookie, is stopped at LDAP_MAX_PAGES
+// pages or LDAP_MAX_ENTRIES entries, and the entries fetched so far are returned
+func pagedSearch(conn searcher, request *ldap.SearchRequest, pageSize uint32) (*ldap.SearchResult, error) {
+	paging := ldap.NewControlPaging(pageSize)
+	request.Controls = append(request.Controls, paging)
+	maxPages, maxEntries := utils.Config.Ldap.MaxPages, utils.Config.Ldap.MaxEntries
+
+	result := &ldap.SearchResult{}
+	for pages := 1; ; pages++ {
+		page, err := conn.Search(request)
+		if err != nil {
+			return nil, err
+		}
+		result.Entries = append(result.Entries, page.Entries...)
+		result.Referrals = append(result.Referrals, page.Referrals...)
+
+		if maxEntries > 0 && len(result.Entries) > maxEntries {
+			utils.Log.Warn().Msgf("Paged search of %s stopped at LDAP_MAX_ENTRIES %d entries, results are partial", request.BaseDN, maxEntries)
+			result.Entries = result.Entries[:maxEntries]
+			return result, nil
+		}
+		control, ok := ldap.FindControl(page.Controls, ldap.ControlTypePaging).(*ldap.ControlPaging)
+		if !ok || len(control.Cookie) == 0 {
+			return result, nil
+		}
+		if maxPages > 0 && pages >= maxPages {
+			utils.Log.Warn().Msgf("Paged search of %s stopped at LDAP_MAX_PAGES %d pages, results are partial", request.BaseDN, maxPages)
+			return result, nil
+		}
+		paging.SetCookie(control.Cookie)
+	}
+}
+
 // Authenticate a user throug LDAP or LDS
 // return if bind was ok, the userDN for next usage, and error if occured
 func AuthenticateUser(username string, password string) (*string, error) {
 
 	// First TCP connect
-	conn, err := getBindedConnection()
+	conn, err := connect()
 	if err != nil {
 		return nil, err
 	}
 	defer conn.Close()
 
+	return authenticateUser(conn, username, password)
+}
+
+// Find the user DN with the bind account connection, then bind as the user
+func authenticateUser(conn ldapConn, username string, password string) (*string, error) {
+
 	// Get User Distinguished Name for Standard User
+	// An ambiguous user is rejected here, only a missing one falls back to admin base
 	userDN, err := getUserDN(conn, utils.Config.Ldap.UserBase, username)
 	if err == nil {
-		err = conn.Bind(userDN, password)
-		return &userDN, err
-	} else if len(utils.Config.Ldap.AdminUserBase) > 0 {
+		return bindUser(conn, userDN, password)
+	} else if errors.Cause(err) == ErrUserNotFound && len(utils.Config.Ldap.AdminUserBase) > 0 {
 		userDN, err := getUserDN(conn, utils.Config.Ldap.AdminUserBase, username)
-		err = conn.Bind(userDN, password)
-		return &userDN, err
+		if err != nil {
+			utils.Log.Error().Msg(err.Error())
+			return nil, err
+		}
+		return bindUser(conn, userDN, password)
 	} else {
 		utils.Log.Error().Msg(err.Error())
 		return nil, err
 	}
 }
 
-func getBindedConnection() (*ldap.Conn, error) {
-	var (
-		err  error
-		conn *ldap.Conn
-	)
+// Bind as the user to check its password
+func bindUser(conn ldapConn, userDN string, password string) (*string, error) {
+	err := conn.Bind(userDN, password)
+	if isAccountLocked(err) {
+		return nil, errors.Wrapf(ErrAccountLocked, "bind refused for %s: %v", utils.RedactUser(userDN), err)
+	} else if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return nil, errors.Wrapf(ErrInvalidCredentials, "bind refused for %s", utils.RedactUser(userDN))
+	} else if err != nil {
+		return nil, classifyError(err, "unable to bind as %s", utils.RedactUser(userDN))
+	}
+	return &userDN, nil
+}
+
+// Active Directory reports a locked account as invalid credentials with
+// the 775 data code, 389 and OpenLDAP password policies as a constraint violation
+func isAccountLocked(err error) bool {
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return strings.Contains(err.Error(), "data 775")
+	}
+	return ldap.IsErrorWithCode(err, ldap.LDAPResultConstraintViolation)
+}
+
+// A bound ldap connection
+type ldapConn interface {
+	searcher
+	Bind(username, password string) error
+	Close()
+}
 
-	tlsConfig := &tls.Config{
+// Open a connection bound with the bind account, replaced in tests
+var connect = func() (ldapConn, error) {
+	conn, err := getBindedConnection()
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// TLS settings of the LDAP connection, with the LDAP_CLIENT_CERT
+// client certificate when the directory requires mutual TLS
+func newTLSConfig() *tls.Config {
+	return &tls.Config{
 		ServerName:         utils.Config.Ldap.Host,
 		InsecureSkipVerify: utils.Config.Ldap.SkipTLSVerification,
+		Certificates:       utils.Config.Ldap.ClientCertificates,
 	}
+}
 
+// Dial the directory within LDAP_DIAL_TIMEOUT. The timeout is given to the
+// dialer, the shared ldap.DefaultTimeout is left alone as logins are concurrent.
+// Each request then waits LDAP_SEARCH_TIMEOUT at most for the directory to answer
+func dial(tlsConfig *tls.Config) (*ldap.Conn, error) {
+	address := net.JoinHostPort(utils.Config.Ldap.Host, strconv.Itoa(utils.Config.Ldap.Port))
+	dialer := &net.Dialer{Timeout: utils.Config.Ldap.DialTimeout}
+
+	var conn net.Conn
+	var err error
 	if utils.Config.Ldap.UseSSL {
-		conn, err = ldap.DialTLS("tcp", fmt.Sprintf("%s:%d", utils.Config.Ldap.Host, utils.Config.Ldap.Port), tlsConfig)
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, tlsConfig)
 	} else {
-		conn, err = ldap.Dial("tcp", fmt.Sprintf("%s:%d", utils.Config.Ldap.Host, utils.Config.Ldap.Port))
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ldapConn := ldap.NewConn(conn, utils.Config.Ldap.UseSSL)
+	ldapConn.Start()
+	if utils.Config.Ldap.SearchTimeout > 0 {
+		ldapConn.SetTimeout(utils.Config.Ldap.SearchTimeout)
+	}
+	return ldapConn, nil
+}
+
+func getBindedConnection() (*ldap.Conn, error) {
+	tlsConfig := newTLSConfig()
+	conn, err := dial(tlsConfig)
+	if err != nil {
+		return nil, errors.Wrapf(ErrUnavailable, "unable to create ldap connector for %s:%d: %v", utils.Config.Ldap.Host, utils.Config.Ldap.Port, err)
 	}
 
 	if utils.Config.Ldap.StartTLS {
 		err = conn.StartTLS(tlsConfig)
 		if err != nil {
-			return nil, errors.Wrapf(err, "unable to setup TLS connection")
+			conn.Close()
+			return nil, errors.Wrapf(ErrUnavailable, "unable to setup TLS connection: %v", err)
 		}
 	}
 
-	if err != nil {
-		return nil, errors.Wrapf(err, "unable to create ldap connector for %s:%d", utils.Config.Ldap.Host, utils.Config.Ldap.Port)
-	}
-
-	// Bind with BindAccount
+	// Bind with BindAccount, a failure is not the user fault
 	err = conn.Bind(utils.Config.Ldap.BindDN, utils.Config.Ldap.BindPassword)
 	if err != nil {
-		return nil, errors.WithStack(err)
+		conn.Close()
+		return nil, errors.Wrapf(ErrUnavailable, "unable to bind with the bind account: %v", err)
 	}
 
 	return conn, nil
 }
 
 // Get User DN for searching in group
-func getUserDN(conn *ldap.Conn, userBaseDN string, username string) (string, error) {
+func getUserDN(conn searcher, userBaseDN string, username string) (string, error) {
 	req := newUserSearchRequest(userBaseDN, username)
 
+	// The filter of the messages is built with the redacted username,
+	// the searched filter is never rewritten
+	filter := fmt.Sprintf(userSearchFilter(username), ldap.EscapeFilter(utils.RedactUser(username)))
+
 	res, err := conn.Search(req)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		// More entries than the size limit, so several users match
+		return "", errors.Wrapf(ErrAmbiguousUser, "more than %d entries found for the user search filter '%s'", req.SizeLimit, filter)
+	}
 	if err != nil {
-		return "", errors.Wrapf(err, "Error searching for user %s", username)
+		return "", classifyError(err, "Error searching for user %s", utils.RedactUser(username))
 	}
+	return selectUserDN(res.Entries, filter)
+}
 
-	if len(res.Entries) == 0 {
-		return "", errors.Errorf("No result for the user search filter '%s'", req.Filter)
-	} else if len(res.Entries) > 1 {
-		return "", errors.Errorf("Multiple entries found for the user search filter '%s'", req.Filter)
+// Pick the user DN from the search entries
+// A single entry is the nominal case, several entries are ambiguous and
+// rejected unless a tiebreaker attribute is configured
+func selectUserDN(entries []*ldap.Entry, filter string) (string, error) {
+	if len(entries) == 0 {
+		return "", errors.Wrapf(ErrUserNotFound, "No result for the user search filter '%s'", filter)
+	} else if len(entries) == 1 {
+		return entries[0].DN, nil
 	}
-	userDN := res.Entries[0].DN
-	return userDN, nil
+
+	attribute := utils.Config.Ldap.UserTiebreakerAttribute
+	if len(attribute) == 0 {
+		return "", errors.Wrapf(ErrAmbiguousUser, "%d entries found for the user search filter '%s'", len(entries), filter)
+	}
+
+	// Keep the entry with the lowest tiebreaker value, equal values are still ambiguous
+	var selected *ldap.Entry
+	ambiguous := false
+	for _, entry := range entries {
+		value := attributeValue(entry, attribute)
+		if len(value) == 0 {
+			continue
+		}
+		if selected == nil || value < attributeValue(selected, attribute) {
+			selected, ambiguous = entry, false
+		} else if value == attributeValue(selected, attribute) {
+			ambiguous = true
+		}
+	}
+
+	if selected == nil || ambiguous {
+		return "", errors.Wrapf(ErrAmbiguousUser, "%d entries found for the user search filter '%s' and tiebreaker '%s' cannot decide", len(entries), filter, attribute)
+	}
+	utils.Log.Warn().Msgf("%d entries found for the user search filter '%s', %s selected by tiebreaker '%s'", len(entries), filter, utils.RedactUser(selected.DN), attribute)
+	return selected.DN, nil
 }
 
-// Check if a user is in admin LDAP group
-// return true if it belong to AdminGroup, false otherwise
+// Check if a user is in admin LDAP group or flagged by the admin attribute
+// return true if it belong to AdminGroup or has the attribute, false otherwise.
+// A member of a denied group is never admin
 func HasAdminAccess(userDN string) bool {
 
-	// No need to go after, there is no Admin Group Base
-	if len(utils.Config.Ldap.AdminGroupBase) == 0 {
+	// No need to go after, there is no Admin Group Base nor Admin Attribute
+	if !isAdminConfigured() {
 		return false
 	}
 
-	conn, err := getBindedConnection()
+	conn, err := connect()
 	if err != nil {
 		utils.Log.Error().Msg(err.Error())
 		return false
 	}
 
 	defer conn.Close()
-	req := newUserAdminSearchRequest(userDN)
-	res, err := conn.Search(req)
+	return hasAdminAccess(conn, userDN)
+}
+
+func isAdminConfigured() bool {
+	return len(utils.Config.Ldap.AdminGroupBase) > 0 || len(utils.Config.Ldap.AdminAttribute) > 0
+}
+
+// Search part of an ldap connection
+type searcher interface {
+	Search(searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error)
+}
+
+func hasAdminAccess(conn searcher, userDN string) bool {
+
+	// Denial takes precedence over all grants
+	if isAdminDenied(conn, userDN) {
+		utils.Log.Info().Msgf("Admin access denied by group for %s", utils.RedactUser(userDN))
+		return false
+	}
+
+	if len(utils.Config.Ldap.AdminGroupBase) > 0 {
+		req := newUserAdminSearchRequest(userDN)
+		res, err := conn.Search(req)
+		if err == nil && len(res.Entries) > 0 {
+			return true
+		}
+	}
+
+	if len(utils.Config.Ldap.AdminAttribute) > 0 {
+		req := newUserEntryRequest(userDN)
+		res, err := conn.Search(req)
+		if err == nil && len(res.Entries) == 1 && hasAdminAttribute(res.Entries[0]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Check if a user is member of an admin denied group,
+// searched in group base and admin group base.
+// A failed search deny the access, a search over its size limit
+// only means the user is in several denied groups
+func isAdminDenied(conn searcher, userDN string) bool {
+	if len(utils.Config.Ldap.AdminDenyGroups) == 0 {
+		return false
+	}
+
+	for _, base := range []string{utils.Config.Ldap.GroupBase, utils.Config.Ldap.AdminGroupBase} {
+		if len(base) == 0 {
+			continue
+		}
+		res, err := conn.Search(newAdminDenySearchRequest(base, userDN))
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+			return true
+		}
+		if err != nil {
+			utils.Log.Error().Msg(err.Error())
+			return true
+		}
+		if len(res.Entries) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if the user entry has the admin attribute set to the configured value
+func hasAdminAttribute(entry *ldap.Entry) bool {
+	for _, value := range attributeValues(entry, utils.Config.Ldap.AdminAttribute) {
+		if strings.EqualFold(value, utils.Config.Ldap.AdminAttributeValue) {
+			return true
+		}
+	}
+	return false
+}
+
+// Values of an entry attribute. A value over LDAP_MAX_ATTR_SIZE bytes is
+// skipped, so hostile or broken directory data is not kept nor matched.
+// LDAP has no per value limit, the cap applies once the entry is fetched:
+// memory is bounded by the attributes each search requests
+func attributeValues(entry *ldap.Entry, name string) []string {
+	values := entry.GetAttributeValues(name)
+	maxSize := utils.Config.Ldap.MaxAttrSize
+	if maxSize <= 0 {
+		return values
+	}
+
+	bounded := make([]string, 0, len(values))
+	for _, value := range values {
+		if len(value) > maxSize {
+			utils.Log.Warn().Msgf("Value of %d bytes of the attribute %s of %s skipped, over LDAP_MAX_ATTR_SIZE", len(value), name, utils.RedactUser(entry.DN))
+			continue
+		}
+		bounded = append(bounded, value)
+	}
+	return bounded
+}
+
+// First value of an entry attribute, empty when none is within LDAP_MAX_ATTR_SIZE
+func attributeValue(entry *ldap.Entry, name string) string {
+	values := attributeValues(entry, name)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// Attribute list asking for no attribute, RFC 4511 4.5.1.8
+const noAttribute = "1.1"
+
+// Server side time limit of searches, in seconds. A sub-second
+// LDAP_SEARCH_TIMEOUT is rounded up, 0 would mean no limit to the directory
+func searchTimeLimit() int {
+	timeout := utils.Config.Ldap.SearchTimeout
+	if timeout <= 0 {
+		return 0
+	}
+	return int(math.Ceil(timeout.Seconds()))
+}
 
-	return err == nil && len(res.Entries) > 0
+// Filter format of the user search
+// A username containing '@' is an email/UPN login and use the UPN filter
+func userSearchFilter(username string) string {
+	if strings.Contains(username, "@") {
+		return utils.Config.Ldap.UpnFilter
+	}
+	return utils.Config.Ldap.UserFilter
 }
 
 // request to search user
+// Only the DN is needed, and the tiebreaker when set, so large
+// attributes of the user entry such as photos are never fetched
 func newUserSearchRequest(userBaseDN string, username string) *ldap.SearchRequest {
-	userFilter := fmt.Sprintf(utils.Config.Ldap.UserFilter, username)
+	userFilter := fmt.Sprintf(userSearchFilter(username), ldap.EscapeFilter(username))
+	sizeLimit := 2                      // enough to detect an ambiguous user
+	attributes := []string{noAttribute} // the DN is always returned
+	if attribute := utils.Config.Ldap.UserTiebreakerAttribute; len(attribute) > 0 {
+		sizeLimit = 0 // the tiebreaker needs every candidate
+		attributes = []string{attribute}
+	}
 	return &ldap.SearchRequest{
 		BaseDN:       userBaseDN,
 		Scope:        ldap.ScopeWholeSubtree,
 		DerefAliases: ldap.NeverDerefAliases,
-		SizeLimit:    2, // limit number of entries in result
-		TimeLimit:    10,
+		SizeLimit:    sizeLimit, // limit number of entries in result
+		TimeLimit:    searchTimeLimit(),
 		TypesOnly:    false,
 		Filter:       userFilter, // filter default format : (&(objectClass=person)(uid=%s))
+		Attributes:   attributes,
+	}
+}
+
+// request to read the user entry admin attribute
+func newUserEntryRequest(userDN string) *ldap.SearchRequest {
+	return &ldap.SearchRequest{
+		BaseDN:       userDN,
+		Scope:        ldap.ScopeBaseObject,
+		DerefAliases: ldap.NeverDerefAliases,
+		SizeLimit:    1, // limit number of entries in result
+		TimeLimit:    searchTimeLimit(),
+		TypesOnly:    false,
+		Filter:       "(objectClass=*)",
+		Attributes:   []string{utils.Config.Ldap.AdminAttribute},
 	}
 }
 
 // request to get user group list
-func newUserGroupSearchRequest(userDN string) *ldap.SearchRequest {
-	groupFilter := fmt.Sprintf("(&(|(objectClass=groupOfNames)(objectClass=group))(member=%s))", userDN)
+func newUserGroupSearchRequest(base string, userDN string) *ldap.SearchRequest {
+	groupFilter := fmt.Sprintf("(&(|(objectClass=groupOfNames)(objectClass=group))(member=%s))", ldap.EscapeFilter(userDN))
 	return &ldap.SearchRequest{
-		BaseDN:       utils.Config.Ldap.GroupBase,
+		BaseDN:       base,
 		Scope:        ldap.ScopeWholeSubtree,
 		DerefAliases: ldap.NeverDerefAliases,
 		SizeLimit:    0, // limit number of entries in result, 0 values means no limitations
-		TimeLimit:    30,
+		TimeLimit:    searchTimeLimit(),
 		TypesOnly:    false,
 		Filter:       groupFilter, // filter default format : (&(objectClass=groupOfNames)(member=%s))
 		Attributes:   []string{"cn"},
@@ -195,19 +610,38 @@ func newUserGroupSearchRequest(userDN string) *ldap.SearchRequest {
 
 // request to get user group list
 func newUserAdminSearchRequest(userDN string) *ldap.SearchRequest {
-	groupFilter := fmt.Sprintf("(&(|(objectClass=groupOfNames)(objectClass=group))(member=%s))", userDN)
+	groupFilter := fmt.Sprintf("(&(|(objectClass=groupOfNames)(objectClass=group))(member=%s))", ldap.EscapeFilter(userDN))
 	return &ldap.SearchRequest{
 		BaseDN:       utils.Config.Ldap.AdminGroupBase,
 		Scope:        ldap.ScopeWholeSubtree,
 		DerefAliases: ldap.NeverDerefAliases,
 		SizeLimit:    1, // limit number of entries in result, 0 values means no limitations
-		TimeLimit:    30,
+		TimeLimit:    searchTimeLimit(),
 		TypesOnly:    false,
 		Filter:       groupFilter, // filter default format : (&(objectClass=groupOfNames)(member=%s))
 		Attributes:   []string{"cn"},
 	}
 }
 
+// request to get user membership of admin denied groups
+func newAdminDenySearchRequest(base string, userDN string) *ldap.SearchRequest {
+	groups := ""
+	for _, group := range utils.Config.Ldap.AdminDenyGroups {
+		groups += fmt.Sprintf("(cn=%s)", ldap.EscapeFilter(group))
+	}
+	groupFilter := fmt.Sprintf("(&(|(objectClass=groupOfNames)(objectClass=group))(member=%s)(|%s))", ldap.EscapeFilter(userDN), groups)
+	return &ldap.SearchRequest{
+		BaseDN:       base,
+		Scope:        ldap.ScopeWholeSubtree,
+		DerefAliases: ldap.NeverDerefAliases,
+		SizeLimit:    1, // limit number of entries in result, 0 values means no limitations
+		TimeLimit:    searchTimeLimit(),
+		TypesOnly:    false,
+		Filter:       groupFilter,
+		Attributes:   []string{"cn"},
+	}
+}
+
 // request to get group list ( for all namespaces )
 func newGroupSearchRequest() *ldap.SearchRequest {
 	return &ldap.SearchRequest{
@@ -215,7 +649,7 @@ func newGroupSearchRequest() *ldap.SearchRequest {
 		Scope:        ldap.ScopeWholeSubtree,
 		DerefAliases: ldap.NeverDerefAliases,
 		SizeLimit:    0, // limit number of entries in result, 0 values means no limitations
-		TimeLimit:    30,
+		TimeLimit:    searchTimeLimit(),
 		TypesOnly:    false,
 		Filter:       "(|(objectClass=groupOfNames)(objectClass=group))", // filter default format : (&(objectClass=groupOfNames)(member=%s))
 		Attributes:   []string{"cn"},
@@ -0,0 +1,721 @@
+package ldap
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/ca-gip/kubi/types"
+	"github.com/ca-gip/kubi/utils"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/ldap.v2"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSelectUserDN(t *testing.T) {
+	utils.Config = &types.Config{Ldap: types.LdapConfig{}}
+	filter := "(cn=demo)"
+
+	t.Run("with zero match", func(t *testing.T) {
+		result, err := selectUserDN([]*ldap.Entry{}, filter)
+
+		assert.NotNil(t, err)
+		assert.Equal(t, ErrUserNotFound, errors.Cause(err))
+		assert.Empty(t, result)
+	})
+
+	t.Run("with single match", func(t *testing.T) {
+		result, err := selectUserDN([]*ldap.Entry{
+			ldap.NewEntry("cn=demo,ou=users", nil),
+		}, filter)
+
+		assert.Nil(t, err)
+		assert.Equal(t, "cn=demo,ou=users", result)
+	})
+
+	t.Run("with multiple match and no tiebreaker", func(t *testing.T) {
+		result, err := selectUserDN([]*ldap.Entry{
+			ldap.NewEntry("cn=demo,ou=users", nil),
+			ldap.NewEntry("cn=demo,ou=others", nil),
+		}, filter)
+
+		assert.NotNil(t, err)
+		assert.Equal(t, ErrAmbiguousUser, errors.Cause(err))
+		assert.Empty(t, result)
+	})
+
+	t.Run("with multiple match and a tiebreaker", func(t *testing.T) {
+		utils.Config.Ldap.UserTiebreakerAttribute = "employeeNumber"
+		defer func() { utils.Config.Ldap.UserTiebreakerAttribute = "" }()
+
+		result, err := selectUserDN([]*ldap.Entry{
+			ldap.NewEntry("cn=demo,ou=users", map[string][]string{"employeeNumber": {"2"}}),
+			ldap.NewEntry("cn=demo,ou=others", map[string][]string{"employeeNumber": {"1"}}),
+			ldap.NewEntry("cn=demo,ou=disabled", nil),
+		}, filter)
+
+		assert.Nil(t, err)
+		assert.Equal(t, "cn=demo,ou=others", result)
+	})
+
+	t.Run("with multiple match and an undecidable tiebreaker", func(t *testing.T) {
+		utils.Config.Ldap.UserTiebreakerAttribute = "employeeNumber"
+		defer func() { utils.Config.Ldap.UserTiebreakerAttribute = "" }()
+
+		result, err := selectUserDN([]*ldap.Entry{
+			ldap.NewEntry("cn=demo,ou=users", map[string][]string{"employeeNumber": {"1"}}),
+			ldap.NewEntry("cn=demo,ou=others", map[string][]string{"employeeNumber": {"1"}}),
+		}, filter)
+
+		assert.NotNil(t, err)
+		assert.Equal(t, ErrAmbiguousUser, errors.Cause(err))
+		assert.Empty(t, result)
+	})
+}
+
+// Searcher enforcing the size limit like a directory: the entries up
+// to the limit are returned with a size limit exceeded error
+type limitedSearcher []*ldap.Entry
+
+func (l limitedSearcher) Search(request *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	if request.SizeLimit > 0 && len(l) > request.SizeLimit {
+		return &ldap.SearchResult{Entries: l[:request.SizeLimit]}, ldap.NewError(ldap.LDAPResultSizeLimitExceeded, errors.New("size limit exceeded"))
+	}
+	return &ldap.SearchResult{Entries: l}, nil
+}
+
+func TestGetUserDN(t *testing.T) {
+	utils.Config = &types.Config{Ldap: types.LdapConfig{UserFilter: "(cn=%s)"}}
+	conn := limitedSearcher{
+		ldap.NewEntry("cn=demo,ou=users", map[string][]string{"employeeNumber": {"3"}}),
+		ldap.NewEntry("cn=demo,ou=others", map[string][]string{"employeeNumber": {"1"}}),
+		ldap.NewEntry("cn=demo,ou=disabled", map[string][]string{"employeeNumber": {"2"}}),
+	}
+
+	t.Run("three matching entries are ambiguous", func(t *testing.T) {
+		result, err := getUserDN(conn, "ou=users", "demo")
+
+		assert.Equal(t, ErrAmbiguousUser, errors.Cause(err))
+		assert.Empty(t, result)
+	})
+
+	t.Run("three matching entries are decided by the tiebreaker", func(t *testing.T) {
+		utils.Config.Ldap.UserTiebreakerAttribute = "employeeNumber"
+		defer func() { utils.Config.Ldap.UserTiebreakerAttribute = "" }()
+
+		result, err := getUserDN(conn, "ou=users", "demo")
+
+		assert.Nil(t, err)
+		assert.Equal(t, "cn=demo,ou=others", result)
+	})
+
+	t.Run("a short username is redacted from the message only", func(t *testing.T) {
+		utils.Config.LogRedactUsernames = true
+		defer func() { utils.Config.LogRedactUsernames = false }()
+
+		_, err := getUserDN(limitedSearcher{}, "ou=users", "cn")
+
+		assert.Equal(t, ErrUserNotFound, errors.Cause(err))
+		assert.Contains(t, err.Error(), "'(cn="+utils.RedactUser("cn")+")'")
+	})
+}
+
+func TestNewUserSearchRequest(t *testing.T) {
+	utils.Config = &types.Config{Ldap: types.LdapConfig{
+		UserFilter: "(cn=%s)",
+		UpnFilter:  "(userPrincipalName=%s)",
+	}}
+
+	t.Run("with a plain login use the user filter", func(t *testing.T) {
+		result := newUserSearchRequest("ou=users", "alice")
+
+		assert.Equal(t, "(cn=alice)", result.Filter)
+		assert.Equal(t, "ou=users", result.BaseDN)
+	})
+
+	t.Run("with an upn login use the upn filter", func(t *testing.T) {
+		result := newUserSearchRequest("ou=users", "alice@corp.com")
+
+		assert.Equal(t, "(userPrincipalName=alice@corp.com)", result.Filter)
+	})
+
+	t.Run("with special characters the value is escaped", func(t *testing.T) {
+		result := newUserSearchRequest("ou=users", "al*ce)(cn=*")
+
+		assert.Equal(t, `(cn=al\2ace\29\28cn=\2a)`, result.Filter)
+	})
+
+	t.Run("no attribute of the user entry is fetched", func(t *testing.T) {
+		result := newUserSearchRequest("ou=users", "alice")
+
+		assert.Equal(t, []string{"1.1"}, result.Attributes)
+	})
+
+	t.Run("only the tiebreaker attribute is fetched when set", func(t *testing.T) {
+		utils.Config.Ldap.UserTiebreakerAttribute = "employeeNumber"
+		defer func() { utils.Config.Ldap.UserTiebreakerAttribute = "" }()
+
+		result := newUserSearchRequest("ou=users", "alice")
+
+		assert.Equal(t, []string{"employeeNumber"}, result.Attributes)
+	})
+}
+
+func TestHasAdminAttribute(t *testing.T) {
+	utils.Config = &types.Config{Ldap: types.LdapConfig{
+		AdminAttribute:      "isClusterAdmin",
+		AdminAttributeValue: "TRUE",
+	}}
+
+	t.Run("with the attribute set to the value", func(t *testing.T) {
+		entry := ldap.NewEntry("cn=admin,ou=users", map[string][]string{"isClusterAdmin": {"TRUE"}})
+
+		assert.True(t, hasAdminAttribute(entry))
+	})
+
+	t.Run("with the attribute value in another case", func(t *testing.T) {
+		entry := ldap.NewEntry("cn=admin,ou=users", map[string][]string{"isClusterAdmin": {"true"}})
+
+		assert.True(t, hasAdminAttribute(entry))
+	})
+
+	t.Run("with the attribute set to another value", func(t *testing.T) {
+		entry := ldap.NewEntry("cn=demo,ou=users", map[string][]string{"isClusterAdmin": {"FALSE"}})
+
+		assert.False(t, hasAdminAttribute(entry))
+	})
+
+	t.Run("without the attribute", func(t *testing.T) {
+		entry := ldap.NewEntry("cn=demo,ou=users", nil)
+
+		assert.False(t, hasAdminAttribute(entry))
+	})
+}
+
+func TestSearchTimeLimit(t *testing.T) {
+	utils.Config = &types.Config{Ldap: types.LdapConfig{
+		UserFilter:     "(cn=%s)",
+		AdminAttribute: "isClusterAdmin",
+		DialTimeout:    2 * time.Second,
+		SearchTimeout:  45 * time.Second,
+	}}
+
+	t.Run("every search request carry the search timeout", func(t *testing.T) {
+		requests := []*ldap.SearchRequest{
+			newUserSearchRequest("ou=users", "alice"),
+			newUserEntryRequest("cn=alice,ou=users"),
+			newUserGroupSearchRequest("ou=groups", "cn=alice,ou=users"),
+			newUserAdminSearchRequest("cn=alice,ou=users"),
+			newGroupSearchRequest(),
+		}
+		for _, request := range requests {
+			assert.Equal(t, 45, request.TimeLimit)
+		}
+	})
+
+	t.Run("a sub-second timeout is still a limit", func(t *testing.T) {
+		utils.Config.Ldap.SearchTimeout = 200 * time.Millisecond
+		defer func() { utils.Config.Ldap.SearchTimeout = 45 * time.Second }()
+
+		assert.Equal(t, 1, newUserSearchRequest("ou=users", "alice").TimeLimit)
+	})
+}
+
+func TestStalledDirectory(t *testing.T) {
+	// A directory accepting connections but never answering
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	portNumber, _ := strconv.Atoi(port)
+	utils.Config = &types.Config{Ldap: types.LdapConfig{
+		Host:          host,
+		Port:          portNumber,
+		GroupBase:     "ou=groups",
+		DialTimeout:   time.Second,
+		SearchTimeout: 100 * time.Millisecond,
+	}}
+
+	conn, err := dial(newTLSConfig())
+	assert.Nil(t, err)
+	defer conn.Close()
+	defer func() { (<-accepted).Close() }()
+
+	searched := make(chan error, 1)
+	go func() {
+		_, err := searchUserGroups(conn, "cn=alice,ou=users")
+		searched <- err
+	}()
+
+	select {
+	case err := <-searched:
+		assert.Equal(t, ErrUnavailable, errors.Cause(err))
+	case <-time.After(5 * time.Second):
+		t.Fatal("the search of a stalled directory is not timed out")
+	}
+}
+
+// Answer searches by base DN, as a directory would
+type fakeSearcher map[string][]*ldap.Entry
+
+func (f fakeSearcher) Search(request *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	return &ldap.SearchResult{Entries: f[request.BaseDN]}, nil
+}
+
+func TestHasAdminAccess(t *testing.T) {
+	utils.Config = &types.Config{Ldap: types.LdapConfig{
+		GroupBase:      "ou=groups",
+		AdminGroupBase: "ou=admins",
+	}}
+	userDN := "cn=alice,ou=users"
+	conn := fakeSearcher{
+		"ou=admins": {ldap.NewEntry("cn=cluster-admins,ou=admins", nil)},
+		"ou=groups": {ldap.NewEntry("cn=contractors,ou=groups", nil)},
+	}
+
+	t.Run("with an admin group and no deny group", func(t *testing.T) {
+		assert.True(t, hasAdminAccess(conn, userDN))
+	})
+
+	t.Run("with an admin group and a deny group", func(t *testing.T) {
+		utils.Config.Ldap.AdminDenyGroups = []string{"contractors"}
+		defer func() { utils.Config.Ldap.AdminDenyGroups = nil }()
+
+		assert.False(t, hasAdminAccess(conn, userDN))
+	})
+
+	t.Run("the deny search match user membership of denied groups", func(t *testing.T) {
+		utils.Config.Ldap.AdminDenyGroups = []string{"contractors", "interns"}
+		defer func() { utils.Config.Ldap.AdminDenyGroups = nil }()
+
+		result := newAdminDenySearchRequest("ou=groups", userDN)
+
+		assert.Equal(t, "(&(|(objectClass=groupOfNames)(objectClass=group))(member=cn=alice,ou=users)(|(cn=contractors)(cn=interns)))", result.Filter)
+	})
+
+	t.Run("a member of several deny groups is denied without error", func(t *testing.T) {
+		utils.Config.Ldap.AdminDenyGroups = []string{"contractors", "interns"}
+		defer func() { utils.Config.Ldap.AdminDenyGroups = nil }()
+		var output bytes.Buffer
+		defaultLog := utils.Log
+		utils.Log = zerolog.New(&output)
+		defer func() { utils.Log = defaultLog }()
+
+		denied := isAdminDenied(limitedSearcher{
+			ldap.NewEntry("cn=contractors,ou=groups", nil),
+			ldap.NewEntry("cn=interns,ou=groups", nil),
+		}, userDN)
+
+		assert.True(t, denied)
+		assert.Empty(t, output.String())
+	})
+
+	t.Run("the user DN is escaped in every membership search", func(t *testing.T) {
+		utils.Config.Ldap.AdminDenyGroups = []string{"contractors"}
+		defer func() { utils.Config.Ldap.AdminDenyGroups = nil }()
+		hostileDN := "cn=al*ce)(cn=*,ou=users"
+
+		for _, request := range []*ldap.SearchRequest{
+			newUserGroupSearchRequest("ou=groups", hostileDN),
+			newUserAdminSearchRequest(hostileDN),
+			newAdminDenySearchRequest("ou=groups", hostileDN),
+		} {
+			assert.Contains(t, request.Filter, `(member=cn=al\2ace\29\28cn=\2a,ou=users)`)
+		}
+	})
+}
+
+// An ldap connection whose searches depend on the bound identity,
+// memberships of userView are only visible when bound as the user
+type fakeConn struct {
+	directory   fakeSearcher
+	userView    fakeSearcher
+	boundAsUser bool
+}
+
+func (c *fakeConn) Search(request *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	if entries, ok := c.userView[request.BaseDN]; ok && c.boundAsUser {
+		return &ldap.SearchResult{Entries: entries}, nil
+	}
+	return c.directory.Search(request)
+}
+
+func (c *fakeConn) Bind(username, password string) error {
+	if username != utils.Config.Ldap.BindDN && password != "secret" {
+		return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+	}
+	c.boundAsUser = username != utils.Config.Ldap.BindDN
+	return nil
+}
+
+func (c *fakeConn) Close() {}
+
+func TestAuthenticateUserGroups(t *testing.T) {
+	utils.Config = &types.Config{Ldap: types.LdapConfig{
+		UserBase:       "ou=users",
+		GroupBase:      "ou=groups",
+		AdminGroupBase: "ou=admins",
+		BindDN:         "cn=kubi,ou=services",
+		UserFilter:     "(cn=%s)",
+	}}
+	directory := fakeSearcher{
+		"ou=users":  {ldap.NewEntry("cn=alice,ou=users", nil)},
+		"ou=groups": {ldap.NewEntry("cn=team,ou=groups", map[string][]string{"cn": {"team"}})},
+		"ou=admins": {ldap.NewEntry("cn=cluster-admins,ou=admins", nil)},
+	}
+	userView := fakeSearcher{
+		"ou=groups": {ldap.NewEntry("cn=hidden-team,ou=groups", map[string][]string{"cn": {"hidden-team"}})},
+	}
+
+	connections := 0
+	defaultConnect := connect
+	connect = func() (ldapConn, error) {
+		connections++
+		return &fakeConn{directory: directory, userView: userView}, nil
+	}
+	defer func() { connect = defaultConnect }()
+
+	login := func() ([]string, bool, error) {
+		connections = 0
+		_, groups, hasAdminAccess, err := AuthenticateUserGroups("alice", "secret")
+		return groups, hasAdminAccess, err
+	}
+
+	t.Run("by default each lookup opens a connection", func(t *testing.T) {
+		groups, hasAdminAccess, err := login()
+
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"team"}, groups)
+		assert.True(t, hasAdminAccess)
+		assert.Equal(t, 3, connections)
+	})
+
+	t.Run("with connection reuse a login opens a single connection", func(t *testing.T) {
+		utils.Config.Ldap.ReuseConnection = true
+		defer func() { utils.Config.Ldap.ReuseConnection = false }()
+
+		groups, hasAdminAccess, err := login()
+
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"team"}, groups)
+		assert.True(t, hasAdminAccess)
+		assert.Equal(t, 1, connections)
+	})
+
+	t.Run("groups visible only to the user are returned when searching as user", func(t *testing.T) {
+		utils.Config.Ldap.SearchAsUser = true
+		defer func() { utils.Config.Ldap.SearchAsUser = false }()
+
+		groups, _, err := login()
+
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"hidden-team"}, groups)
+	})
+
+	t.Run("a wrong password is rejected", func(t *testing.T) {
+		_, _, _, err := AuthenticateUserGroups("alice", "wrong")
+
+		assert.Equal(t, ErrInvalidCredentials, errors.Cause(err))
+	})
+}
+
+// A connection refusing every bind with an error
+type refusingConn struct {
+	fakeConn
+	err error
+}
+
+func (c *refusingConn) Bind(username, password string) error {
+	return c.err
+}
+
+func TestBindUser(t *testing.T) {
+	utils.Config = &types.Config{}
+	bind := func(err error) error {
+		_, result := bindUser(&refusingConn{err: err}, "cn=alice,ou=users", "secret")
+		return errors.Cause(result)
+	}
+
+	t.Run("a wrong password is invalid credentials", func(t *testing.T) {
+		err := ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("80090308: LdapErr: DSID-0C09042A, comment: AcceptSecurityContext error, data 52e, v3839"))
+
+		assert.Equal(t, ErrInvalidCredentials, bind(err))
+	})
+
+	t.Run("an active directory locked account is locked", func(t *testing.T) {
+		err := ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("80090308: LdapErr: DSID-0C09042A, comment: AcceptSecurityContext error, data 775, v3839"))
+
+		assert.Equal(t, ErrAccountLocked, bind(err))
+	})
+
+	t.Run("a password policy lockout is locked", func(t *testing.T) {
+		err := ldap.NewError(ldap.LDAPResultConstraintViolation, errors.New("Exceed password retry limit. Please try later."))
+
+		assert.Equal(t, ErrAccountLocked, bind(err))
+	})
+}
+
+func TestSearchUserGroups(t *testing.T) {
+	utils.Config = &types.Config{Ldap: types.LdapConfig{
+		GroupBase:      "ou=groups",
+		AdminGroupBase: "ou=admins",
+	}}
+	userDN := "cn=alice,ou=users"
+	group := func(name string, base string) *ldap.Entry {
+		return ldap.NewEntry("cn="+name+","+base, map[string][]string{"cn": {name}})
+	}
+
+	t.Run("only the group base is searched by default", func(t *testing.T) {
+		conn := fakeSearcher{"ou=admins": {group("cluster-admins", "ou=admins")}}
+
+		result, err := searchUserGroups(conn, userDN)
+
+		assert.Nil(t, err)
+		assert.Empty(t, result)
+	})
+
+	t.Run("a membership only in the admin base is found", func(t *testing.T) {
+		utils.Config.Ldap.SearchAdminGroupBase = true
+		defer func() { utils.Config.Ldap.SearchAdminGroupBase = false }()
+		conn := fakeSearcher{"ou=admins": {group("cluster-admins", "ou=admins")}}
+
+		result, err := searchUserGroups(conn, userDN)
+
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"cluster-admins"}, result)
+	})
+
+	t.Run("groups found in both bases are deduplicated", func(t *testing.T) {
+		utils.Config.Ldap.SearchAdminGroupBase = true
+		defer func() { utils.Config.Ldap.SearchAdminGroupBase = false }()
+		conn := fakeSearcher{
+			"ou=groups": {group("team", "ou=groups"), group("ops", "ou=groups")},
+			"ou=admins": {group("ops", "ou=admins"), group("cluster-admins", "ou=admins")},
+		}
+
+		result, err := searchUserGroups(conn, userDN)
+
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"team", "ops", "cluster-admins"}, result)
+	})
+}
+
+// A directory always returning a full page and the same cookie
+type endlessPager struct {
+	searches int
+}
+
+func (e *endlessPager) Search(request *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	e.searches++
+	return &ldap.SearchResult{
+		Entries: []*ldap.Entry{
+			ldap.NewEntry("cn=group-a,ou=groups", nil),
+			ldap.NewEntry("cn=group-b,ou=groups", nil),
+		},
+		Controls: []ldap.Control{&ldap.ControlPaging{PagingSize: 2, Cookie: []byte("stuck")}},
+	}, nil
+}
+
+func TestPagedSearch(t *testing.T) {
+
+	t.Run("stops at the max pages with partial results", func(t *testing.T) {
+		utils.Config = &types.Config{Ldap: types.LdapConfig{MaxPages: 3}}
+		directory := &endlessPager{}
+
+		result, err := pagedSearch(directory, newGroupSearchRequest(), 2)
+
+		assert.Nil(t, err)
+		assert.Equal(t, 3, directory.searches)
+		assert.Len(t, result.Entries, 6)
+	})
+
+	t.Run("stops at the max entries with partial results", func(t *testing.T) {
+		utils.Config = &types.Config{Ldap: types.LdapConfig{MaxPages: 100, MaxEntries: 5}}
+		directory := &endlessPager{}
+
+		result, err := pagedSearch(directory, newGroupSearchRequest(), 2)
+
+		assert.Nil(t, err)
+		assert.Equal(t, 3, directory.searches)
+		assert.Len(t, result.Entries, 5)
+	})
+
+	t.Run("stops when the directory clears the cookie", func(t *testing.T) {
+		utils.Config = &types.Config{Ldap: types.LdapConfig{MaxPages: 100}}
+		directory := fakeSearcher{"ou=groups": {ldap.NewEntry("cn=group-a,ou=groups", nil)}}
+		request := newGroupSearchRequest()
+		request.BaseDN = "ou=groups"
+
+		result, err := pagedSearch(directory, request, 2)
+
+		assert.Nil(t, err)
+		assert.Len(t, result.Entries, 1)
+	})
+}
+
+func TestAttributeValues(t *testing.T) {
+	utils.Config = &types.Config{Ldap: types.LdapConfig{MaxAttrSize: 16}}
+	oversized := strings.Repeat("x", 1<<20)
+	entry := ldap.NewEntry("cn=group-a,ou=groups", map[string][]string{
+		"cn":          {oversized},
+		"description": {oversized, "short"},
+	})
+
+	t.Run("an oversized value is skipped", func(t *testing.T) {
+		assert.Empty(t, attributeValue(entry, "cn"))
+	})
+
+	t.Run("values within the size are kept", func(t *testing.T) {
+		assert.Equal(t, []string{"short"}, attributeValues(entry, "description"))
+	})
+
+	t.Run("a group with an oversized name is not returned", func(t *testing.T) {
+		utils.Config.Ldap.GroupBase = "ou=groups"
+		conn := fakeSearcher{"ou=groups": {entry, ldap.NewEntry("cn=group-b,ou=groups", map[string][]string{"cn": {"group-b"}})}}
+
+		groups, err := searchUserGroups(conn, "cn=alice,ou=users")
+
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"group-b"}, groups)
+	})
+}
+
+func TestCheckGroupCount(t *testing.T) {
+	utils.Config = &types.Config{Ldap: types.LdapConfig{GroupBase: "ou=groups", MaxGroups: 2, WarnNoGroups: true}}
+	var output bytes.Buffer
+	defaultLog := utils.Log
+	utils.Log = zerolog.New(&output)
+	defer func() { utils.Log = defaultLog }()
+
+	check := func(groups ...string) string {
+		output.Reset()
+		checkGroupCount("cn=alice,ou=users", groups)
+		return output.String()
+	}
+
+	t.Run("a user without groups is warned of", func(t *testing.T) {
+		assert.Contains(t, check(), "No group found")
+	})
+
+	t.Run("a user over the group ceiling is warned of", func(t *testing.T) {
+		assert.Contains(t, check("a", "b", "c"), "over LDAP_MAX_GROUPS 2")
+	})
+
+	t.Run("a plausible group count is not warned of", func(t *testing.T) {
+		assert.Empty(t, check("a", "b"))
+	})
+
+	t.Run("no warning for a user without groups unless asked", func(t *testing.T) {
+		utils.Config.Ldap.WarnNoGroups = false
+		defer func() { utils.Config.Ldap.WarnNoGroups = true }()
+
+		assert.Empty(t, check())
+	})
+}
+
+func newTestKeyPair(t *testing.T, name string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+
+	pair, err := tls.X509KeyPair(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}))
+	assert.Nil(t, err)
+	return pair
+}
+
+func TestClientCertificate(t *testing.T) {
+	server := newTestKeyPair(t, "ldap.example.com")
+	client := newTestKeyPair(t, "kubi")
+
+	// Handshake with a directory requiring a client certificate,
+	// return the certificate it was presented
+	handshake := func() ([]*x509.Certificate, error) {
+		listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+			Certificates: []tls.Certificate{server},
+			ClientAuth:   tls.RequireAnyClientCert,
+		})
+		assert.Nil(t, err)
+		defer listener.Close()
+
+		presented := make(chan []*x509.Certificate, 1)
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				presented <- nil
+				return
+			}
+			defer conn.Close()
+			directory := conn.(*tls.Conn)
+			directory.Handshake()
+			presented <- directory.ConnectionState().PeerCertificates
+		}()
+
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		assert.Nil(t, err)
+		defer conn.Close()
+		client := tls.Client(conn, newTLSConfig())
+		err = client.Handshake()
+		if err == nil {
+			// The directory rejects a missing certificate after the client handshake
+			_, err = client.Read(make([]byte, 1))
+		}
+		certificates := <-presented
+		if len(certificates) > 0 {
+			return certificates, nil
+		}
+		return nil, err
+	}
+
+	t.Run("the client certificate is presented to the directory", func(t *testing.T) {
+		utils.Config = &types.Config{Ldap: types.LdapConfig{
+			Host:                "ldap.example.com",
+			SkipTLSVerification: true,
+			ClientCertificates:  []tls.Certificate{client},
+		}}
+
+		certificates, err := handshake()
+
+		assert.Nil(t, err)
+		assert.Len(t, certificates, 1)
+		assert.Equal(t, "kubi", certificates[0].Subject.CommonName)
+	})
+
+	t.Run("the handshake fails without client certificate", func(t *testing.T) {
+		utils.Config = &types.Config{Ldap: types.LdapConfig{Host: "ldap.example.com", SkipTLSVerification: true}}
+
+		certificates, err := handshake()
+
+		assert.NotNil(t, err)
+		assert.Empty(t, certificates)
+	})
+}
@@ -3,9 +3,10 @@ package main
 import (
 	"github.com/ca-gip/kubi/services"
 	"github.com/ca-gip/kubi/utils"
-	"github.com/gorilla/mux"
 	"github.com/rs/zerolog/log"
+	"net"
 	"net/http"
+	"strconv"
 )
 
 func main() {
@@ -16,35 +17,49 @@ func main() {
 	}
 	utils.Config = config
 
-	// Generate namespace and role binding for ldap groups
-	// no need to wait here
+	if len(utils.Config.GroupNamespaceMapFile) > 0 {
+		services.WatchGroupMapping(utils.Config.GroupNamespaceMapFile, utils.Config.GroupNamespaceMapInterval)
+	}
 
-	utils.Log.Info().Msg("Generating resources from LDAP groups")
-	services.GenerateAdminClusterRoleBinding()
+	if len(utils.Config.GroupParserFile) > 0 {
+		services.WatchGroupParser(utils.Config.GroupParserFile, utils.Config.GroupParserInterval)
+	}
 
-	err = services.GenerateResourcesFromLdapGroups()
-	if err != nil {
-		log.Error().Err(err)
+	// JWKS keys only verify tokens in verify only mode
+	if utils.Config.VerifyOnly && len(utils.Config.JwksURLs) > 0 {
+		services.WatchJWKS(utils.Config.JwksURLs, utils.Config.JwksRefreshInterval)
+	} else if len(utils.Config.JwksURLs) > 0 {
+		utils.Log.Warn().Msg("VERIFY_JWKS_URLS is only used in verify only mode, it is not fetched")
 	}
 
-	router := mux.NewRouter()
-	router.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		w.WriteHeader(http.StatusNotFound)
-		utils.Log.Warn().Msgf("%d %s %s", http.StatusNotFound, req.Method, req.URL.String())
-	})
-	//router.Use(middlewares.LoggingMiddleware)
+	// Generate namespace and role binding for ldap groups
+	// no need to wait here, nor to do it in verify only mode
+	if !utils.Config.VerifyOnly {
+		utils.Log.Info().Msg("Generating resources from LDAP groups")
+		services.GenerateAdminClusterRoleBinding()
+
+		err = services.GenerateResourcesFromLdapGroups()
+		if err != nil {
+			log.Error().Err(err)
+		}
+	}
 
-	for _, prefix := range utils.ApiPrefix() {
-		router.PathPrefix(prefix).Methods(http.MethodGet, http.MethodPost, http.MethodPatch, http.MethodPut, http.MethodDelete, http.MethodOptions).HandlerFunc(services.ProxyHandler)
+	// Ops endpoints are served on their own listener when OPS_PORT is set
+	withOps := utils.Config.OpsPort == 0
+	router := services.NewRouter(withOps, utils.Config.VerifyOnly)
+	handler := http.Handler(router)
+	if utils.Config.AccessLog {
+		handler = services.WithAccessLog(handler)
 	}
 
-	router.HandleFunc("/ca", services.CA).Methods(http.MethodGet)
-	router.HandleFunc("/refresh", services.RefreshK8SResources).Methods(http.MethodGet) // TODO, protect from users
-	router.HandleFunc("/config", services.GenerateConfig).Methods(http.MethodGet)
-	router.HandleFunc("/token", services.GenerateJWT).Methods(http.MethodGet)
-	router.HandleFunc("/token/{username}", services.VerifyJWT).Methods(http.MethodPost)
+	if !withOps {
+		opsAddress := net.JoinHostPort(utils.Config.OpsAddress, strconv.Itoa(utils.Config.OpsPort))
+		if err := services.ListenOps(opsAddress); err != nil {
+			utils.Log.Fatal().Err(err).Msg("Ops listener is required")
+		}
+	}
 
 	utils.Log.Info().Msgf(" Preparing to serve request, port: %d", 8000)
-	utils.Log.Fatal().Err(http.ListenAndServeTLS(":8000", utils.TlsCertPath, utils.TlsKeyPath, router))
+	utils.Log.Fatal().Err(http.ListenAndServeTLS(":8000", utils.TlsCertPath, utils.TlsKeyPath, handler))
 
 }
@@ -0,0 +1,117 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/ca-gip/kubi/utils"
+	"net"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// Request id of the access log, taken from the client when well formed
+const requestIdHeader = "X-Request-Id"
+
+var validRequestId = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+type accessRecordKey struct{}
+
+// Fields of an access log record only known to the handlers
+type accessRecord struct {
+	user string
+}
+
+// Response writer keeping the status for the access log
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// Flush the response, for watches streamed through the proxy
+func (w *statusWriter) Flush() {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack the connection, for exec, attach and port-forward upgrades
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("the response writer does not support hijacking")
+	}
+	if w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return hijacker.Hijack()
+}
+
+// WithAccessLog log a json record per request, with ACCESS_LOG, for SIEM
+// ingestion. Only the method, path, status, duration, client ip, authenticated
+// user and request id are logged, never the query, headers or body
+func WithAccessLog(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		requestId := r.Header.Get(requestIdHeader)
+		if !validRequestId.MatchString(requestId) {
+			requestId = newRequestId()
+		}
+		w.Header().Set(requestIdHeader, requestId)
+
+		record := &accessRecord{}
+		writer := &statusWriter{ResponseWriter: w}
+		handler.ServeHTTP(writer, r.WithContext(context.WithValue(r.Context(), accessRecordKey{}, record)))
+
+		status := writer.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		event := utils.AccessLog.Info().
+			Str("method", r.Method).
+			Str("path", r.URL.Path).
+			Int("status", status).
+			Dur("duration", time.Since(start)).
+			Str("clientIp", clientIP(r)).
+			Str("requestId", requestId)
+		if len(record.user) > 0 {
+			event = event.Str("user", utils.RedactUser(record.user))
+		}
+		event.Send()
+	})
+}
+
+// Record the authenticated user of a request for its access log
+func setAccessUser(r *http.Request, user string) {
+	if record, ok := r.Context().Value(accessRecordKey{}).(*accessRecord); ok {
+		record.user = user
+	}
+}
+
+func newRequestId() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(id)
+}
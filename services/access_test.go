@@ -0,0 +1,141 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"github.com/ca-gip/kubi/types"
+	"github.com/ca-gip/kubi/utils"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWithAccessLog(t *testing.T) {
+	withConfig(t, &types.Config{})
+	var output bytes.Buffer
+	defaultAccessLog := utils.AccessLog
+	utils.AccessLog = zerolog.New(&output)
+	defer func() { utils.AccessLog = defaultAccessLog }()
+
+	serve := func(handler http.HandlerFunc, request *http.Request) (*httptest.ResponseRecorder, map[string]interface{}) {
+		output.Reset()
+		recorder := httptest.NewRecorder()
+		WithAccessLog(handler).ServeHTTP(recorder, request)
+
+		record := map[string]interface{}{}
+		assert.Nil(t, json.Unmarshal(output.Bytes(), &record))
+		return recorder, record
+	}
+
+	t.Run("an authenticated request is logged with its user", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodGet, "/token?ttl=1h", nil)
+		request.SetBasicAuth("alice", "a-password")
+		request.Header.Set(requestIdHeader, "a-request")
+
+		recorder, record := serve(func(w http.ResponseWriter, r *http.Request) {
+			setAccessUser(r, "alice")
+			w.Write([]byte("a-token"))
+		}, request)
+
+		assert.Equal(t, "GET", record["method"])
+		assert.Equal(t, "/token", record["path"])
+		assert.Equal(t, float64(http.StatusOK), record["status"])
+		assert.Contains(t, record, "duration")
+		assert.Equal(t, "192.0.2.1", record["clientIp"])
+		assert.Equal(t, "alice", record["user"])
+		assert.Equal(t, "a-request", record["requestId"])
+		assert.Equal(t, "a-request", recorder.Header().Get(requestIdHeader))
+		assert.NotContains(t, output.String(), "a-password")
+		assert.NotContains(t, output.String(), "a-token")
+	})
+
+	t.Run("a rejected request is logged without user", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodGet, "/config", nil)
+		request.SetBasicAuth("mallory", "a-guess")
+
+		recorder, record := serve(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnauthorized)
+		}, request)
+
+		assert.Equal(t, float64(http.StatusUnauthorized), record["status"])
+		assert.NotContains(t, record, "user")
+		assert.NotEmpty(t, record["requestId"])
+		assert.Equal(t, record["requestId"], recorder.Header().Get(requestIdHeader))
+		assert.NotContains(t, output.String(), "a-guess")
+	})
+}
+
+func TestAccessLogProxyStreams(t *testing.T) {
+	release := make(chan struct{})
+	apiServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "" {
+			conn, buffer, err := w.(http.Hijacker).Hijack()
+			assert.Nil(t, err)
+			defer conn.Close()
+			buffer.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: SPDY/3.1\r\n\r\n")
+			buffer.Flush()
+			line, _ := buffer.ReadString('\n')
+			buffer.WriteString("echo " + line)
+			buffer.Flush()
+			return
+		}
+		// A watch sends its first event and waits for the next
+		w.Write([]byte("{\"type\":\"ADDED\"}\n"))
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer apiServer.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(apiServer.Certificate())
+	withConfig(t, &types.Config{ApiServerURL: apiServer.URL, ApiServerTLSConfig: tls.Config{RootCAs: roots}})
+
+	// Hijacked connections are not waited for by Close
+	var handlers sync.WaitGroup
+	proxy := WithAccessLog(http.HandlerFunc(ProxyHandler))
+	kubi := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlers.Add(1)
+		defer handlers.Done()
+		proxy.ServeHTTP(w, r)
+	}))
+	defer kubi.Close()
+	defer handlers.Wait()
+
+	t.Run("an exec upgrade reaches the api server", func(t *testing.T) {
+		conn, err := net.Dial("tcp", kubi.Listener.Addr().String())
+		assert.Nil(t, err)
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		io.WriteString(conn, "POST /api/v1/namespaces/demo/pods/web/exec HTTP/1.1\r\nHost: kubi\r\nConnection: Upgrade\r\nUpgrade: SPDY/3.1\r\n\r\n")
+		reader := bufio.NewReader(conn)
+		response, err := http.ReadResponse(reader, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusSwitchingProtocols, response.StatusCode)
+
+		io.WriteString(conn, "ls\n")
+		line, err := reader.ReadString('\n')
+		assert.Nil(t, err)
+		assert.Equal(t, "echo ls\n", line)
+	})
+
+	t.Run("a watch event is flushed to the client", func(t *testing.T) {
+		defer close(release)
+		client := &http.Client{Timeout: 5 * time.Second}
+		response, err := client.Get(kubi.URL + "/api/v1/pods?watch=true")
+		assert.Nil(t, err)
+		defer response.Body.Close()
+
+		line, err := bufio.NewReader(response.Body).ReadString('\n')
+		assert.Nil(t, err)
+		assert.Equal(t, "{\"type\":\"ADDED\"}\n", line)
+	})
+}
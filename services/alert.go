@@ -0,0 +1,65 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/ca-gip/kubi/types"
+	"github.com/ca-gip/kubi/utils"
+	"net/http"
+	"time"
+)
+
+// Deliveries tried for an admin alert, with a growing delay in between
+const adminAlertAttempts = 3
+
+var adminAlertClient = &http.Client{Timeout: 5 * time.Second}
+var adminAlertRetryDelay = time.Second
+
+// Event posted to ADMIN_ALERT_WEBHOOK_URL, the token itself is never sent
+type adminAlert struct {
+	Event    string    `json:"event"`
+	User     string    `json:"user"`
+	SourceIP string    `json:"source_ip"`
+	Time     time.Time `json:"time"`
+}
+
+// Alert security when an admin token is issued. The alert is delivered
+// in background, the user response never waits for it
+func alertAdminToken(claims *types.AuthJWTClaims, sourceIP string) {
+	url := utils.Config.AdminAlertWebhookURL
+	if len(url) == 0 || !claims.AdminAccess {
+		return
+	}
+	go postAdminAlert(url, adminAlert{
+		Event:    "admin_token_issued",
+		User:     claims.User,
+		SourceIP: sourceIP,
+		Time:     time.Unix(claims.IssuedAt, 0).UTC(),
+	})
+}
+
+// Post an alert, retried briefly, an undelivered alert is logged
+func postAdminAlert(url string, alert adminAlert) {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		utils.Log.Error().Msgf("Cannot encode the admin alert: %v", err)
+		return
+	}
+
+	for attempt := 1; attempt <= adminAlertAttempts; attempt++ {
+		response, err := adminAlertClient.Post(url, "application/json", bytes.NewReader(body))
+		if err == nil {
+			response.Body.Close()
+			if response.StatusCode < http.StatusMultipleChoices {
+				return
+			}
+			err = fmt.Errorf("unexpected status %d", response.StatusCode)
+		}
+		utils.Log.Warn().Msgf("Admin alert delivery %d/%d to %s failed: %v", attempt, adminAlertAttempts, url, err)
+		if attempt < adminAlertAttempts {
+			time.Sleep(time.Duration(attempt) * adminAlertRetryDelay)
+		}
+	}
+	utils.Log.Error().Msgf("Admin alert for %s not delivered to %s", utils.RedactUser(alert.User), url)
+}
@@ -0,0 +1,63 @@
+package services
+
+import (
+	"encoding/json"
+	"github.com/ca-gip/kubi/types"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAlertAdminToken(t *testing.T) {
+	alerts := make(chan adminAlert, 10)
+	sink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert adminAlert
+		json.NewDecoder(r.Body).Decode(&alert)
+		alerts <- alert
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer sink.Close()
+	withConfig(t, &types.Config{AdminAlertWebhookURL: sink.URL})
+	issuedAt := time.Date(2019, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	t.Run("an admin token fires the webhook", func(t *testing.T) {
+		claims := &types.AuthJWTClaims{User: "admin", AdminAccess: true}
+		claims.IssuedAt = issuedAt.Unix()
+
+		alertAdminToken(claims, "10.0.0.7")
+
+		select {
+		case alert := <-alerts:
+			assert.Equal(t, adminAlert{Event: "admin_token_issued", User: "admin", SourceIP: "10.0.0.7", Time: issuedAt}, alert)
+		case <-time.After(5 * time.Second):
+			t.Fatal("no alert received")
+		}
+	})
+
+	t.Run("a normal token does not", func(t *testing.T) {
+		alertAdminToken(&types.AuthJWTClaims{User: "demo"}, "10.0.0.8")
+
+		select {
+		case alert := <-alerts:
+			t.Fatalf("unexpected alert for %s", alert.User)
+		case <-time.After(200 * time.Millisecond):
+		}
+	})
+
+	t.Run("a failed delivery is retried", func(t *testing.T) {
+		adminAlertRetryDelay = time.Millisecond
+		defer func() { adminAlertRetryDelay = time.Second }()
+		attempts := 0
+		failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempts++
+			w.WriteHeader(http.StatusBadGateway)
+		}))
+		defer failing.Close()
+
+		postAdminAlert(failing.URL, adminAlert{User: "admin"})
+
+		assert.Equal(t, adminAlertAttempts, attempts)
+	})
+}
@@ -0,0 +1,47 @@
+package services
+
+import (
+	"fmt"
+	"github.com/ca-gip/kubi/types"
+	"github.com/ca-gip/kubi/utils"
+	"github.com/dgrijalva/jwt-go"
+	"net/http"
+	"time"
+)
+
+// Sign a login assertion for a downstream system, with its own key
+// It's independent from the kubectl token
+func signAssertion(username string, source string) (string, error) {
+	method := jwt.GetSigningMethod(utils.Config.AssertionSigningMethod)
+	if method == nil {
+		return "", fmt.Errorf("unknown ASSERTION_SIGNING_METHOD %s", utils.Config.AssertionSigningMethod)
+	}
+	key, err := signKey(method, utils.Config.AssertionKey)
+	if err != nil {
+		return "", err
+	}
+
+	claims := types.AssertionClaims{
+		User:   username,
+		Source: source,
+		StandardClaims: jwt.StandardClaims{
+			IssuedAt: time.Now().Unix(),
+			Issuer:   "Kubi Server",
+		},
+	}
+	return jwt.NewWithClaims(method, claims).SignedString(key)
+}
+
+// Add the login assertion header, only when an assertion key is configured
+func setAssertionHeader(w http.ResponseWriter, r *http.Request, username string) {
+	if len(utils.Config.AssertionKey) == 0 {
+		return
+	}
+
+	assertion, err := signAssertion(username, clientIP(r))
+	if err != nil {
+		utils.Log.Error().Msgf("Cannot sign the login assertion: %v", err)
+		return
+	}
+	w.Header().Set("X-Assertion", assertion)
+}
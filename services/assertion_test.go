@@ -0,0 +1,49 @@
+package services
+
+import (
+	"github.com/ca-gip/kubi/types"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSetAssertionHeader(t *testing.T) {
+	request := httptest.NewRequest(http.MethodGet, "/token", nil)
+	request.RemoteAddr = "10.0.0.1:45678"
+
+	t.Run("when enabled the assertion verifies against its own key", func(t *testing.T) {
+		withConfig(t, &types.Config{AssertionKey: []byte("an-assertion-key"), AssertionSigningMethod: "HS256"})
+		recorder := httptest.NewRecorder()
+
+		setAssertionHeader(recorder, request, "alice")
+
+		header := recorder.Header().Get("X-Assertion")
+		assert.NotEmpty(t, header)
+
+		claims := &types.AssertionClaims{}
+		token, err := jwt.ParseWithClaims(header, claims, func(token *jwt.Token) (interface{}, error) {
+			return []byte("an-assertion-key"), nil
+		})
+		assert.Nil(t, err)
+		assert.True(t, token.Valid)
+		assert.Equal(t, "alice", claims.User)
+		assert.Equal(t, "10.0.0.1", claims.Source)
+		assert.NotZero(t, claims.IssuedAt)
+
+		_, err = jwt.ParseWithClaims(header, &types.AssertionClaims{}, func(token *jwt.Token) (interface{}, error) {
+			return []byte("a-signing-key"), nil
+		})
+		assert.NotNil(t, err)
+	})
+
+	t.Run("when disabled there is no assertion", func(t *testing.T) {
+		withConfig(t, &types.Config{})
+		recorder := httptest.NewRecorder()
+
+		setAssertionHeader(recorder, request, "alice")
+
+		assert.Empty(t, recorder.Header().Get("X-Assertion"))
+	})
+}
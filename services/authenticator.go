@@ -2,16 +2,18 @@ package services
 
 import (
 	"encoding/base64"
-	"errors"
+	"encoding/json"
 	"fmt"
 	"github.com/ca-gip/kubi/authenticator"
 	"github.com/ca-gip/kubi/types"
 	"github.com/ca-gip/kubi/utils"
 	"github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
 	"gopkg.in/yaml.v2"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -20,62 +22,242 @@ var Config *types.Config
 
 var signingKey, _ = ioutil.ReadFile(utils.TlsKeyPath)
 
-func generateUserToken(groups []string, username string, hasAdminAccess bool) (string, error) {
-	var auths = GetUserNamespaces(groups)
+var (
+	ErrAuthHeaderTooLarge   = errors.New("Authorization header too large")
+	ErrPasswordTooShort     = errors.New("Password shorter than the minimum length")
+	ErrVerifyOnly           = errors.New("Tokens are not issued in verify only mode")
+	ErrTokenTooLong         = errors.New("Token lifetime longer than the maximum accepted")
+	ErrInvalidTTL           = errors.New("Invalid token ttl")
+	ErrInvalidBasicAuth     = errors.New("Invalid Auth")
+	ErrMalformedBasicAuth   = errors.New("Malformed basic auth credentials")
+	ErrMissingClaims        = errors.New("Token without the required claims")
+	ErrUnsupportedVersion   = errors.New("Unsupported token version")
+	ErrTooFewNamespaces     = errors.New("Not enough namespaces for a kubeconfig")
+	ErrInvalidImpersonation = errors.New("Invalid impersonation")
+	ErrImpersonationDenied  = errors.New("Impersonation is reserved to admins")
+	ErrImpersonationRefused = errors.New("Impersonation not allowed")
+	ErrRefreshTooOld        = errors.New("Token refreshed for longer than the refresh max age, a new login is required")
+)
+
+// Version of the token claims, to increase when they change
+const tokenVersion = 1
+
+// Context a token is issued for
+type tokenBinding struct {
+	audience string
+	issuedIP string
+	userDN   string
+	lifetime time.Duration
+}
+
+func generateUserToken(groups []string, username string, hasAdminAccess bool, binding tokenBinding) (string, *types.AuthJWTClaims, error) {
+	claims, err := newUserClaims(userAuths(groups), username, hasAdminAccess, binding)
+	if err != nil {
+		return "", nil, err
+	}
+	token, err := issueUserToken(claims, binding)
+	return token, claims, err
+}
+
+// Namespaces granted to the groups of a user
+func userAuths(groups []string) []*types.AuthJWTTupple {
+	auths := GetUserNamespaces(groups)
+	if len(utils.Config.RolePrivilegeOrder) > 0 {
+		auths = mergeRoles(auths, utils.Config.RolePrivilegeOrder)
+	}
+	return pendings.Filter(auths)
+}
 
-	duration, err := time.ParseDuration(utils.Config.TokenLifeTime)
-	time := time.Now().Add(duration)
+// Count a token in the quota of its user, then sign it
+func issueUserToken(claims *types.AuthJWTClaims, binding tokenBinding) (string, error) {
+	if !tokenQuotas.Allow(quotaAccount(claims.User, binding.userDN), claims.AdminAccess) {
+		utils.Log.Warn().Msgf("Daily token quota exceeded for %s", utils.RedactUser(claims.User))
+		return "", ErrTokenQuotaExceeded
+	}
+	return signClaims(claims)
+}
+
+// Sign a new token for already resolved namespaces
+func signUserToken(auths []*types.AuthJWTTupple, username string, hasAdminAccess bool, binding tokenBinding) (string, *types.AuthJWTClaims, error) {
+	claims, err := newUserClaims(auths, username, hasAdminAccess, binding)
+	if err != nil {
+		return "", nil, err
+	}
+	token, err := signClaims(claims)
+	return token, claims, err
+}
+
+// Claims of a new token, nothing is signed yet
+func newUserClaims(auths []*types.AuthJWTTupple, username string, hasAdminAccess bool, binding tokenBinding) (*types.AuthJWTClaims, error) {
+	if utils.Config.VerifyOnly {
+		return nil, ErrVerifyOnly
+	}
+
+	duration := binding.lifetime
+	if duration <= 0 {
+		lifetime, err := time.ParseDuration(utils.Config.TokenLifeTime)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid token lifetime %s", utils.Config.TokenLifeTime)
+		}
+		duration = lifetime
+	}
+	issuedAt := time.Now()
+	expiresAt := issuedAt.Add(duration)
+
+	id, err := newTokenId()
+	if err != nil {
+		return nil, err
+	}
 
 	// Create the Claims
 	claims := types.AuthJWTClaims{
-		auths,
-		username,
-		hasAdminAccess,
-		jwt.StandardClaims{
-			ExpiresAt: time.Unix(),
+		Auths:       auths,
+		User:        username,
+		AdminAccess: hasAdminAccess,
+		Instance:    utils.Config.InstanceName,
+		IssuedIP:    binding.issuedIP,
+		Version:     tokenVersion,
+		StandardClaims: jwt.StandardClaims{
+			Id:        id,
+			Audience:  binding.audience,
+			IssuedAt:  issuedAt.Unix(),
+			ExpiresAt: expiresAt.Unix(),
 			Issuer:    "Kubi Server",
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS512, claims)
-	signedToken, err := token.SignedString(signingKey)
+	// The directory entry is only disclosed with INCLUDE_USER_DN
+	if utils.Config.IncludeUserDN {
+		claims.UserDN = binding.userDN
+	}
+	if utils.Config.SingleUseTokens {
+		if claims.Nonce, err = newTokenId(); err != nil {
+			return nil, err
+		}
+	}
+	return &claims, nil
+}
+
+// Sign claims, the token is only logged as issued once signed
+func signClaims(claims *types.AuthJWTClaims) (string, error) {
+	method, err := signingMethod()
+	if err != nil {
+		return "", err
+	}
+	key, err := signKey(method, signingKey)
+	if err != nil {
+		return "", err
+	}
+
+	token := jwt.NewWithClaims(method, *claims)
+	token.Header["kid"] = signingKeyId(publicPart(key))
+	signedToken, err := token.SignedString(key)
+	if err == nil {
+		utils.Log.Info().Msgf("Token issued for %s, expires at %v", utils.RedactUser(claims.User), claims.ExpiresAt)
+		utils.Metrics.Add("tokens_issued", 1)
+		logGrant(claims)
+		tokenActivities.Touch(claims.Id, claims.ExpiresAt)
+	}
 
 	return signedToken, err
 }
 
-func baseGenerateToken(auth types.Auth) (*string, error) {
+// Log an authorization grant for compliance
+// Only the claims are logged, the signed token must never be.
+// The username is never redacted here, it's the audit record
+func logGrant(claims *types.AuthJWTClaims) {
+	if !utils.Config.GrantLog {
+		return
+	}
+	utils.GrantLog.Info().
+		Str("user", claims.User).
+		Interface("auths", claims.Auths).
+		Bool("adminAccess", claims.AdminAccess).
+		Int64("expiresAt", claims.ExpiresAt).
+		Str("instance", claims.Instance).
+		Msg("authorization granted")
+}
 
-	userDN, err := ldap.AuthenticateUser(auth.Username, auth.Password)
+func baseGenerateToken(auth types.Auth) (*string, *types.AuthJWTClaims, error) {
+	claims, binding, err := authorizeUser(auth)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	groups, err := ldap.GetUserGroups(*userDN)
+	token, err := issueToken(claims, binding)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	return &token, claims, nil
+}
+
+// Authenticate the user and resolve the claims of its token
+// Nothing is signed, counted in the quota or alerted yet
+func authorizeUser(auth types.Auth) (*types.AuthJWTClaims, tokenBinding, error) {
+
+	// Clearly invalid credentials never reach the directory
+	if len(auth.Password) < utils.Config.MinPasswordLength {
+		return nil, tokenBinding{}, ErrPasswordTooShort
 	}
-	token, err := generateUserToken(groups, auth.Username, ldap.HasAdminAccess(*userDN))
 
+	audience, err := clusterAudience(auth.Cluster)
 	if err != nil {
-		return nil, err
+		return nil, tokenBinding{}, err
+	}
+
+	userDN, groups, hasAdminAccess, err := ldap.AuthenticateUserGroups(auth.Username, auth.Password)
+	if err != nil {
+		return nil, tokenBinding{}, err
+	}
+	binding := tokenBinding{audience: audience, issuedIP: auth.SourceIP, userDN: *userDN, lifetime: auth.Lifetime}
+	claims, err := newUserClaims(userAuths(groups), auth.Username, hasAdminAccess, binding)
+	return claims, binding, err
+}
+
+// Issue the token of authorized claims, admins tokens are alerted
+func issueToken(claims *types.AuthJWTClaims, binding tokenBinding) (string, error) {
+	token, err := issueUserToken(claims, binding)
+	if err != nil {
+		return "", err
 	}
-	return &token, nil
+	alertAdminToken(claims, binding.issuedIP)
+	return token, nil
 }
 
 func GenerateJWT(w http.ResponseWriter, r *http.Request) {
+	setNoStoreHeaders(w)
 	err, auth := basicAuth(r)
 	if err != nil {
 		utils.Log.Info().Err(err)
-		w.WriteHeader(http.StatusUnauthorized)
-		io.WriteString(w, "Basic Auth: Invalid credentials")
+		writeBasicAuthError(w, err)
+		return
 	}
 
-	token, err := baseGenerateToken(*auth)
+	auth.Lifetime, err = requestLifetime(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, err.Error())
+		return
+	}
 
-	if token != nil {
-		w.WriteHeader(http.StatusOK)
-		io.WriteString(w, *token)
+	token, claims, err := baseGenerateToken(*auth)
+
+	if err != nil {
+		utils.Log.Info().Msg(err.Error())
+		writeTokenError(w, err)
+		return
 	}
+	setAccessUser(r, claims.User)
+
+	setExpiryHeader(w, claims)
+	setLinkHeaders(w)
+	setAssertionHeader(w, r, auth.Username)
+	if wantsJSON(r) {
+		writeTokenJSON(w, *token, claims)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, *token)
 
 }
 
@@ -83,95 +265,553 @@ func GenerateJWT(w http.ResponseWriter, r *http.Request) {
 // and cluster information. It can be directly used out of the box
 // by kubectl. It return a well formatted yaml
 func GenerateConfig(w http.ResponseWriter, r *http.Request) {
+	setNoStoreHeaders(w)
+	// A PKCS#12 bundle holds a client certificate and key, and kubeconfigs
+	// only carry tokens. Said plainly rather than answering a yaml config
+	if r.URL.Query().Get("format") == "p12" {
+		w.WriteHeader(http.StatusNotImplemented)
+		io.WriteString(w, "PKCS#12 output needs client certificate kubeconfigs, kubi only issues tokens")
+		return
+	}
 	err, auth := basicAuth(r)
 
 	if err != nil {
 		utils.Log.Info().Err(err)
 		utils.Log.Info().Msg(err.Error())
-		w.WriteHeader(http.StatusUnauthorized)
-		io.WriteString(w, "Basic Auth: Invalid credentials")
+		writeBasicAuthError(w, err)
+		return
 	}
 
-	token, err := baseGenerateToken(*auth)
+	if status, err := readConfigParams(r, auth); err != nil {
+		w.WriteHeader(status)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	if r.URL.Query().Get("type") == "bootstrap" {
+		generateBootstrapConfig(w, *auth)
+		return
+	}
+
+	yml, token, claims, err := generateConfigYaml("https://"+r.Host, *auth)
 
 	if err != nil {
-		utils.Log.Info().Err(err)
-		w.WriteHeader(http.StatusUnauthorized)
+		utils.Log.Info().Msg(err.Error())
+		writeTokenError(w, err)
 		return
 	}
+	setAccessUser(r, claims.User)
 
-	config := &types.KubeConfig{
-		ApiVersion: "v1",
-		Kind:       "Config",
-		Clusters: []types.KubeConfigCluster{
-			{
-				Name: "kubernetes",
-				Cluster: types.KubeConfigClusterData{
-					Server:          "https://" + r.Host,
-					CertificateData: utils.Config.KubeCa,
-				},
-			},
-		},
-		CurrentContext: "kubernetes" + "-" + auth.Username,
-		Contexts: []types.KubeConfigContext{
-			{
-				Name: "kubernetes" + "-" + auth.Username,
-				Context: types.KubeConfigContextData{
-					Cluster: "kubernetes",
-					User:    auth.Username,
-				},
-			},
-		},
-		Users: []types.KubeConfigUser{
-			{
-				User: types.KubeConfigUserToken{Token: *token},
-				Name: auth.Username},
-		},
+	setExpiryHeader(w, claims)
+	setLinkHeaders(w)
+	setTokenHeader(w, token)
+	yml = withAdminBanner(w, yml, claims)
+	w.Header().Set("Content-Type", "text/x-yaml; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(yml)
+
+}
+
+// Read the ttl, impersonation and cluster parameters of a config request
+// The status to answer comes with the error
+func readConfigParams(r *http.Request, auth *types.Auth) (int, error) {
+	var err error
+	if auth.Lifetime, err = requestLifetime(r); err != nil {
+		return http.StatusBadRequest, err
 	}
+	if auth.ImpersonateUser, auth.ImpersonateGroups, err = requestImpersonation(r); err != nil {
+		return http.StatusBadRequest, err
+	}
+	if auth.ConfigCluster, err = requestConfigCluster(r); err != nil {
+		return http.StatusNotFound, err
+	}
+	return 0, nil
+}
 
+// Authenticate the user and marshal its kubeconfig
+// The token and its claims are also returned for the response headers
+func generateConfigYaml(server string, auth types.Auth) ([]byte, string, *types.AuthJWTClaims, error) {
+	config, claims, binding, err := buildKubeConfig(server, auth)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	token, err := issueToken(claims, binding)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	withToken(config, token)
 	yml, err := yaml.Marshal(config)
+	return yml, token, claims, err
+}
 
-	utils.Log.Error().Err(err)
-	w.WriteHeader(http.StatusCreated)
-	w.Header().Set("Content-Type", "text/x-yaml; charset=utf-8")
-	w.Write(yml)
+// Authenticate the user and build its kubeconfig, still without a token
+// A config refused here costs no signature, quota or admin alert
+func buildKubeConfig(server string, auth types.Auth) (*types.KubeConfig, *types.AuthJWTClaims, tokenBinding, error) {
+	claims, binding, err := authorizeUser(auth)
+	if err != nil {
+		return nil, nil, binding, err
+	}
+	if err := verifyConfigNamespaces(claims); err != nil {
+		return nil, nil, binding, err
+	}
 
+	config := newKubeConfig(server, auth.Username, "", claims.Auths, claims.AdminAccess)
+	if err := withImpersonation(config, auth, claims); err != nil {
+		return nil, nil, binding, err
+	}
+	if err := withSingleCluster(config, auth.ConfigCluster); err != nil {
+		return nil, nil, binding, err
+	}
+	return config, claims, binding, nil
 }
 
-func VerifyJWT(w http.ResponseWriter, r *http.Request) {
-	bodyString, err := ioutil.ReadAll(r.Body)
-	token, err := jwt.ParseWithClaims(string(bodyString), &types.AuthJWTClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return signingKey, nil
+// A kubeconfig is only given to users with MIN_NAMESPACES_FOR_CONFIG namespaces,
+// so half provisioned accounts do not get a config that seems to work.
+// Admins are not concerned, their access is cluster wide
+func verifyConfigNamespaces(claims *types.AuthJWTClaims) error {
+	if claims.AdminAccess || len(claims.Auths) >= utils.Config.MinNamespacesForConfig {
+		return nil
+	}
+	return errors.Wrapf(ErrTooFewNamespaces, "%d namespaces granted, %d are required. Check your groups with your administrator",
+		len(claims.Auths), utils.Config.MinNamespacesForConfig)
+}
+
+// Remind admins that their token grants cluster-admin,
+// with a header and a yaml comment ignored by kubectl
+func withAdminBanner(w http.ResponseWriter, yml []byte, claims *types.AuthJWTClaims) []byte {
+	if !utils.Config.AdminConfigBanner || !claims.AdminAccess {
+		return yml
+	}
+	w.Header().Set("X-Admin", "true")
+	banner := fmt.Sprintf("# WARNING: this token grants cluster-admin access to %s.\n# It expires at %s.\n",
+		claims.User, time.Unix(claims.ExpiresAt, 0).UTC().Format(time.RFC3339))
+	return append([]byte(banner), yml...)
+}
+
+// Token lifetime requested with the ttl parameter, zero when omitted
+// A ttl under MIN_TTL is raised to it, a ttl over MAX_TTL is rejected
+func requestLifetime(r *http.Request) (time.Duration, error) {
+	ttl := r.URL.Query().Get("ttl")
+	if len(ttl) == 0 {
+		return 0, nil
+	}
+
+	lifetime, err := time.ParseDuration(ttl)
+	if err != nil || lifetime <= 0 {
+		return 0, errors.Wrapf(ErrInvalidTTL, "%s is not a positive duration", ttl)
+	}
+	if lifetime > utils.Config.MaxTTL {
+		return 0, errors.Wrapf(ErrInvalidTTL, "%s is over the maximum of %v", ttl, utils.Config.MaxTTL)
+	}
+	if lifetime < utils.Config.MinTTL {
+		return utils.Config.MinTTL, nil
+	}
+	return lifetime, nil
+}
+
+// Token response for OAuth style clients
+type tokenResponse struct {
+	Token     string `json:"token"`
+	ExpiresIn int64  `json:"expires_in"`
+	ExpiresAt string `json:"expires_at"`
+}
+
+// User and groups to impersonate, from the impersonate-user
+// and impersonate-group parameters. Kubernetes does not allow
+// groups without a user to impersonate
+func requestImpersonation(r *http.Request) (string, []string, error) {
+	user := r.URL.Query().Get("impersonate-user")
+	groups := r.URL.Query()["impersonate-group"]
+	if len(user) == 0 && len(groups) > 0 {
+		return "", nil, errors.Wrap(ErrInvalidImpersonation, "impersonate-group requires impersonate-user")
+	}
+	return user, groups, nil
+}
+
+// Single cluster asked with the cluster parameter, the kubi cluster
+// or one of CLUSTERS. Empty when all clusters are asked
+func requestConfigCluster(r *http.Request) (string, error) {
+	name := r.URL.Query().Get("cluster")
+	if len(name) == 0 || name == defaultClusterName {
+		return name, nil
+	}
+	if _, ok := utils.Config.Clusters[name]; !ok {
+		return "", errors.Wrapf(ErrClusterNotFound, "%s", name)
+	}
+	return name, nil
+}
+
+// A json token is asked with format=json or an Accept header,
+// the bare token stays the default
+func wantsJSON(r *http.Request) bool {
+	return r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+func writeTokenJSON(w http.ResponseWriter, token string, claims *types.AuthJWTClaims) {
+	body, err := json.Marshal(tokenResponse{
+		Token:     token,
+		ExpiresIn: claims.ExpiresAt - time.Now().Unix(),
+		ExpiresAt: time.Unix(claims.ExpiresAt, 0).UTC().Format(time.RFC3339),
 	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
 
-	if claims, ok := token.Claims.(*types.AuthJWTClaims); ok && token.Valid {
-		utils.Log.Info().Msgf("%v %v", claims.Auths, claims.StandardClaims.ExpiresAt)
-	} else {
-		utils.Log.Info().Msgf("%b", err)
+// Responses carrying a token must not be kept by a cache or a proxy
+func setNoStoreHeaders(w http.ResponseWriter) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Vary", "Authorization")
+}
+
+// Related endpoints of a token response, for clients to discover them,
+// under ROUTE_PREFIX. The JWKS is only linked when the signing key has a public part
+func setLinkHeaders(w http.ResponseWriter) {
+	if !utils.Config.LinkHeaders {
+		return
+	}
+	link := func(path string, rel string) string {
+		return fmt.Sprintf(`<%s%s>; rel="%s"`, utils.Config.RoutePrefix, path, rel)
+	}
+	links := []string{link("/token/refresh", "refresh"), link("/whoami", "whoami"), link("/config/preview", "preview")}
+	if method, err := signingMethod(); err == nil {
+		if _, isHMAC := method.(*jwt.SigningMethodHMAC); !isHMAC {
+			links = append(links, link("/jwks", "jwks"))
+		}
+	}
+	w.Header().Set("Link", strings.Join(links, ", "))
+}
+
+// Expiry of the issued token, for clients to renew in time
+func setExpiryHeader(w http.ResponseWriter, claims *types.AuthJWTClaims) {
+	w.Header().Set("X-Token-Expires-At", time.Unix(claims.ExpiresAt, 0).UTC().Format(time.RFC3339))
+}
+
+// Tell the clients of a token expiring within EXPIRY_WARNING_WINDOW
+// the seconds left, so they refresh it before it is rejected
+func setExpiresInHeader(w http.ResponseWriter, claims *types.AuthJWTClaims) {
+	window := utils.Config.ExpiryWarningWindow
+	left := time.Until(time.Unix(claims.ExpiresAt, 0))
+	if window <= 0 || left > window {
+		return
 	}
+	utils.Log.Info().Msgf("Token of %s expires in %v", utils.RedactUser(claims.User), left.Round(time.Second))
+	w.Header().Set("X-Token-Expires-In", strconv.FormatInt(int64(left/time.Second), 10))
+}
 
+// In tokenFile mode, the token is delivered in a header
+// to be saved at the KUBECONFIG_TOKEN_FILE path
+func setTokenHeader(w http.ResponseWriter, token string) {
+	if len(utils.Config.KubeConfigTokenFile) > 0 {
+		w.Header().Set("X-Kubi-Token", token)
+	}
+}
+
+// VerifyJWT answer 200 to a valid token, and 401 to a token failing
+// any check: signature, expiry, claims, audience, nonce, id or idle time
+func VerifyJWT(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		utils.Log.Info().Msgf("Cannot read the token to verify: %v", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	claims, err := verifyToken(string(body), r)
+	if err != nil {
+		utils.Log.Info().Msgf("Token rejected: %v", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	setExpiresInHeader(w, claims)
+	setAccessUser(r, claims.User)
+	utils.Log.Info().Msgf("%v %v, issued by %v", claims.Auths, claims.StandardClaims.ExpiresAt, claims.Instance)
 	w.WriteHeader(http.StatusOK)
 }
 
+// Parse a token presented to the verify webhook and run every check on it
+func verifyToken(tokenString string, r *http.Request) (*types.AuthJWTClaims, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &types.AuthJWTClaims{}, verifyKeyFunc)
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := token.Claims.(*types.AuthJWTClaims)
+	if !ok || !token.Valid {
+		return nil, errors.New("Invalid token")
+	}
+	if err := verifyAudience(claims, requestCluster(r)); err != nil {
+		return nil, err
+	}
+	if err := verifyClaims(claims); err != nil {
+		return nil, err
+	}
+	if err := verifyNonce(claims); err != nil {
+		return nil, err
+	}
+	if err := verifyUniqueTokenId(claims); err != nil {
+		return nil, err
+	}
+	if !tokenActivities.Touch(claims.Id, claims.ExpiresAt) {
+		return nil, ErrTokenIdle
+	}
+	return claims, nil
+}
+
+// RefreshJWT issue a fresh token from a valid bearer token
+// A token expired for less than the refresh grace is still accepted
+func RefreshJWT(w http.ResponseWriter, r *http.Request) {
+	const bearerPrefix = "Bearer "
+	setNoStoreHeaders(w)
+
+	bearer := r.Header.Get("Authorization")
+	if !strings.HasPrefix(bearer, bearerPrefix) {
+		w.WriteHeader(http.StatusUnauthorized)
+		io.WriteString(w, "Invalid Authorization Header, a bearer token is expected")
+		return
+	}
+
+	token, err := refreshUserToken(strings.TrimPrefix(bearer, bearerPrefix), r)
+	if err != nil {
+		utils.Log.Info().Msgf("Refresh refused for %v: %v", r.RemoteAddr, err.Error())
+		if errors.Cause(err) == ErrTokenQuotaExceeded {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	setLinkHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, token)
+}
+
+// Whoami returns the claims of the bearer token, for clients to
+// check the user, namespaces and expiry of the token they hold
+func Whoami(w http.ResponseWriter, r *http.Request) {
+	setNoStoreHeaders(w)
+	claims, err := CurrentJWT(w, r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	body, err := json.Marshal(claims)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	setLinkHeaders(w)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// Check a token like a verified one, with the refresh grace on its expiry,
+// then issue a new one with the same claims and lifetime, counted in the quota.
+// Refreshes are chained up to TOKEN_REFRESH_MAX_AGE after the login,
+// then the user must log in again and go through the directory
+func refreshUserToken(tokenString string, r *http.Request) (string, error) {
+	grace, err := time.ParseDuration(utils.Config.TokenRefreshGrace)
+	if err != nil {
+		return "", err
+	}
+
+	// Expiry is checked below against the grace window
+	parser := &jwt.Parser{SkipClaimsValidation: true}
+	token, err := parser.ParseWithClaims(tokenString, &types.AuthJWTClaims{}, verifyKeyFunc)
+	if err != nil {
+		return "", err
+	}
+
+	claims, ok := token.Claims.(*types.AuthJWTClaims)
+	if !ok || !token.Valid {
+		return "", errors.New("Invalid token")
+	}
+	if time.Now().After(time.Unix(claims.ExpiresAt, 0).Add(grace)) {
+		return "", errors.New("Token expired beyond the refresh grace")
+	}
+	if err := verifyClaims(claims); err != nil {
+		return "", err
+	}
+	if err := verifyIssuedIP(claims, r); err != nil {
+		return "", err
+	}
+	lifetime, err := refreshLifetime(claims)
+	if err != nil {
+		return "", err
+	}
+	// An idle token is not brought back to life by a refresh
+	if !tokenActivities.Touch(claims.Id, claims.ExpiresAt) {
+		return "", ErrTokenIdle
+	}
+
+	binding := tokenBinding{audience: claims.Audience, issuedIP: claims.IssuedIP, userDN: claims.UserDN, lifetime: lifetime}
+	refreshed, err := newUserClaims(claims.Auths, claims.User, claims.AdminAccess, binding)
+	if err != nil {
+		return "", err
+	}
+	refreshed.LoginAt = refreshOrigin(claims)
+	return issueUserToken(refreshed, binding)
+}
+
+// Login time of a token, carried along its refreshes
+func refreshOrigin(claims *types.AuthJWTClaims) int64 {
+	if claims.LoginAt > 0 {
+		return claims.LoginAt
+	}
+	return claims.IssuedAt
+}
+
+// Lifetime of the token refreshing claims: the one they were issued with,
+// cut at TOKEN_REFRESH_MAX_AGE after the login
+func refreshLifetime(claims *types.AuthJWTClaims) (time.Duration, error) {
+	if claims.IssuedAt == 0 {
+		return 0, errors.Wrap(ErrMissingClaims, "no iat claim to refresh from")
+	}
+	lifetime := time.Duration(claims.ExpiresAt-claims.IssuedAt) * time.Second
+
+	maxAge := utils.Config.TokenRefreshMaxAge
+	if maxAge <= 0 {
+		return lifetime, nil
+	}
+	left := time.Until(time.Unix(refreshOrigin(claims), 0).Add(maxAge))
+	if left <= 0 {
+		return 0, ErrRefreshTooOld
+	}
+	if lifetime > left {
+		lifetime = left
+	}
+	return lifetime, nil
+}
+
+// Check the claims of a validly signed token
+func verifyClaims(claims *types.AuthJWTClaims) error {
+	for _, verify := range []func(*types.AuthJWTClaims) error{verifyVersion, verifyLifetime, verifyRequiredClaims} {
+		if err := verify(claims); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// With SINGLE_USE_TOKENS, a token is only verified once, by its nonce.
+// Only the verify endpoint uses the nonce, it is called by the api server
+func verifyNonce(claims *types.AuthJWTClaims) error {
+	if !utils.Config.SingleUseTokens {
+		return nil
+	}
+	if len(claims.Nonce) == 0 {
+		return errors.Wrap(ErrMissingClaims, "nonce is required for single use tokens")
+	}
+	if !nonces.Use(claims.Nonce, claims.ExpiresAt) {
+		return errors.Wrapf(ErrTokenReplayed, "nonce %s", claims.Nonce)
+	}
+	return nil
+}
+
+// With DUPLICATE_JTI_CHECK, a token id verified for two users is reported
+// as a likely forgery or signing key leak, and rejected with DUPLICATE_JTI_REJECT
+func verifyUniqueTokenId(claims *types.AuthJWTClaims) error {
+	if !utils.Config.DuplicateJtiCheck || len(claims.Id) == 0 {
+		return nil
+	}
+	if verifiedTokenIds.Record(claims.Id, claims.User, claims.ExpiresAt) {
+		return nil
+	}
+
+	utils.Metrics.Add("duplicate_jti", 1)
+	utils.Log.Error().Msgf("SECURITY: token id %s presented for %s was already verified for another user, the signing key may be compromised",
+		claims.Id, utils.RedactUser(claims.User))
+	if utils.Config.DuplicateJtiReject {
+		return errors.Wrapf(ErrDuplicateTokenId, "token id %s", claims.Id)
+	}
+	return nil
+}
+
+// Reject a token of a claim schema older than MIN_TOKEN_VERSION,
+// or newer than this kubi knows. A token without ver is version 0
+func verifyVersion(claims *types.AuthJWTClaims) error {
+	if claims.Version < utils.Config.MinTokenVersion || claims.Version > tokenVersion {
+		return errors.Wrapf(ErrUnsupportedVersion, "token version %d, accepted versions are %d to %d",
+			claims.Version, utils.Config.MinTokenVersion, tokenVersion)
+	}
+	return nil
+}
+
+// Reject a token claiming a lifetime longer than MAX_TOKEN_LIFETIME_ACCEPTED,
+// a token without iat cannot be checked and is rejected too
+func verifyLifetime(claims *types.AuthJWTClaims) error {
+	maxLifetime := utils.Config.MaxTokenLifetimeAccepted
+	if maxLifetime <= 0 {
+		return nil
+	}
+	if claims.IssuedAt == 0 {
+		return errors.Wrap(ErrTokenTooLong, "no iat claim")
+	}
+	if time.Duration(claims.ExpiresAt-claims.IssuedAt)*time.Second > maxLifetime {
+		return ErrTokenTooLong
+	}
+	return nil
+}
+
+// Reject a validly signed token with an incomplete claim set:
+// the user is required, and the auths unless admin, each with a namespace and role
+func verifyRequiredClaims(claims *types.AuthJWTClaims) error {
+	if !utils.Config.RequireClaims {
+		return nil
+	}
+	if len(claims.User) == 0 {
+		return errors.Wrap(ErrMissingClaims, "no user")
+	}
+	if claims.Auths == nil && !claims.AdminAccess {
+		return errors.Wrap(ErrMissingClaims, "no auths")
+	}
+	for _, auth := range claims.Auths {
+		if auth == nil || len(auth.Namespace) == 0 || len(auth.Role) == 0 {
+			return errors.Wrap(ErrMissingClaims, "malformed auths")
+		}
+	}
+	return nil
+}
+
 func CurrentJWT(w http.ResponseWriter, r *http.Request) (*types.AuthJWTClaims, error) {
 
 	const bearerPrefix = "Bearer "
 
 	bearer := r.Header.Get("Authorization")
 	if !strings.HasPrefix(bearer, bearerPrefix) || len(bearer) < 8 {
-		return nil, errors.New(fmt.Sprintf("Invalid Authorization Header: %s", bearer))
+		return nil, errors.New("Invalid Authorization Header, a bearer token is expected")
 	}
 	splitToken := strings.Split(bearer, bearerPrefix)
 	bearer = splitToken[1]
 
-	token, err := jwt.ParseWithClaims(bearer, &types.AuthJWTClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return signingKey, nil
-	})
+	token, err := jwt.ParseWithClaims(bearer, &types.AuthJWTClaims{}, verifyKeyFunc)
 	if err != nil {
 		utils.Log.Info().Msgf("Bad token: %v", err.Error())
 		return nil, err
 	}
 	if claims, ok := token.Claims.(*types.AuthJWTClaims); ok && token.Valid {
+		if err := verifyClaims(claims); err != nil {
+			utils.Log.Info().Msgf("Auth token rejected for %v: %v", r.RemoteAddr, err)
+			return nil, err
+		}
+		if !tokenActivities.Touch(claims.Id, claims.ExpiresAt) {
+			utils.Log.Info().Msgf("Auth token is idle for %v", r.RemoteAddr)
+			return nil, ErrTokenIdle
+		}
+		// Only here, the verify webhook is called by the api server, not the client
+		if err := verifyIssuedIP(claims, r); err != nil {
+			utils.Log.Info().Msgf("Auth token issued to %v presented by %v", claims.IssuedIP, clientIP(r))
+			return nil, err
+		}
+		setAccessUser(r, claims.User)
 		return claims, nil
 	} else {
 		utils.Log.Info().Msgf("Auth token is invalid for %v: error  %v", r.RemoteAddr, err.Error())
@@ -179,14 +819,73 @@ func CurrentJWT(w http.ResponseWriter, r *http.Request) (*types.AuthJWTClaims, e
 	}
 }
 
+// Reply to a failed basic authentication
+func writeBasicAuthError(w http.ResponseWriter, err error) {
+	countAuthFailure(err)
+	if err == ErrAuthHeaderTooLarge {
+		w.WriteHeader(http.StatusRequestHeaderFieldsTooLarge)
+		io.WriteString(w, "Basic Auth: Authorization header too large")
+		return
+	}
+	if err == ErrMalformedBasicAuth {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, "Basic Auth: credentials must be base64 encoded user:password")
+		return
+	}
+	setRealmHeader(w)
+	w.WriteHeader(http.StatusUnauthorized)
+	io.WriteString(w, "Basic Auth: Invalid credentials")
+}
+
+// Reply to a failed token generation
+// An unavailable directory is not a rejected authentication
+func writeTokenError(w http.ResponseWriter, err error) {
+	countAuthFailure(err)
+	switch errors.Cause(err) {
+	case ErrTokenQuotaExceeded:
+		w.WriteHeader(http.StatusTooManyRequests)
+		io.WriteString(w, err.Error())
+	case ErrImpersonationDenied, ErrImpersonationRefused, ErrTooFewNamespaces:
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, err.Error())
+	case ErrClusterNotFound:
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, err.Error())
+	case ldap.ErrUnavailable:
+		w.Header().Set("Retry-After", strconv.Itoa(utils.Config.Ldap.RetryAfter))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, "Authentication backend unavailable")
+	default:
+		setRealmHeader(w)
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+}
+
+// Browsers prompt for credentials with the AUTH_REALM
+func setRealmHeader(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", utils.Config.AuthRealm))
+}
+
+// Extract credentials from the basic auth header
+// Oversized headers are rejected before decoding
 func basicAuth(r *http.Request) (error, *types.Auth) {
-	auth := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	header := r.Header.Get("Authorization")
+	if len(header) > utils.Config.MaxAuthHeader {
+		return ErrAuthHeaderTooLarge, nil
+	}
+
+	auth := strings.SplitN(header, " ", 2)
 
 	if len(auth) != 2 || auth[0] != "Basic" {
-		var err = errors.New("Invalid Auth")
-		return err, nil
+		return ErrInvalidBasicAuth, nil
+	}
+	payload, err := base64.StdEncoding.DecodeString(auth[1])
+	if err != nil {
+		return ErrMalformedBasicAuth, nil
 	}
-	payload, _ := base64.StdEncoding.DecodeString(auth[1])
 	pair := strings.SplitN(string(payload), ":", 2)
-	return nil, &types.Auth{Username: pair[0], Password: pair[1]}
+	if len(pair) != 2 {
+		return ErrMalformedBasicAuth, nil
+	}
+	return nil, &types.Auth{Username: pair[0], Password: pair[1], Cluster: r.Header.Get(clusterHeader), SourceIP: clientIP(r)}
 }
@@ -0,0 +1,907 @@
+package services
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/ca-gip/kubi/authenticator"
+	"github.com/ca-gip/kubi/types"
+	"github.com/ca-gip/kubi/utils"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGenerateUserTokenLogs(t *testing.T) {
+	withTokenConfig(t, &types.Config{GrantLog: true})
+
+	var output bytes.Buffer
+	defaultLog, defaultGrantLog := utils.Log, utils.GrantLog
+	utils.Log, utils.GrantLog = zerolog.New(&output), zerolog.New(&output)
+	defer func() { utils.Log, utils.GrantLog = defaultLog, defaultGrantLog }()
+
+	token, _, err := generateUserToken([]string{"valid_demo_admin", "notvalid"}, "demo", true, tokenBinding{})
+
+	assert.Nil(t, err)
+	assert.NotEmpty(t, token)
+	assert.Contains(t, output.String(), "authorization granted")
+	assert.Contains(t, output.String(), `"user":"demo"`)
+	assert.NotContains(t, output.String(), token)
+	for _, part := range bytes.Split([]byte(token), []byte(".")) {
+		assert.NotContains(t, output.String(), string(part))
+	}
+}
+
+func TestRefreshUserToken(t *testing.T) {
+	withTokenConfig(t, &types.Config{TokenRefreshGrace: "2m", TokenRefreshMaxAge: 24 * time.Hour})
+	request := httptest.NewRequest(http.MethodGet, "/token/refresh", nil)
+
+	// A token of the given lifetime, expiring at expiresAt
+	newToken := func(expiresAt time.Time, lifetime time.Duration, edit func(*types.AuthJWTClaims)) string {
+		claims := types.AuthJWTClaims{
+			User: "demo",
+			StandardClaims: jwt.StandardClaims{
+				IssuedAt:  expiresAt.Add(-lifetime).Unix(),
+				ExpiresAt: expiresAt.Unix(),
+				Issuer:    "Kubi Server",
+			},
+		}
+		if edit != nil {
+			edit(&claims)
+		}
+		token, _ := jwt.NewWithClaims(jwt.SigningMethodHS512, claims).SignedString(signingKey)
+		return token
+	}
+	expiredToken := func(expiredSince time.Duration) string {
+		return newToken(time.Now().Add(-expiredSince), 4*time.Hour, nil)
+	}
+	parse := func(token string) *types.AuthJWTClaims {
+		claims := &types.AuthJWTClaims{}
+		_, err := jwt.ParseWithClaims(token, claims, verifyKeyFunc)
+		assert.Nil(t, err)
+		return claims
+	}
+
+	t.Run("with a token expired within the grace", func(t *testing.T) {
+		result, err := refreshUserToken(expiredToken(time.Minute), request)
+
+		assert.Nil(t, err)
+		assert.NotEmpty(t, result)
+	})
+
+	t.Run("with a token expired beyond the grace", func(t *testing.T) {
+		result, err := refreshUserToken(expiredToken(time.Hour), request)
+
+		assert.NotNil(t, err)
+		assert.Empty(t, result)
+	})
+
+	t.Run("with a token signed by another key", func(t *testing.T) {
+		token := expiredToken(-time.Hour)
+		signingKey = []byte("another-signing-key")
+		defer func() { signingKey = testSigningKey }()
+
+		result, err := refreshUserToken(token, request)
+
+		assert.NotNil(t, err)
+		assert.Empty(t, result)
+	})
+
+	t.Run("the refreshed token keeps the lifetime and the login time", func(t *testing.T) {
+		token := newToken(time.Now().Add(time.Minute), 90*time.Minute, nil)
+
+		result, err := refreshUserToken(token, request)
+
+		assert.Nil(t, err)
+		refreshed := parse(result)
+		assert.Equal(t, int64(90*60), refreshed.ExpiresAt-refreshed.IssuedAt)
+		assert.Equal(t, parse(token).IssuedAt, refreshed.LoginAt)
+	})
+
+	t.Run("the refresh chain ends at the max age after the login", func(t *testing.T) {
+		loginAt := time.Now().Add(-23 * time.Hour)
+		token := newToken(time.Now().Add(time.Minute), 4*time.Hour, func(claims *types.AuthJWTClaims) {
+			claims.LoginAt = loginAt.Unix()
+		})
+
+		result, err := refreshUserToken(token, request)
+
+		assert.Nil(t, err)
+		assert.True(t, parse(result).ExpiresAt <= loginAt.Add(24*time.Hour).Unix(), "a refresh cannot outlive the max age")
+	})
+
+	t.Run("with a token past the max age after the login", func(t *testing.T) {
+		token := newToken(time.Now().Add(time.Minute), 4*time.Hour, func(claims *types.AuthJWTClaims) {
+			claims.LoginAt = time.Now().Add(-25 * time.Hour).Unix()
+		})
+
+		result, err := refreshUserToken(token, request)
+
+		assert.Equal(t, ErrRefreshTooOld, err)
+		assert.Empty(t, result)
+	})
+
+	t.Run("with a token failing the claim checks", func(t *testing.T) {
+		utils.Config.MaxTokenLifetimeAccepted = time.Hour
+		defer func() { utils.Config.MaxTokenLifetimeAccepted = 0 }()
+
+		result, err := refreshUserToken(expiredToken(time.Minute), request)
+
+		assert.Equal(t, ErrTokenTooLong, errors.Cause(err))
+		assert.Empty(t, result)
+	})
+
+	t.Run("with a bound token presented from another ip", func(t *testing.T) {
+		utils.Config.BindTokenToIp = true
+		defer func() { utils.Config.BindTokenToIp = false }()
+		token := newToken(time.Now().Add(time.Minute), 4*time.Hour, func(claims *types.AuthJWTClaims) {
+			claims.IssuedIP = "10.0.0.1"
+		})
+
+		result, err := refreshUserToken(token, request)
+
+		assert.Equal(t, ErrTokenIpMismatch, err)
+		assert.Empty(t, result)
+	})
+
+	t.Run("refreshes are counted in the daily quota", func(t *testing.T) {
+		utils.Config.TokenDailyQuota = 1
+		defer func() { utils.Config.TokenDailyQuota = 0 }()
+		quotas := tokenQuotas
+		tokenQuotas = &tokenQuota{counts: map[string]int{}, now: time.Now}
+		defer func() { tokenQuotas = quotas }()
+
+		_, err := refreshUserToken(expiredToken(time.Minute), request)
+		assert.Nil(t, err)
+
+		recorder := httptest.NewRecorder()
+		refresh := httptest.NewRequest(http.MethodGet, "/token/refresh", nil)
+		refresh.Header.Set("Authorization", "Bearer "+expiredToken(time.Minute))
+		RefreshJWT(recorder, refresh)
+
+		assert.Equal(t, http.StatusTooManyRequests, recorder.Code)
+	})
+
+	t.Run("the refreshed token is not cached", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodGet, "/token/refresh", nil)
+		request.Header.Set("Authorization", "Bearer "+expiredToken(time.Minute))
+		recorder := httptest.NewRecorder()
+
+		RefreshJWT(recorder, request)
+
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "no-store", recorder.Header().Get("Cache-Control"))
+		assert.Equal(t, "no-cache", recorder.Header().Get("Pragma"))
+		assert.Equal(t, "Authorization", recorder.Header().Get("Vary"))
+	})
+}
+
+func TestGenerateUserTokenInstance(t *testing.T) {
+	withTokenConfig(t, &types.Config{InstanceName: "cluster-a"})
+
+	token, _, err := generateUserToken([]string{"valid_demo_admin"}, "demo", false, tokenBinding{})
+	assert.Nil(t, err)
+
+	claims := &types.AuthJWTClaims{}
+	_, err = jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
+		return signingKey, nil
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, "cluster-a", claims.Instance)
+}
+
+func TestBasicAuthMaxHeader(t *testing.T) {
+	withConfig(t, &types.Config{MaxAuthHeader: 8192})
+
+	t.Run("with an oversized header", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodGet, "/token", nil)
+		request.Header.Set("Authorization", "Basic "+strings.Repeat("A", 10000))
+		recorder := httptest.NewRecorder()
+
+		GenerateJWT(recorder, request)
+
+		assert.Equal(t, http.StatusRequestHeaderFieldsTooLarge, recorder.Code)
+	})
+
+	t.Run("with a header within the limit", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodGet, "/token", nil)
+		request.SetBasicAuth("demo", "password")
+
+		err, auth := basicAuth(request)
+
+		assert.Nil(t, err)
+		assert.Equal(t, "demo", auth.Username)
+		assert.Equal(t, "password", auth.Password)
+	})
+
+	t.Run("with credentials without separator", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodGet, "/token", nil)
+		request.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("demo")))
+		recorder := httptest.NewRecorder()
+
+		GenerateJWT(recorder, request)
+
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	})
+
+	t.Run("with credentials not base64 encoded", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodGet, "/token", nil)
+		request.Header.Set("Authorization", "Basic demo:password")
+
+		err, _ := basicAuth(request)
+
+		assert.Equal(t, ErrMalformedBasicAuth, err)
+	})
+}
+
+func TestGenerateUserTokenRedaction(t *testing.T) {
+	withTokenConfig(t, &types.Config{GrantLog: true, LogRedactUsernames: true, LogRedactSalt: "salt"})
+
+	var output, grantOutput bytes.Buffer
+	defaultLog, defaultGrantLog := utils.Log, utils.GrantLog
+	utils.Log, utils.GrantLog = zerolog.New(&output), zerolog.New(&grantOutput)
+	defer func() { utils.Log, utils.GrantLog = defaultLog, defaultGrantLog }()
+
+	_, _, err := generateUserToken([]string{"valid_demo_admin"}, "alice", false, tokenBinding{})
+
+	assert.Nil(t, err)
+	assert.Contains(t, output.String(), utils.RedactUser("alice"))
+	assert.NotContains(t, output.String(), "alice")
+	assert.Contains(t, grantOutput.String(), `"user":"alice"`)
+}
+
+func TestGenerateJWTLdapErrors(t *testing.T) {
+	withConfig(t, &types.Config{MaxAuthHeader: 8192, Ldap: types.LdapConfig{
+		Host:        "127.0.0.1",
+		Port:        1,
+		DialTimeout: time.Second,
+		RetryAfter:  30,
+	}})
+
+	t.Run("a dial failure yields 503", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodGet, "/token", nil)
+		request.SetBasicAuth("alice", "password")
+		recorder := httptest.NewRecorder()
+
+		GenerateJWT(recorder, request)
+
+		assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+		assert.Equal(t, "30", recorder.Header().Get("Retry-After"))
+	})
+
+	t.Run("a wrong password yields 401", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+
+		writeTokenError(recorder, errors.Wrap(ldap.ErrInvalidCredentials, "bind refused"))
+
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+		assert.Empty(t, recorder.Header().Get("Retry-After"))
+	})
+}
+
+func TestGenerateJWTMinPasswordLength(t *testing.T) {
+	// An unreachable directory, reaching it yields 503
+	withConfig(t, &types.Config{MaxAuthHeader: 8192, MinPasswordLength: 8, Ldap: types.LdapConfig{
+		Host:        "127.0.0.1",
+		Port:        1,
+		DialTimeout: time.Second,
+	}})
+
+	generate := func(password string) int {
+		request := httptest.NewRequest(http.MethodGet, "/token", nil)
+		request.SetBasicAuth("alice", password)
+		recorder := httptest.NewRecorder()
+		GenerateJWT(recorder, request)
+		return recorder.Code
+	}
+
+	t.Run("an under length password is rejected without ldap call", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, generate("short"))
+	})
+
+	t.Run("a sufficient length password proceeds to ldap", func(t *testing.T) {
+		assert.Equal(t, http.StatusServiceUnavailable, generate("long-enough"))
+	})
+}
+
+func TestVerifyJWTClusterAudience(t *testing.T) {
+	withTokenConfig(t, &types.Config{ClusterAudiences: map[string]string{"a": "cluster-a", "b": "cluster-b"}})
+
+	token, _, err := signUserToken(nil, "demo", false, tokenBinding{audience: "cluster-a"})
+	assert.Nil(t, err)
+
+	verify := func(cluster string) int {
+		request := httptest.NewRequest(http.MethodPost, "/token/demo", strings.NewReader(token))
+		request.Header.Set(clusterHeader, cluster)
+		recorder := httptest.NewRecorder()
+		VerifyJWT(recorder, request)
+		return recorder.Code
+	}
+
+	t.Run("a token for cluster a is accepted as a", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, verify("a"))
+	})
+
+	t.Run("a token for cluster a is rejected as b", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, verify("b"))
+	})
+
+	t.Run("an unknown cluster is rejected", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, verify("c"))
+	})
+}
+
+func TestWithAdminBanner(t *testing.T) {
+	withConfig(t, &types.Config{AdminConfigBanner: true})
+	yml := []byte("apiVersion: v1\n")
+	expiresAt := time.Date(2019, 3, 1, 14, 0, 0, 0, time.UTC).Unix()
+
+	t.Run("an admin config has the banner and header", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		claims := &types.AuthJWTClaims{User: "alice", AdminAccess: true, StandardClaims: jwt.StandardClaims{ExpiresAt: expiresAt}}
+
+		result := withAdminBanner(recorder, yml, claims)
+
+		assert.Equal(t, "true", recorder.Header().Get("X-Admin"))
+		assert.True(t, strings.HasPrefix(string(result), "# WARNING: this token grants cluster-admin"))
+		assert.Contains(t, string(result), "2019-03-01T14:00:00Z")
+		assert.True(t, strings.HasSuffix(string(result), string(yml)))
+	})
+
+	t.Run("a user config is unchanged", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		claims := &types.AuthJWTClaims{User: "bob", StandardClaims: jwt.StandardClaims{ExpiresAt: expiresAt}}
+
+		result := withAdminBanner(recorder, yml, claims)
+
+		assert.Empty(t, recorder.Header().Get("X-Admin"))
+		assert.Equal(t, yml, result)
+	})
+}
+
+func TestVerifyLifetime(t *testing.T) {
+	withConfig(t, &types.Config{MaxTokenLifetimeAccepted: 24 * time.Hour})
+	now := time.Now()
+	claims := func(issuedAt time.Time, lifetime time.Duration) *types.AuthJWTClaims {
+		return &types.AuthJWTClaims{StandardClaims: jwt.StandardClaims{
+			IssuedAt:  issuedAt.Unix(),
+			ExpiresAt: issuedAt.Add(lifetime).Unix(),
+		}}
+	}
+
+	t.Run("a normal token pass", func(t *testing.T) {
+		assert.Nil(t, verifyLifetime(claims(now, 4*time.Hour)))
+	})
+
+	t.Run("an over long token is rejected", func(t *testing.T) {
+		assert.Equal(t, ErrTokenTooLong, verifyLifetime(claims(now, 30*24*time.Hour)))
+	})
+
+	t.Run("a token without iat is rejected", func(t *testing.T) {
+		err := verifyLifetime(&types.AuthJWTClaims{StandardClaims: jwt.StandardClaims{ExpiresAt: now.Unix()}})
+
+		assert.Equal(t, ErrTokenTooLong, errors.Cause(err))
+	})
+
+	t.Run("issued tokens carry iat", func(t *testing.T) {
+		withTokenConfig(t, &types.Config{MaxTokenLifetimeAccepted: 24 * time.Hour})
+
+		_, issued, err := signUserToken(nil, "demo", false, tokenBinding{})
+
+		assert.Nil(t, err)
+		assert.NotZero(t, issued.IssuedAt)
+		assert.Nil(t, verifyLifetime(issued))
+	})
+}
+
+func TestRequestLifetime(t *testing.T) {
+	withConfig(t, &types.Config{MinTTL: 5 * time.Minute, MaxTTL: 8 * time.Hour})
+	lifetime := func(query string) (time.Duration, error) {
+		return requestLifetime(httptest.NewRequest(http.MethodGet, "/token"+query, nil))
+	}
+
+	t.Run("without ttl the default lifetime is used", func(t *testing.T) {
+		result, err := lifetime("")
+
+		assert.Nil(t, err)
+		assert.Zero(t, result)
+	})
+
+	t.Run("a ttl in range is used", func(t *testing.T) {
+		result, err := lifetime("?ttl=90m")
+
+		assert.Nil(t, err)
+		assert.Equal(t, 90*time.Minute, result)
+	})
+
+	t.Run("a ttl under the minimum is clamped", func(t *testing.T) {
+		result, err := lifetime("?ttl=30s")
+
+		assert.Nil(t, err)
+		assert.Equal(t, 5*time.Minute, result)
+	})
+
+	t.Run("a ttl over the maximum or invalid is rejected", func(t *testing.T) {
+		for _, query := range []string{"?ttl=24h", "?ttl=-1h", "?ttl=forever"} {
+			_, err := lifetime(query)
+			assert.Equal(t, ErrInvalidTTL, errors.Cause(err), query)
+		}
+	})
+
+	t.Run("a rejected ttl is a bad request", func(t *testing.T) {
+		utils.Config.MaxAuthHeader = 8192
+		request := httptest.NewRequest(http.MethodGet, "/token?ttl=24h", nil)
+		request.SetBasicAuth("alice", "password")
+		recorder := httptest.NewRecorder()
+
+		GenerateJWT(recorder, request)
+
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	})
+
+	t.Run("the requested ttl is reflected in exp and the expiry header", func(t *testing.T) {
+		utils.Config.TokenLifeTime, utils.Config.JwtSigningMethod = "4h", "HS512"
+		signingKey = testSigningKey
+
+		_, claims, err := signUserToken(nil, "demo", false, tokenBinding{lifetime: 90 * time.Minute})
+		assert.Nil(t, err)
+		assert.Equal(t, int64(90*60), claims.ExpiresAt-claims.IssuedAt)
+
+		recorder := httptest.NewRecorder()
+		setExpiryHeader(recorder, claims)
+		assert.Equal(t, time.Unix(claims.ExpiresAt, 0).UTC().Format(time.RFC3339), recorder.Header().Get("X-Token-Expires-At"))
+	})
+
+	t.Run("an invalid default lifetime is an error", func(t *testing.T) {
+		utils.Config.TokenLifeTime = "forever"
+		defer func() { utils.Config.TokenLifeTime = "4h" }()
+
+		claims, err := newUserClaims(nil, "demo", false, tokenBinding{})
+
+		assert.NotNil(t, err)
+		assert.Nil(t, claims)
+	})
+}
+
+func TestWriteTokenJSON(t *testing.T) {
+	claims := &types.AuthJWTClaims{StandardClaims: jwt.StandardClaims{ExpiresAt: time.Now().Add(4 * time.Hour).Unix()}}
+
+	t.Run("json is selected by the format or the Accept header", func(t *testing.T) {
+		byFormat := httptest.NewRequest(http.MethodGet, "/token?format=json", nil)
+		byAccept := httptest.NewRequest(http.MethodGet, "/token", nil)
+		byAccept.Header.Set("Accept", "application/json")
+
+		assert.True(t, wantsJSON(byFormat))
+		assert.True(t, wantsJSON(byAccept))
+		assert.False(t, wantsJSON(httptest.NewRequest(http.MethodGet, "/token", nil)))
+	})
+
+	t.Run("the json carries the token and its expiry", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+
+		writeTokenJSON(recorder, "a-token", claims)
+
+		var result tokenResponse
+		assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &result))
+		assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+		assert.Equal(t, "a-token", result.Token)
+		assert.InDelta(t, 4*60*60, result.ExpiresIn, 2)
+		assert.Equal(t, time.Unix(claims.ExpiresAt, 0).UTC().Format(time.RFC3339), result.ExpiresAt)
+	})
+}
+
+func TestVerifyRequiredClaims(t *testing.T) {
+	withTokenConfig(t, &types.Config{RequireClaims: true})
+	auths := []*types.AuthJWTTupple{{Namespace: "demo", Role: "admin"}}
+
+	verify := func(claims types.AuthJWTClaims) int {
+		claims.ExpiresAt = time.Now().Add(time.Hour).Unix()
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS512, claims).SignedString(signingKey)
+		assert.Nil(t, err)
+
+		recorder := httptest.NewRecorder()
+		VerifyJWT(recorder, httptest.NewRequest(http.MethodPost, "/token/demo", strings.NewReader(token)))
+		return recorder.Code
+	}
+
+	t.Run("a complete token is accepted", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, verify(types.AuthJWTClaims{User: "demo", Auths: auths}))
+	})
+
+	t.Run("a signed token without user is rejected", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, verify(types.AuthJWTClaims{Auths: auths}))
+	})
+
+	t.Run("a signed token without auths is rejected unless admin", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, verify(types.AuthJWTClaims{User: "demo"}))
+		assert.Equal(t, http.StatusOK, verify(types.AuthJWTClaims{User: "demo", AdminAccess: true}))
+	})
+
+	t.Run("a signed token with malformed auths is rejected", func(t *testing.T) {
+		malformed := []*types.AuthJWTTupple{{Namespace: "demo"}}
+
+		assert.Equal(t, http.StatusUnauthorized, verify(types.AuthJWTClaims{User: "demo", Auths: malformed}))
+	})
+}
+
+func TestAuthRealm(t *testing.T) {
+	withConfig(t, &types.Config{AuthRealm: "Kubi production", MaxAuthHeader: 8192})
+
+	t.Run("a missing basic auth has the realm", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+
+		GenerateJWT(recorder, httptest.NewRequest(http.MethodGet, "/token", nil))
+
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+		assert.Equal(t, `Basic realm="Kubi production"`, recorder.Header().Get("WWW-Authenticate"))
+	})
+
+	t.Run("rejected credentials have the realm", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+
+		writeTokenError(recorder, errors.Wrap(ldap.ErrInvalidCredentials, "bind refused"))
+
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+		assert.Equal(t, `Basic realm="Kubi production"`, recorder.Header().Get("WWW-Authenticate"))
+	})
+
+	t.Run("an unavailable directory has no realm", func(t *testing.T) {
+		utils.Config.Ldap.RetryAfter = 30
+		recorder := httptest.NewRecorder()
+
+		writeTokenError(recorder, ldap.ErrUnavailable)
+
+		assert.Empty(t, recorder.Header().Get("WWW-Authenticate"))
+	})
+}
+
+func TestVerifyVersion(t *testing.T) {
+	withTokenConfig(t, &types.Config{MinTokenVersion: 1})
+
+	t.Run("issued tokens carry the current version", func(t *testing.T) {
+		_, claims, err := signUserToken(nil, "demo", false, tokenBinding{})
+
+		assert.Nil(t, err)
+		assert.Equal(t, tokenVersion, claims.Version)
+		assert.Nil(t, verifyVersion(claims))
+	})
+
+	t.Run("a too old token is rejected", func(t *testing.T) {
+		err := verifyVersion(&types.AuthJWTClaims{})
+
+		assert.Equal(t, ErrUnsupportedVersion, errors.Cause(err))
+		assert.Contains(t, err.Error(), "token version 0, accepted versions are 1 to 1")
+	})
+
+	t.Run("an unknown token version is rejected", func(t *testing.T) {
+		err := verifyVersion(&types.AuthJWTClaims{Version: tokenVersion + 1})
+
+		assert.Equal(t, ErrUnsupportedVersion, errors.Cause(err))
+	})
+}
+
+func TestVerifyConfigNamespaces(t *testing.T) {
+	withConfig(t, &types.Config{MinNamespacesForConfig: 2})
+	auths := []*types.AuthJWTTupple{
+		{Namespace: "ns-a", Role: "admin"},
+		{Namespace: "ns-b", Role: "admin"},
+	}
+
+	t.Run("a user under the threshold is refused", func(t *testing.T) {
+		err := verifyConfigNamespaces(&types.AuthJWTClaims{Auths: auths[:1]})
+
+		assert.Equal(t, ErrTooFewNamespaces, errors.Cause(err))
+		assert.Contains(t, err.Error(), "1 namespaces granted, 2 are required")
+	})
+
+	t.Run("a user at the threshold get a config", func(t *testing.T) {
+		assert.Nil(t, verifyConfigNamespaces(&types.AuthJWTClaims{Auths: auths}))
+	})
+
+	t.Run("an admin is not concerned", func(t *testing.T) {
+		assert.Nil(t, verifyConfigNamespaces(&types.AuthJWTClaims{AdminAccess: true}))
+	})
+
+	t.Run("a refused config is forbidden", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		writeTokenError(recorder, verifyConfigNamespaces(&types.AuthJWTClaims{Auths: auths[:1]}))
+
+		assert.Equal(t, http.StatusForbidden, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), "1 namespaces granted, 2 are required")
+	})
+}
+
+func TestIncludeUserDN(t *testing.T) {
+	withTokenConfig(t, &types.Config{})
+	binding := tokenBinding{userDN: "cn=alice,ou=users,dc=example"}
+
+	t.Run("the dn is not in the token by default", func(t *testing.T) {
+		_, claims, err := generateUserToken(nil, "alice", false, binding)
+
+		assert.Nil(t, err)
+		assert.Empty(t, claims.UserDN)
+	})
+
+	t.Run("the authenticated dn is in the token when enabled", func(t *testing.T) {
+		utils.Config.IncludeUserDN = true
+		defer func() { utils.Config.IncludeUserDN = false }()
+
+		token, _, err := generateUserToken(nil, "alice", false, binding)
+		assert.Nil(t, err)
+
+		claims := &types.AuthJWTClaims{}
+		_, err = jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
+			return signingKey, nil
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, "cn=alice,ou=users,dc=example", claims.UserDN)
+	})
+}
+
+func TestSingleUseTokens(t *testing.T) {
+	withTokenConfig(t, &types.Config{SingleUseTokens: true})
+
+	verify := func(token string) int {
+		recorder := httptest.NewRecorder()
+		VerifyJWT(recorder, httptest.NewRequest(http.MethodPost, "/token/demo", strings.NewReader(token)))
+		return recorder.Code
+	}
+
+	t.Run("a single use token is verified once", func(t *testing.T) {
+		token, claims, err := signUserToken(nil, "demo", false, tokenBinding{})
+		assert.Nil(t, err)
+		assert.NotEmpty(t, claims.Nonce)
+
+		assert.Equal(t, http.StatusOK, verify(token))
+		assert.Equal(t, http.StatusUnauthorized, verify(token))
+	})
+
+	t.Run("a token without nonce is rejected", func(t *testing.T) {
+		utils.Config.SingleUseTokens = false
+		token, _, err := signUserToken(nil, "demo", false, tokenBinding{})
+		utils.Config.SingleUseTokens = true
+		assert.Nil(t, err)
+
+		assert.Equal(t, http.StatusUnauthorized, verify(token))
+	})
+}
+
+func TestGenerateConfigP12(t *testing.T) {
+	withConfig(t, &types.Config{})
+	request := httptest.NewRequest(http.MethodGet, "/config?format=p12", nil)
+	request.SetBasicAuth("alice", "secret")
+	recorder := httptest.NewRecorder()
+
+	GenerateConfig(recorder, request)
+
+	assert.Equal(t, http.StatusNotImplemented, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "PKCS#12")
+}
+
+func TestLinkHeaders(t *testing.T) {
+	withTokenConfig(t, &types.Config{TokenRefreshGrace: "2m", LinkHeaders: true})
+
+	t.Run("a token response links the related endpoints", func(t *testing.T) {
+		token, _, err := signUserToken(nil, "demo", false, tokenBinding{})
+		assert.Nil(t, err)
+		request := httptest.NewRequest(http.MethodGet, "/token/refresh", nil)
+		request.Header.Set("Authorization", "Bearer "+token)
+		recorder := httptest.NewRecorder()
+
+		RefreshJWT(recorder, request)
+
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, `</token/refresh>; rel="refresh", </whoami>; rel="whoami", </config/preview>; rel="preview"`, recorder.Header().Get("Link"))
+	})
+
+	t.Run("the links are under the route prefix", func(t *testing.T) {
+		utils.Config.RoutePrefix = "/kubi-api"
+		defer func() { utils.Config.RoutePrefix = "" }()
+		recorder := httptest.NewRecorder()
+
+		setLinkHeaders(recorder)
+
+		assert.Equal(t, `</kubi-api/token/refresh>; rel="refresh", </kubi-api/whoami>; rel="whoami", </kubi-api/config/preview>; rel="preview"`, recorder.Header().Get("Link"))
+	})
+
+	t.Run("the jwks is linked for an asymmetric signing method", func(t *testing.T) {
+		utils.Config.JwtSigningMethod = "RS256"
+		recorder := httptest.NewRecorder()
+
+		setLinkHeaders(recorder)
+
+		assert.Contains(t, recorder.Header().Get("Link"), `</jwks>; rel="jwks"`)
+	})
+
+	t.Run("no links when disabled", func(t *testing.T) {
+		utils.Config.LinkHeaders = false
+		recorder := httptest.NewRecorder()
+
+		setLinkHeaders(recorder)
+
+		assert.Empty(t, recorder.Header().Get("Link"))
+	})
+}
+
+func TestWhoami(t *testing.T) {
+	withTokenConfig(t, &types.Config{})
+
+	t.Run("the claims of the bearer token are returned", func(t *testing.T) {
+		auths := []*types.AuthJWTTupple{{Namespace: "demo", Role: "admin"}}
+		token, _, err := signUserToken(auths, "alice", false, tokenBinding{})
+		assert.Nil(t, err)
+		request := httptest.NewRequest(http.MethodGet, "/whoami", nil)
+		request.Header.Set("Authorization", "Bearer "+token)
+		recorder := httptest.NewRecorder()
+
+		Whoami(recorder, request)
+
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+		claims := types.AuthJWTClaims{}
+		assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &claims))
+		assert.Equal(t, "alice", claims.User)
+		assert.Equal(t, "demo", claims.Auths[0].Namespace)
+	})
+
+	t.Run("an invalid token is unauthorized", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodGet, "/whoami", nil)
+		request.Header.Set("Authorization", "Bearer not-a-token")
+		recorder := httptest.NewRecorder()
+
+		Whoami(recorder, request)
+
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	})
+}
+
+func TestDuplicateTokenId(t *testing.T) {
+	withTokenConfig(t, &types.Config{DuplicateJtiCheck: true})
+
+	sign := func(id string, user string) string {
+		claims := types.AuthJWTClaims{
+			User:           user,
+			StandardClaims: jwt.StandardClaims{Id: id, ExpiresAt: time.Now().Add(time.Hour).Unix()},
+		}
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS512, claims).SignedString(signingKey)
+		assert.Nil(t, err)
+		return token
+	}
+	verify := func(token string) int {
+		recorder := httptest.NewRecorder()
+		VerifyJWT(recorder, httptest.NewRequest(http.MethodPost, "/token/demo", strings.NewReader(token)))
+		return recorder.Code
+	}
+	duplicates := func() string {
+		if count := utils.Metrics.Get("duplicate_jti"); count != nil {
+			return count.String()
+		}
+		return "0"
+	}
+
+	t.Run("the same id for another user is reported", func(t *testing.T) {
+		before := duplicates()
+
+		assert.Equal(t, http.StatusOK, verify(sign("id-1", "alice")))
+		assert.Equal(t, http.StatusOK, verify(sign("id-1", "alice")))
+		assert.Equal(t, before, duplicates())
+
+		assert.Equal(t, http.StatusOK, verify(sign("id-1", "mallory")))
+		assert.NotEqual(t, before, duplicates())
+	})
+
+	t.Run("the same id for another user is rejected with enforcement", func(t *testing.T) {
+		utils.Config.DuplicateJtiReject = true
+		defer func() { utils.Config.DuplicateJtiReject = false }()
+
+		assert.Equal(t, http.StatusOK, verify(sign("id-2", "alice")))
+		assert.Equal(t, http.StatusUnauthorized, verify(sign("id-2", "mallory")))
+	})
+}
+
+func TestExpiresInHeader(t *testing.T) {
+	withTokenConfig(t, &types.Config{ExpiryWarningWindow: 5 * time.Minute})
+
+	verify := func(lifetime time.Duration) *httptest.ResponseRecorder {
+		claims := types.AuthJWTClaims{
+			User:           "alice",
+			StandardClaims: jwt.StandardClaims{ExpiresAt: time.Now().Add(lifetime).Unix()},
+		}
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS512, claims).SignedString(signingKey)
+		assert.Nil(t, err)
+
+		recorder := httptest.NewRecorder()
+		VerifyJWT(recorder, httptest.NewRequest(http.MethodPost, "/token/demo", strings.NewReader(token)))
+		return recorder
+	}
+
+	t.Run("a token close to expiry carries the seconds left", func(t *testing.T) {
+		recorder := verify(2 * time.Minute)
+
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		left, err := strconv.Atoi(recorder.Header().Get("X-Token-Expires-In"))
+		assert.Nil(t, err)
+		assert.InDelta(t, 120, left, 2)
+	})
+
+	t.Run("a fresh token carries no warning", func(t *testing.T) {
+		recorder := verify(time.Hour)
+
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Empty(t, recorder.Header().Get("X-Token-Expires-In"))
+	})
+}
+
+func TestVerifyJWTRejects(t *testing.T) {
+	withTokenConfig(t, &types.Config{})
+	verify := func(token string) int {
+		recorder := httptest.NewRecorder()
+		VerifyJWT(recorder, httptest.NewRequest(http.MethodPost, "/token/demo", strings.NewReader(token)))
+		return recorder.Code
+	}
+
+	t.Run("a malformed token is rejected", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, verify("not-a-token"))
+	})
+
+	t.Run("an expired token is rejected", func(t *testing.T) {
+		claims := types.AuthJWTClaims{User: "demo", StandardClaims: jwt.StandardClaims{ExpiresAt: time.Now().Add(-time.Minute).Unix()}}
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS512, claims).SignedString(signingKey)
+		assert.Nil(t, err)
+
+		assert.Equal(t, http.StatusUnauthorized, verify(token))
+	})
+
+	t.Run("a token signed with another key is rejected", func(t *testing.T) {
+		claims := types.AuthJWTClaims{User: "demo", StandardClaims: jwt.StandardClaims{ExpiresAt: time.Now().Add(time.Hour).Unix()}}
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS512, claims).SignedString([]byte("another-key"))
+		assert.Nil(t, err)
+
+		assert.Equal(t, http.StatusUnauthorized, verify(token))
+	})
+
+	t.Run("a valid token is accepted", func(t *testing.T) {
+		token, _, err := signUserToken(nil, "demo", false, tokenBinding{})
+		assert.Nil(t, err)
+
+		assert.Equal(t, http.StatusOK, verify(token))
+	})
+
+	// The api server only reads the status of the webhook answer
+	t.Run("the token review endpoints reject a bad signature", func(t *testing.T) {
+		token, _, err := signUserToken(nil, "demo", false, tokenBinding{})
+		assert.Nil(t, err)
+		parts := strings.Split(token, ".")
+		forged := parts[0] + "." + parts[1] + "." + base64.RawURLEncoding.EncodeToString([]byte("forged-signature"))
+
+		for _, path := range []string{"/token/demo", "/clusters/b/token/demo"} {
+			recorder := httptest.NewRecorder()
+			NewRouter(false, false).ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, path, strings.NewReader(forged)))
+
+			assert.Equal(t, http.StatusUnauthorized, recorder.Code, path)
+		}
+	})
+}
+
+func TestUserAuthsMergeRoles(t *testing.T) {
+	withConfig(t, &types.Config{RolePrivilegeOrder: []string{"admin", "edit", "viewer"}})
+
+	auths := userAuths([]string{
+		"valid_team-a_viewer",
+		"valid_team-b_edit",
+		"valid_team-a_admin",
+		"valid_team-a_edit",
+	})
+
+	assert.Len(t, auths, 2)
+	assert.Equal(t, types.AuthJWTTupple{Namespace: "team-a", Role: "admin"}, *auths[0])
+	assert.Equal(t, types.AuthJWTTupple{Namespace: "team-b", Role: "edit"}, *auths[1])
+}
@@ -0,0 +1,153 @@
+package services
+
+import (
+	"crypto/rand"
+	"fmt"
+	"github.com/ca-gip/kubi/types"
+	"github.com/ca-gip/kubi/utils"
+	"gopkg.in/yaml.v2"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"time"
+)
+
+// Bootstrap token secrets must be in kube-system
+const bootstrapTokenNamespace = "kube-system"
+
+const bootstrapTokenChars = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+// Create part of the secrets api
+type secretCreator interface {
+	Create(secret *corev1.Secret) (*corev1.Secret, error)
+}
+
+// Random string of the bootstrap token alphabet
+// Bytes over the last multiple of the alphabet size are skipped, to avoid bias
+func randomBootstrapString(length int) (string, error) {
+	limit := 256 - 256%len(bootstrapTokenChars)
+	result := make([]byte, 0, length)
+	raw := make([]byte, length)
+	for len(result) < length {
+		if _, err := rand.Read(raw); err != nil {
+			return "", err
+		}
+		for _, b := range raw {
+			if int(b) < limit && len(result) < length {
+				result = append(result, bootstrapTokenChars[int(b)%len(bootstrapTokenChars)])
+			}
+		}
+	}
+	return string(result), nil
+}
+
+// Create a bootstrap token secret expiring after BOOTSTRAP_TOKEN_TTL,
+// with the BOOTSTRAP_TOKEN_USAGES, and return the token
+func createBootstrapToken(secrets secretCreator, username string) (string, error) {
+	id, err := randomBootstrapString(6)
+	if err != nil {
+		return "", err
+	}
+	secret, err := randomBootstrapString(16)
+	if err != nil {
+		return "", err
+	}
+
+	data := map[string]string{
+		"token-id":     id,
+		"token-secret": secret,
+		"expiration":   time.Now().Add(utils.Config.BootstrapTokenTTL).UTC().Format(time.RFC3339),
+		"description":  fmt.Sprintf("Issued by kubi for %s", username),
+	}
+	for _, usage := range utils.Config.BootstrapTokenUsages {
+		data["usage-bootstrap-"+usage] = "true"
+	}
+
+	_, err = secrets.Create(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "bootstrap-token-" + id,
+			Namespace: bootstrapTokenNamespace,
+		},
+		Type:       corev1.SecretTypeBootstrapToken,
+		StringData: data,
+	})
+	if err != nil {
+		return "", err
+	}
+	utils.Log.Info().Msgf("Bootstrap token %s issued for %s", id, utils.RedactUser(username))
+	return id + "." + secret, nil
+}
+
+// Kubeconfig authenticating on the api server itself with a bootstrap token
+func newBootstrapKubeConfig(username string, token string) *types.KubeConfig {
+	name := "bootstrap-" + username
+	return &types.KubeConfig{
+		ApiVersion: "v1",
+		Kind:       "Config",
+		Clusters: []types.KubeConfigCluster{
+			{
+				Name: defaultClusterName,
+				Cluster: types.KubeConfigClusterData{
+					Server:          utils.Config.ApiServerURL,
+					CertificateData: utils.Config.KubeConfigCa,
+				},
+			},
+		},
+		CurrentContext: name,
+		Contexts: []types.KubeConfigContext{
+			{
+				Name:    name,
+				Context: types.KubeConfigContextData{Cluster: defaultClusterName, User: name},
+			},
+		},
+		Users: []types.KubeConfigUser{
+			{
+				Name: name,
+				User: types.KubeConfigUserToken{Token: token},
+			},
+		},
+	}
+}
+
+// Reply a bootstrap token kubeconfig, only to admins
+// and when ALLOW_BOOTSTRAP_TOKENS is set
+func generateBootstrapConfig(w http.ResponseWriter, auth types.Auth) {
+	if !utils.Config.AllowBootstrapTokens {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	_, claims, err := baseGenerateToken(auth)
+	if err != nil {
+		utils.Log.Info().Msg(err.Error())
+		writeTokenError(w, err)
+		return
+	}
+	if !claims.AdminAccess {
+		utils.Log.Info().Msgf("Bootstrap token refused for %s, not admin", utils.RedactUser(auth.Username))
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	clientSet, err := utils.KubeClient()
+	if err != nil {
+		utils.Log.Error().Msg(err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	token, err := createBootstrapToken(clientSet.CoreV1().Secrets(bootstrapTokenNamespace), auth.Username)
+	if err != nil {
+		utils.Log.Error().Msgf("Cannot create a bootstrap token: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	yml, err := yaml.Marshal(newBootstrapKubeConfig(auth.Username, token))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/x-yaml; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(yml)
+}
@@ -0,0 +1,71 @@
+package services
+
+import (
+	"github.com/ca-gip/kubi/types"
+	"github.com/ca-gip/kubi/utils"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type fakeSecrets struct {
+	created []*corev1.Secret
+}
+
+func (f *fakeSecrets) Create(secret *corev1.Secret) (*corev1.Secret, error) {
+	f.created = append(f.created, secret)
+	return secret, nil
+}
+
+func TestCreateBootstrapToken(t *testing.T) {
+	withConfig(t, &types.Config{
+		ApiServerURL:         "https://10.0.0.1:6443",
+		KubeConfigCa:         "a-ca",
+		BootstrapTokenTTL:    time.Hour,
+		BootstrapTokenUsages: []string{"authentication", "signing"},
+	})
+	secrets := &fakeSecrets{}
+
+	token, err := createBootstrapToken(secrets, "alice")
+
+	t.Run("a bootstrap token secret is created", func(t *testing.T) {
+		assert.Nil(t, err)
+		assert.Len(t, secrets.created, 1)
+
+		secret := secrets.created[0]
+		assert.Equal(t, corev1.SecretTypeBootstrapToken, secret.Type)
+		assert.Equal(t, "kube-system", secret.Namespace)
+		assert.Equal(t, "bootstrap-token-"+secret.StringData["token-id"], secret.Name)
+		assert.Len(t, secret.StringData["token-id"], 6)
+		assert.Len(t, secret.StringData["token-secret"], 16)
+		assert.Equal(t, "true", secret.StringData["usage-bootstrap-authentication"])
+		assert.Equal(t, "true", secret.StringData["usage-bootstrap-signing"])
+
+		expiration, err := time.Parse(time.RFC3339, secret.StringData["expiration"])
+		assert.Nil(t, err)
+		assert.WithinDuration(t, time.Now().Add(time.Hour), expiration, time.Minute)
+	})
+
+	t.Run("the kubeconfig references the bootstrap token", func(t *testing.T) {
+		secret := secrets.created[0]
+		result := newBootstrapKubeConfig("alice", token)
+
+		assert.Equal(t, secret.StringData["token-id"]+"."+secret.StringData["token-secret"], result.Users[0].User.Token)
+		assert.Equal(t, "https://10.0.0.1:6443", result.Clusters[0].Cluster.Server)
+		assert.Equal(t, "a-ca", result.Clusters[0].Cluster.CertificateData)
+	})
+
+	t.Run("bootstrap configs are refused when not allowed", func(t *testing.T) {
+		utils.Config.MaxAuthHeader = 8192
+		request := httptest.NewRequest(http.MethodGet, "/config?type=bootstrap", nil)
+		request.SetBasicAuth("alice", "password")
+		recorder := httptest.NewRecorder()
+
+		GenerateConfig(recorder, request)
+
+		assert.Equal(t, http.StatusForbidden, recorder.Code)
+	})
+}
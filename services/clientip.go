@@ -0,0 +1,63 @@
+package services
+
+import (
+	"errors"
+	"github.com/ca-gip/kubi/types"
+	"github.com/ca-gip/kubi/utils"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var ErrTokenIpMismatch = errors.New("token presented from another ip than issued to")
+
+// Client ip of a request
+// X-Forwarded-For is only read when the request comes from a trusted proxy,
+// the client is then the last address not being a trusted proxy
+func clientIP(r *http.Request) string {
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remote = r.RemoteAddr
+	}
+	if !isTrustedProxy(remote) {
+		return remote
+	}
+
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(forwarded[i])
+		if len(ip) == 0 {
+			continue
+		}
+		if !isTrustedProxy(ip) {
+			return ip
+		}
+		remote = ip
+	}
+	return remote
+}
+
+func isTrustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range utils.Config.TrustedProxies {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check a token is presented from the ip it was issued to,
+// only when BIND_TOKEN_TO_IP is enabled and the token records its ip
+func verifyIssuedIP(claims *types.AuthJWTClaims, r *http.Request) error {
+	if !utils.Config.BindTokenToIp || len(claims.IssuedIP) == 0 {
+		return nil
+	}
+	if clientIP(r) != claims.IssuedIP {
+		return ErrTokenIpMismatch
+	}
+	return nil
+}
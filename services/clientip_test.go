@@ -0,0 +1,68 @@
+package services
+
+import (
+	"github.com/ca-gip/kubi/types"
+	"github.com/ca-gip/kubi/utils"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	withConfig(t, &types.Config{TrustedProxies: []*net.IPNet{proxies}})
+
+	t.Run("without proxy the remote address is the client", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodGet, "/token", nil)
+		request.RemoteAddr = "192.168.1.10:45678"
+		request.Header.Set("X-Forwarded-For", "1.2.3.4")
+
+		assert.Equal(t, "192.168.1.10", clientIP(request))
+	})
+
+	t.Run("behind a trusted proxy the forwarded address is the client", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodGet, "/token", nil)
+		request.RemoteAddr = "10.0.0.1:45678"
+		request.Header.Set("X-Forwarded-For", "1.2.3.4, 192.168.1.10, 10.0.0.2")
+
+		assert.Equal(t, "192.168.1.10", clientIP(request))
+	})
+}
+
+func TestIssuedIP(t *testing.T) {
+	withTokenConfig(t, &types.Config{})
+
+	token, claims, err := signUserToken(nil, "demo", false, tokenBinding{issuedIP: "192.168.1.10"})
+	assert.Nil(t, err)
+
+	present := func(remoteAddr string) (*types.AuthJWTClaims, error) {
+		request := httptest.NewRequest(http.MethodGet, "/api", nil)
+		request.RemoteAddr = remoteAddr
+		request.Header.Set("Authorization", "Bearer "+token)
+		return CurrentJWT(httptest.NewRecorder(), request)
+	}
+
+	t.Run("the issued ip is recorded", func(t *testing.T) {
+		assert.Equal(t, "192.168.1.10", claims.IssuedIP)
+	})
+
+	t.Run("by default a token is accepted from another ip", func(t *testing.T) {
+		_, err := present("192.168.1.20:45678")
+
+		assert.Nil(t, err)
+	})
+
+	t.Run("when bound a token is rejected from another ip", func(t *testing.T) {
+		utils.Config.BindTokenToIp = true
+		defer func() { utils.Config.BindTokenToIp = false }()
+
+		_, err := present("192.168.1.20:45678")
+		assert.Equal(t, ErrTokenIpMismatch, err)
+
+		result, err := present("192.168.1.10:45678")
+		assert.Nil(t, err)
+		assert.Equal(t, "demo", result.User)
+	})
+}
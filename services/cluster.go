@@ -0,0 +1,52 @@
+package services
+
+import (
+	"errors"
+	"github.com/ca-gip/kubi/types"
+	"github.com/ca-gip/kubi/utils"
+	"github.com/gorilla/mux"
+	"net/http"
+)
+
+// Select the cluster a token is issued or verified for
+const clusterHeader = "X-Cluster-Name"
+
+var (
+	ErrUnknownCluster = errors.New("unknown cluster")
+	ErrWrongAudience  = errors.New("token not issued for this cluster")
+	// A kubeconfig asked for a cluster not configured, or not granted to the user
+	ErrClusterNotFound = errors.New("cluster not found")
+)
+
+// Cluster selected by the path, or by the header
+func requestCluster(r *http.Request) string {
+	if cluster, ok := mux.Vars(r)["cluster"]; ok {
+		return cluster
+	}
+	return r.Header.Get(clusterHeader)
+}
+
+// Audience of a cluster from CLUSTER_AUDIENCES
+// No cluster means no audience
+func clusterAudience(cluster string) (string, error) {
+	if len(cluster) == 0 {
+		return "", nil
+	}
+	audience, ok := utils.Config.ClusterAudiences[cluster]
+	if !ok {
+		return "", ErrUnknownCluster
+	}
+	return audience, nil
+}
+
+// Check a token was issued for the cluster it is verified for
+func verifyAudience(claims *types.AuthJWTClaims, cluster string) error {
+	audience, err := clusterAudience(cluster)
+	if err != nil || len(audience) == 0 {
+		return err
+	}
+	if !claims.VerifyAudience(audience, true) {
+		return ErrWrongAudience
+	}
+	return nil
+}
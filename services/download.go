@@ -0,0 +1,112 @@
+package services
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/ca-gip/kubi/utils"
+	"github.com/gorilla/mux"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type downloadEntry struct {
+	content   []byte
+	token     string
+	expiresAt time.Time
+}
+
+// A single use store for generated kubeconfigs
+// Entries are removed when taken or when their ttl is over
+type downloadStore struct {
+	sync.Mutex
+	entries map[string]downloadEntry
+}
+
+var downloads = &downloadStore{entries: map[string]downloadEntry{}}
+
+// Store a content, and its token for the tokenFile mode, and return its random id
+func (s *downloadStore) Put(content []byte, token string, ttl time.Duration) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(raw)
+
+	s.Lock()
+	s.entries[id] = downloadEntry{content: content, token: token, expiresAt: time.Now().Add(ttl)}
+	s.Unlock()
+
+	time.AfterFunc(ttl, func() {
+		s.Lock()
+		delete(s.entries, id)
+		s.Unlock()
+	})
+	return id, nil
+}
+
+// Return an entry and invalidate it
+func (s *downloadStore) Take(id string) (*downloadEntry, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	entry, ok := s.entries[id]
+	delete(s.entries, id)
+	if !ok || time.Now().After(entry.expiresAt) {
+		return nil, false
+	}
+	return &entry, true
+}
+
+// GenerateConfigLink authenticate the user, store its kubeconfig
+// and return a one time download url
+func GenerateConfigLink(w http.ResponseWriter, r *http.Request) {
+	setNoStoreHeaders(w)
+	err, auth := basicAuth(r)
+	if err != nil {
+		utils.Log.Info().Msg(err.Error())
+		writeBasicAuthError(w, err)
+		return
+	}
+
+	ttl, err := time.ParseDuration(utils.Config.DownloadLinkTTL)
+	if err != nil {
+		utils.Log.Error().Msgf("Invalid DOWNLOAD_LINK_TTL: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	yml, token, claims, err := generateConfigYaml("https://"+r.Host, *auth)
+	if err != nil {
+		utils.Log.Info().Msg(err.Error())
+		writeTokenError(w, err)
+		return
+	}
+	setAccessUser(r, claims.User)
+
+	id, err := downloads.Put(yml, token, ttl)
+	if err != nil {
+		utils.Log.Error().Msg(err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, "https://"+r.Host+"/config/download/"+id)
+}
+
+// DownloadConfig serve a stored kubeconfig once
+func DownloadConfig(w http.ResponseWriter, r *http.Request) {
+	setNoStoreHeaders(w)
+	entry, ok := downloads.Take(mux.Vars(r)["id"])
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	setTokenHeader(w, entry.token)
+	w.Header().Set("Content-Type", "text/x-yaml; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(entry.content)
+}
@@ -0,0 +1,48 @@
+package services
+
+import (
+	"github.com/ca-gip/kubi/types"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDownloadConfig(t *testing.T) {
+	withConfig(t, &types.Config{})
+	router := mux.NewRouter()
+	router.HandleFunc("/config/download/{id}", DownloadConfig)
+
+	download := func(id string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/config/download/"+id, nil))
+		return recorder
+	}
+
+	t.Run("the link works once", func(t *testing.T) {
+		id, err := downloads.Put([]byte("kind: Config"), "token", time.Minute)
+		assert.Nil(t, err)
+
+		first := download(id)
+		assert.Equal(t, http.StatusOK, first.Code)
+		assert.Equal(t, "kind: Config", first.Body.String())
+
+		second := download(id)
+		assert.Equal(t, http.StatusNotFound, second.Code)
+	})
+
+	t.Run("the link expires after the ttl", func(t *testing.T) {
+		id, err := downloads.Put([]byte("kind: Config"), "token", 10*time.Millisecond)
+		assert.Nil(t, err)
+
+		time.Sleep(50 * time.Millisecond)
+
+		assert.Equal(t, http.StatusNotFound, download(id).Code)
+	})
+
+	t.Run("with an unknown link", func(t *testing.T) {
+		assert.Equal(t, http.StatusNotFound, download("unknown").Code)
+	})
+}
@@ -0,0 +1,56 @@
+package services
+
+import (
+	"github.com/ca-gip/kubi/authenticator"
+	"github.com/ca-gip/kubi/utils"
+	"github.com/pkg/errors"
+)
+
+// Reasons of authentication failures, the labels of kubi_auth_failures_total
+const (
+	reasonBadCredentials  = "bad_credentials"
+	reasonLdapUnavailable = "ldap_unavailable"
+	reasonNoNamespaces    = "no_namespaces"
+	reasonLocked          = "locked"
+	reasonRateLimited     = "rate_limited"
+	reasonQuotaExceeded   = "quota_exceeded"
+	reasonNotAllowlisted  = "not_allowlisted"
+	reasonOther           = "other"
+)
+
+// Every reason is published, at zero until a failure
+var failureReasons = []string{reasonBadCredentials, reasonLdapUnavailable, reasonNoNamespaces, reasonLocked,
+	reasonRateLimited, reasonQuotaExceeded, reasonNotAllowlisted, reasonOther}
+
+func init() {
+	for _, reason := range failureReasons {
+		utils.AuthFailures.Add(reason, 0)
+	}
+}
+
+// Classify an authentication failure by its cause
+// A directory outage must not look like a password guessing spike
+func failureReason(err error) string {
+	switch errors.Cause(err) {
+	case ldap.ErrInvalidCredentials, ldap.ErrUserNotFound, ldap.ErrAmbiguousUser, ErrPasswordTooShort, ErrInvalidBasicAuth, ErrMalformedBasicAuth:
+		return reasonBadCredentials
+	case ldap.ErrUnavailable:
+		return reasonLdapUnavailable
+	case ErrTooFewNamespaces:
+		return reasonNoNamespaces
+	case ldap.ErrAccountLocked:
+		return reasonLocked
+	case ErrRateLimited:
+		return reasonRateLimited
+	case ErrTokenQuotaExceeded:
+		return reasonQuotaExceeded
+	case ErrImpersonationDenied, ErrImpersonationRefused:
+		return reasonNotAllowlisted
+	default:
+		return reasonOther
+	}
+}
+
+func countAuthFailure(err error) {
+	utils.AuthFailures.Add(failureReason(err), 1)
+}
@@ -0,0 +1,82 @@
+package services
+
+import (
+	"expvar"
+	"github.com/ca-gip/kubi/authenticator"
+	"github.com/ca-gip/kubi/types"
+	"github.com/ca-gip/kubi/utils"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthFailureMetrics(t *testing.T) {
+	withConfig(t, &types.Config{Ldap: types.LdapConfig{RetryAfter: 30}, AuthRealm: "Kubi"})
+	defaultFaults := faults
+	defer func() { faults = defaultFaults }()
+	injectFault := func(kind string) func(error) {
+		return func(error) {
+			utils.Config.EnableFaultInjection = true
+			defer func() { utils.Config.EnableFaultInjection = false }()
+			faults = &faultInjection{random: func() float64 { return 0 }}
+			assert.Nil(t, faults.Set(faultSpec{Kind: kind, Rate: 1, Duration: "1m"}))
+
+			withFaults(func(w http.ResponseWriter, r *http.Request) {})(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/token", nil))
+		}
+	}
+	tokenError := func(err error) { writeTokenError(httptest.NewRecorder(), err) }
+	count := func(reason string) int64 {
+		if value, ok := utils.AuthFailures.Get(reason).(*expvar.Int); ok {
+			return value.Value()
+		}
+		return 0
+	}
+
+	failures := []struct {
+		reason string
+		err    error
+		write  func(error)
+	}{
+		{reasonBadCredentials, errors.Wrap(ldap.ErrInvalidCredentials, "bind refused"), tokenError},
+		{reasonBadCredentials, errors.Wrap(ldap.ErrUserNotFound, "no result"), tokenError},
+		{reasonBadCredentials, ErrPasswordTooShort, tokenError},
+		{reasonBadCredentials, ErrInvalidBasicAuth, func(err error) { writeBasicAuthError(httptest.NewRecorder(), err) }},
+		{reasonLdapUnavailable, errors.Wrap(ldap.ErrUnavailable, "dial failed"), tokenError},
+		{reasonNoNamespaces, errors.Wrapf(ErrTooFewNamespaces, "%d namespaces granted", 0), tokenError},
+		{reasonLocked, errors.Wrap(ldap.ErrAccountLocked, "bind refused"), tokenError},
+		{reasonRateLimited, ErrRateLimited, injectFault(faultRateLimited)},
+		{reasonQuotaExceeded, ErrTokenQuotaExceeded, tokenError},
+		{reasonNotAllowlisted, errors.Wrap(ErrImpersonationDenied, "alice asked to impersonate bob"), tokenError},
+		{reasonOther, ErrClusterNotFound, tokenError},
+	}
+
+	for _, failure := range failures {
+		t.Run(failure.reason+" "+failure.err.Error(), func(t *testing.T) {
+			before := map[string]int64{}
+			for _, reason := range failureReasons {
+				before[reason] = count(reason)
+			}
+
+			failure.write(failure.err)
+
+			for reason, value := range before {
+				if reason == failure.reason {
+					assert.Equal(t, value+1, count(reason), reason)
+				} else {
+					assert.Equal(t, value, count(reason), reason)
+				}
+			}
+		})
+	}
+
+	t.Run("every reason is published under the metric name", func(t *testing.T) {
+		metric, ok := expvar.Get("kubi_auth_failures_total").(*expvar.Map)
+
+		assert.True(t, ok)
+		for _, reason := range failureReasons {
+			assert.NotNil(t, metric.Get(reason), reason)
+		}
+	})
+}
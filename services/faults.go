@@ -0,0 +1,171 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ca-gip/kubi/authenticator"
+	"github.com/ca-gip/kubi/utils"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Kinds of faults injected in the token and config responses
+const (
+	faultUnavailable  = "unavailable"
+	faultRateLimited  = "rate_limited"
+	faultUnauthorized = "unauthorized"
+	faultSlow         = "slow"
+)
+
+// Longest a fault can be injected for, it cannot be left on by mistake
+const maxFaultDuration = time.Hour
+
+// Failure of the rate limited fault, for the failure metrics
+var ErrRateLimited = errors.New("Too many requests")
+
+// A fault asked by an admin with ENABLE_FAULT_INJECTION,
+// for client teams to test their retries and backoff
+type faultSpec struct {
+	Kind     string  `json:"kind"`
+	Rate     float64 `json:"rate"`
+	Duration string  `json:"duration"`
+	Delay    string  `json:"delay,omitempty"`
+}
+
+type faultInjection struct {
+	sync.RWMutex
+	kind   string
+	rate   float64
+	delay  time.Duration
+	until  time.Time
+	random func() float64
+}
+
+var faults = &faultInjection{random: rand.Float64}
+
+// Check and apply a fault, it replaces the previous one
+func (f *faultInjection) Set(spec faultSpec) error {
+	switch spec.Kind {
+	case faultUnavailable, faultRateLimited, faultUnauthorized, faultSlow:
+	default:
+		return fmt.Errorf("unknown fault kind %q", spec.Kind)
+	}
+	if spec.Rate <= 0 || spec.Rate > 1 {
+		return fmt.Errorf("rate must be over 0 and at most 1")
+	}
+	duration, err := time.ParseDuration(spec.Duration)
+	if err != nil || duration <= 0 || duration > maxFaultDuration {
+		return fmt.Errorf("duration must be a positive duration up to %v", maxFaultDuration)
+	}
+	var delay time.Duration
+	if spec.Kind == faultSlow {
+		delay, err = time.ParseDuration(spec.Delay)
+		if err != nil || delay <= 0 {
+			return fmt.Errorf("delay must be a positive duration for a slow fault")
+		}
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	f.kind, f.rate, f.delay, f.until = spec.Kind, spec.Rate, delay, time.Now().Add(duration)
+	return nil
+}
+
+func (f *faultInjection) Clear() {
+	f.Lock()
+	defer f.Unlock()
+	f.kind = ""
+}
+
+// Fault to inject in a request, drawn at the fault rate while it lasts
+func (f *faultInjection) draw() (string, time.Duration, bool) {
+	f.RLock()
+	defer f.RUnlock()
+	if len(f.kind) == 0 || time.Now().After(f.until) || f.random() >= f.rate {
+		return "", 0, false
+	}
+	return f.kind, f.delay, true
+}
+
+// Inject the current fault in a fraction of the requests, with ENABLE_FAULT_INJECTION
+// A slow fault delays the request, the others answer in place of the handler
+// and are counted in the failure metrics as the failure they stand for
+func withFaults(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !utils.Config.EnableFaultInjection {
+			handler(w, r)
+			return
+		}
+		kind, delay, ok := faults.draw()
+		if !ok {
+			handler(w, r)
+			return
+		}
+
+		utils.Log.Warn().Msgf("Fault %s injected in %s %s", kind, r.Method, r.URL.Path)
+		switch kind {
+		case faultSlow:
+			time.Sleep(delay)
+			handler(w, r)
+		case faultUnavailable:
+			countAuthFailure(ldap.ErrUnavailable)
+			w.Header().Set("Retry-After", strconv.Itoa(utils.Config.Ldap.RetryAfter))
+			w.WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(w, "Injected fault: authentication backend unavailable")
+		case faultRateLimited:
+			countAuthFailure(ErrRateLimited)
+			w.Header().Set("Retry-After", strconv.Itoa(utils.Config.Ldap.RetryAfter))
+			w.WriteHeader(http.StatusTooManyRequests)
+			io.WriteString(w, "Injected fault: too many requests")
+		case faultUnauthorized:
+			countAuthFailure(ldap.ErrInvalidCredentials)
+			setRealmHeader(w)
+			w.WriteHeader(http.StatusUnauthorized)
+			io.WriteString(w, "Injected fault: invalid credentials")
+		}
+	}
+}
+
+// InjectFaults set the injected fault with PUT, or clear it with DELETE
+// Only served with ENABLE_FAULT_INJECTION, and to admin tokens
+func InjectFaults(w http.ResponseWriter, r *http.Request) {
+	if !utils.Config.EnableFaultInjection {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	claims, err := CurrentJWT(w, r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if !claims.AdminAccess {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		faults.Clear()
+		utils.Log.Warn().Msgf("Fault injection cleared by %s", utils.RedactUser(claims.User))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var spec faultSpec
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&spec); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, err.Error())
+		return
+	}
+	if err := faults.Set(spec); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, err.Error())
+		return
+	}
+	utils.Log.Warn().Msgf("Fault %s injected at rate %v for %s by %s", spec.Kind, spec.Rate, spec.Duration, utils.RedactUser(claims.User))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,69 @@
+package services
+
+import (
+	"github.com/ca-gip/kubi/types"
+	"github.com/ca-gip/kubi/utils"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFaultInjection(t *testing.T) {
+	withConfig(t, &types.Config{Ldap: types.LdapConfig{RetryAfter: 30}})
+
+	// Evenly spread draws, 0.0 to 0.9
+	draws := 0
+	faults = &faultInjection{random: func() float64 {
+		draws++
+		return float64((draws-1)%10) / 10
+	}}
+	defer func() { faults = &faultInjection{random: rand.Float64} }()
+
+	ok := func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) }
+	codes := func() map[int]int {
+		result := map[int]int{}
+		for i := 0; i < 100; i++ {
+			recorder := httptest.NewRecorder()
+			withFaults(ok)(recorder, httptest.NewRequest(http.MethodGet, "/token", nil))
+			result[recorder.Code]++
+		}
+		return result
+	}
+
+	assert.Nil(t, faults.Set(faultSpec{Kind: faultUnavailable, Rate: 0.3, Duration: "1m"}))
+
+	t.Run("no fault is injected when not enabled", func(t *testing.T) {
+		assert.Equal(t, map[int]int{http.StatusOK: 100}, codes())
+	})
+
+	t.Run("the fault is injected at the configured rate", func(t *testing.T) {
+		utils.Config.EnableFaultInjection = true
+		defer func() { utils.Config.EnableFaultInjection = false }()
+
+		assert.Equal(t, map[int]int{http.StatusOK: 70, http.StatusServiceUnavailable: 30}, codes())
+	})
+
+	t.Run("a cleared fault is not injected", func(t *testing.T) {
+		utils.Config.EnableFaultInjection = true
+		defer func() { utils.Config.EnableFaultInjection = false }()
+		faults.Clear()
+
+		assert.Equal(t, map[int]int{http.StatusOK: 100}, codes())
+	})
+
+	t.Run("invalid faults are rejected", func(t *testing.T) {
+		assert.NotNil(t, faults.Set(faultSpec{Kind: "teapot", Rate: 0.5, Duration: "1m"}))
+		assert.NotNil(t, faults.Set(faultSpec{Kind: faultRateLimited, Rate: 1.5, Duration: "1m"}))
+		assert.NotNil(t, faults.Set(faultSpec{Kind: faultRateLimited, Rate: 0.5, Duration: "24h"}))
+		assert.NotNil(t, faults.Set(faultSpec{Kind: faultSlow, Rate: 0.5, Duration: "1m"}))
+	})
+
+	t.Run("the trigger is not served when not enabled", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		InjectFaults(recorder, httptest.NewRequest(http.MethodPut, "/faults", nil))
+
+		assert.Equal(t, http.StatusNotFound, recorder.Code)
+	})
+}
@@ -0,0 +1,42 @@
+package services
+
+import (
+	"github.com/ca-gip/kubi/types"
+	"github.com/ca-gip/kubi/utils"
+	"testing"
+)
+
+// Key signing the tokens of the tests
+var testSigningKey = []byte("a-signing-key")
+
+// Replace the configuration for the duration of a test
+// The configuration and the signing key are restored after it
+func withConfig(t *testing.T, config *types.Config) {
+	t.Helper()
+	defaultConfig, defaultKey := utils.Config, signingKey
+	t.Cleanup(func() { utils.Config, signingKey = defaultConfig, defaultKey })
+	utils.Config = config
+}
+
+// WithConfig is withConfig for the tests of the services_test package
+var WithConfig = withConfig
+
+// SetGroupParser swaps the group parser for the tests of the services_test package
+var SetGroupParser = func(expression string) error { return groupParsers.Set(expression) }
+
+// Sign and verify 4h HS512 tokens with the test key,
+// unless the configuration says otherwise
+func withTokenConfig(t *testing.T, config *types.Config) {
+	t.Helper()
+	if len(config.TokenLifeTime) == 0 {
+		config.TokenLifeTime = "4h"
+	}
+	if len(config.JwtSigningMethod) == 0 {
+		config.JwtSigningMethod = "HS512"
+	}
+	if len(config.JwtVerifyAlgs) == 0 {
+		config.JwtVerifyAlgs = []string{"HS512"}
+	}
+	withConfig(t, config)
+	signingKey = testSigningKey
+}
@@ -0,0 +1,62 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/ca-gip/kubi/utils"
+	"github.com/dgrijalva/jwt-go"
+	"net/http"
+)
+
+// Fixed message signed to fingerprint the signing key
+const fingerprintMessage = "kubi-signing-key-fingerprint"
+
+// KeyFingerprint return a non secret fingerprint of a signing key.
+// An RSA or ECDSA key is identified by the JWK thumbprint of its public
+// key, the kid published on /jwks, whatever the encoding of the key file.
+// An HMAC secret gets a truncated HMAC of a fixed message.
+// Replicas sharing the same key report the same value, the key itself is never exposed.
+func KeyFingerprint(key []byte) string {
+	if public := privateKeyPublicPart(key); public != nil {
+		if jsonKey, err := newJsonWebKey(public); err == nil {
+			return jwkThumbprint(jsonKey)
+		}
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(fingerprintMessage))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// Public key of an RSA or ECDSA private key file, nil for a secret
+func privateKeyPublicPart(key []byte) interface{} {
+	if private, err := jwt.ParseRSAPrivateKeyFromPEM(key); err == nil {
+		return &private.PublicKey
+	}
+	if private, err := jwt.ParseECPrivateKeyFromPEM(key); err == nil {
+		return &private.PublicKey
+	}
+	return nil
+}
+
+// Readiness handler, report the signing key fingerprint
+// so operators can diff replicas behind a load balancer.
+// A verify only kubi has no signing key, it reports the
+// fingerprints of its verification keys instead
+func Readyz(w http.ResponseWriter, _ *http.Request) {
+	status := map[string]interface{}{"status": "ok"}
+	if utils.Config.VerifyOnly {
+		fingerprints := []string{}
+		for _, key := range verifyOnlyJwks() {
+			fingerprints = append(fingerprints, key.Kid)
+		}
+		status["verifyKeyFingerprints"] = fingerprints
+	} else {
+		status["signingKeyFingerprint"] = KeyFingerprint(signingKey)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,76 @@
+package services_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/ca-gip/kubi/services"
+	"github.com/ca-gip/kubi/types"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestKeyFingerprint(t *testing.T) {
+
+	t.Run("same key report the same fingerprint", func(t *testing.T) {
+		first := services.KeyFingerprint([]byte("a-signing-key"))
+		second := services.KeyFingerprint([]byte("a-signing-key"))
+
+		assert.Equal(t, first, second)
+	})
+
+	t.Run("different keys report different fingerprints", func(t *testing.T) {
+		first := services.KeyFingerprint([]byte("a-signing-key"))
+		second := services.KeyFingerprint([]byte("another-signing-key"))
+
+		assert.NotEqual(t, first, second)
+	})
+
+	t.Run("fingerprint does not expose the key", func(t *testing.T) {
+		result := services.KeyFingerprint([]byte("a-signing-key"))
+
+		assert.NotContains(t, result, "a-signing-key")
+		assert.Len(t, result, 16)
+	})
+
+	t.Run("an RSA key is identified by its public key, not its file", func(t *testing.T) {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		assert.Nil(t, err)
+		pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+		assert.Nil(t, err)
+
+		first := services.KeyFingerprint(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+		second := services.KeyFingerprint(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}))
+
+		assert.Equal(t, first, second)
+	})
+}
+
+func TestReadyzVerifyOnly(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	publicDer, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.Nil(t, err)
+
+	services.WithConfig(t, &types.Config{
+		VerifyOnly: true,
+		VerifyKeys: [][]byte{pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDer})},
+	})
+
+	recorder := httptest.NewRecorder()
+	services.Readyz(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	var status struct {
+		SigningKeyFingerprint string   `json:"signingKeyFingerprint"`
+		VerifyKeyFingerprints []string `json:"verifyKeyFingerprints"`
+	}
+	assert.Nil(t, json.NewDecoder(recorder.Body).Decode(&status))
+	assert.Empty(t, status.SigningKeyFingerprint)
+	// A verifier reports the fingerprint its issuer reports for the same key
+	signing := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	assert.Equal(t, []string{services.KeyFingerprint(signing)}, status.VerifyKeyFingerprints)
+}
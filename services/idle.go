@@ -0,0 +1,72 @@
+package services
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/ca-gip/kubi/utils"
+	"sync"
+	"time"
+)
+
+var ErrTokenIdle = errors.New("token unused for longer than the idle timeout")
+
+type activityEntry struct {
+	lastSeen  time.Time
+	expiresAt time.Time
+}
+
+// Track the last use of each token by its id
+// Entries are kept until the token expiry, then pruned
+type tokenActivity struct {
+	sync.Mutex
+	entries    map[string]activityEntry
+	lastPruned time.Time
+	now        func() time.Time
+}
+
+var tokenActivities = &tokenActivity{entries: map[string]activityEntry{}, now: time.Now}
+
+// Generate a random token id
+func newTokenId() (string, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+// Record a token use, return false if it was idle for too long
+// A token unknown to this instance starts to be tracked.
+// A zero timeout means no idle check
+func (a *tokenActivity) Touch(id string, expiresAt int64) bool {
+	timeout := utils.Config.TokenIdleTimeout
+	if timeout <= 0 || len(id) == 0 {
+		return true
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	now := a.now()
+	a.prune(now, timeout)
+
+	entry, ok := a.entries[id]
+	if ok && now.Sub(entry.lastSeen) > timeout {
+		return false
+	}
+	a.entries[id] = activityEntry{lastSeen: now, expiresAt: time.Unix(expiresAt, 0)}
+	return true
+}
+
+// Drop expired tokens, at most once per timeout
+func (a *tokenActivity) prune(now time.Time, timeout time.Duration) {
+	if now.Sub(a.lastPruned) < timeout {
+		return
+	}
+	for id, entry := range a.entries {
+		if now.After(entry.expiresAt) {
+			delete(a.entries, id)
+		}
+	}
+	a.lastPruned = now
+}
@@ -0,0 +1,76 @@
+package services
+
+import (
+	"github.com/ca-gip/kubi/types"
+	"github.com/ca-gip/kubi/utils"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenActivity(t *testing.T) {
+	withConfig(t, &types.Config{TokenIdleTimeout: 15 * time.Minute})
+	now := time.Date(2019, 3, 1, 10, 0, 0, 0, time.UTC)
+	expiresAt := now.Add(4 * time.Hour).Unix()
+	activity := &tokenActivity{entries: map[string]activityEntry{}, now: func() time.Time { return now }}
+
+	activity.Touch("used", expiresAt)
+	activity.Touch("idle", expiresAt)
+
+	t.Run("a regularly used token stays valid", func(t *testing.T) {
+		for i := 0; i < 4; i++ {
+			now = now.Add(10 * time.Minute)
+			assert.True(t, activity.Touch("used", expiresAt))
+		}
+	})
+
+	t.Run("an idle token is rejected before its expiry", func(t *testing.T) {
+		assert.False(t, activity.Touch("idle", expiresAt))
+		assert.False(t, activity.Touch("idle", expiresAt))
+	})
+
+	t.Run("expired tokens are pruned", func(t *testing.T) {
+		now = time.Unix(expiresAt, 0).Add(time.Minute)
+		activity.Touch("other", now.Add(time.Hour).Unix())
+
+		assert.NotContains(t, activity.entries, "used")
+		assert.NotContains(t, activity.entries, "idle")
+	})
+
+	t.Run("a zero timeout means no idle check", func(t *testing.T) {
+		utils.Config.TokenIdleTimeout = 0
+
+		assert.True(t, activity.Touch("idle", expiresAt))
+	})
+}
+
+func TestIdleTokenRejected(t *testing.T) {
+	withTokenConfig(t, &types.Config{TokenRefreshGrace: "2m", TokenIdleTimeout: 15 * time.Minute})
+	now := time.Now()
+	defaultActivities := tokenActivities
+	tokenActivities = &tokenActivity{entries: map[string]activityEntry{}, now: func() time.Time { return now }}
+	defer func() { tokenActivities = defaultActivities }()
+
+	token, _, err := signUserToken(nil, "demo", false, tokenBinding{})
+	assert.Nil(t, err)
+	verify := func() int {
+		recorder := httptest.NewRecorder()
+		VerifyJWT(recorder, httptest.NewRequest(http.MethodPost, "/token/demo", strings.NewReader(token)))
+		return recorder.Code
+	}
+	assert.Equal(t, http.StatusOK, verify())
+	now = now.Add(20 * time.Minute)
+
+	t.Run("the webhook rejects an idle token", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, verify())
+	})
+
+	t.Run("an idle token cannot be refreshed", func(t *testing.T) {
+		_, err := refreshUserToken(token, httptest.NewRequest(http.MethodGet, "/token/refresh", nil))
+
+		assert.Equal(t, ErrTokenIdle, err)
+	})
+}
@@ -0,0 +1,55 @@
+package services
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrDuplicateTokenId = errors.New("token id already seen for another user")
+
+// Interval between two prunes of the token ids
+const tokenIdPruneInterval = time.Minute
+
+type tokenIdEntry struct {
+	user      string
+	expiresAt time.Time
+}
+
+// Users of the verified token ids, kept until the token expiry. The same id
+// for two users means a forged token or a leaked signing key
+type tokenIds struct {
+	sync.Mutex
+	entries    map[string]tokenIdEntry
+	lastPruned time.Time
+	now        func() time.Time
+}
+
+var verifiedTokenIds = &tokenIds{entries: map[string]tokenIdEntry{}, now: time.Now}
+
+// Record the user of a token id, return false if the id was seen for another user
+func (t *tokenIds) Record(id string, user string, expiresAt int64) bool {
+	t.Lock()
+	defer t.Unlock()
+	now := t.now()
+	t.prune(now)
+
+	if entry, ok := t.entries[id]; ok {
+		return entry.user == user
+	}
+	t.entries[id] = tokenIdEntry{user: user, expiresAt: time.Unix(expiresAt, 0)}
+	return true
+}
+
+// Drop the ids of expired tokens, at most once per interval
+func (t *tokenIds) prune(now time.Time) {
+	if now.Sub(t.lastPruned) < tokenIdPruneInterval {
+		return
+	}
+	for id, entry := range t.entries {
+		if now.After(entry.expiresAt) {
+			delete(t.entries, id)
+		}
+	}
+	t.lastPruned = now
+}
@@ -0,0 +1,312 @@
+package services
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/ca-gip/kubi/utils"
+	"github.com/dgrijalva/jwt-go"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Largest JWKS document read from an url
+const maxJwksSize = 1 << 20
+
+// Verification keys fetched from VERIFY_JWKS_URLS, by url then kid
+// A failed fetch keeps the keys last fetched from that url
+type jwksKeys struct {
+	sync.RWMutex
+	client    *http.Client
+	keys      map[string]map[string]interface{}
+	instances map[string]string
+}
+
+func newJwksKeys() *jwksKeys {
+	return &jwksKeys{
+		client:    &http.Client{Timeout: 10 * time.Second},
+		keys:      map[string]map[string]interface{}{},
+		instances: map[string]string{},
+	}
+}
+
+// A JWKS url, given as instance=url its keys only verify
+// the tokens of that KUBI_INSTANCE_NAME
+type jwksSource struct {
+	instance string
+	url      string
+}
+
+func parseJwksSource(entry string) jwksSource {
+	separator := strings.Index(entry, "=")
+	if separator > 0 && !strings.Contains(entry[:separator], "/") {
+		return jwksSource{instance: entry[:separator], url: entry[separator+1:]}
+	}
+	return jwksSource{url: entry}
+}
+
+var jwks = newJwksKeys()
+
+// A key of a JWKS document, only the RSA and EC members are read
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+var jwkCurves = map[string]elliptic.Curve{
+	"P-256": elliptic.P256(),
+	"P-384": elliptic.P384(),
+	"P-521": elliptic.P521(),
+}
+
+// Public key of a JWK
+func (k jsonWebKey) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeJwkInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeJwkInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curve, ok := jwkCurves[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decodeJwkInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeJwkInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+	}
+}
+
+// JWK of a public key, without kid
+func newJsonWebKey(public interface{}) (jsonWebKey, error) {
+	switch public := public.(type) {
+	case *rsa.PublicKey:
+		return jsonWebKey{
+			Kty: "RSA",
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+		}, nil
+	case *ecdsa.PublicKey:
+		size := (public.Curve.Params().BitSize + 7) / 8
+		return jsonWebKey{
+			Kty: "EC",
+			Use: "sig",
+			Crv: public.Curve.Params().Name,
+			X:   base64.RawURLEncoding.EncodeToString(padBytes(public.X.Bytes(), size)),
+			Y:   base64.RawURLEncoding.EncodeToString(padBytes(public.Y.Bytes(), size)),
+		}, nil
+	default:
+		return jsonWebKey{}, fmt.Errorf("only RSA and ECDSA public keys can be published")
+	}
+}
+
+// Left pad with zeros the coordinates of an EC key to the curve size
+func padBytes(data []byte, size int) []byte {
+	if len(data) >= size {
+		return data
+	}
+	return append(make([]byte, size-len(data)), data...)
+}
+
+// RFC 7638 thumbprint of a JWK, the sha256 of its required
+// members in lexicographic order, without whitespace
+func jwkThumbprint(key jsonWebKey) string {
+	var members string
+	switch key.Kty {
+	case "RSA":
+		members = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, key.E, key.N)
+	case "EC":
+		members = fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, key.Crv, key.X, key.Y)
+	}
+	sum := sha256.Sum256([]byte(members))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// JWKS handler, publish the public signing key with the kid of the issued
+// tokens, for verifiers like a verify only kubi. HMAC keys are never published.
+// A verify only kubi publishes its local verification keys, to be chained
+func JWKS(w http.ResponseWriter, _ *http.Request) {
+	var keys []jsonWebKey
+	if utils.Config.VerifyOnly {
+		keys = verifyOnlyJwks()
+	} else {
+		method, err := signingMethod()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		public, err := verifyKey(method, signingKey)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if key, err := newJsonWebKey(public); err == nil {
+			key.Kid = signingKeyId(public)
+			keys = []jsonWebKey{key}
+		}
+	}
+	if len(keys) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(jsonWebKeySet{Keys: keys})
+}
+
+// The local RSA and ECDSA keys of the verify only mode, by thumbprint
+func verifyOnlyJwks() []jsonWebKey {
+	keys := []jsonWebKey{}
+	for _, keyData := range utils.Config.VerifyKeys {
+		var public interface{}
+		if key, err := jwt.ParseRSAPublicKeyFromPEM(keyData); err == nil {
+			public = key
+		} else if key, err := jwt.ParseECPublicKeyFromPEM(keyData); err == nil {
+			public = key
+		} else {
+			continue
+		}
+		key, err := newJsonWebKey(public)
+		if err != nil {
+			continue
+		}
+		key.Kid = jwkThumbprint(key)
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Decode a base64url unsigned integer of a JWK
+func decodeJwkInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty key member")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+// Fetch the signing keys of a JWKS url
+// Keys without kid or of an unsupported type are skipped
+func (j *jwksKeys) fetch(url string) (map[string]interface{}, error) {
+	response, err := j.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", response.StatusCode)
+	}
+
+	var set jsonWebKeySet
+	if err := json.NewDecoder(io.LimitReader(response.Body, maxJwksSize)).Decode(&set); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]interface{}{}
+	for _, key := range set.Keys {
+		if len(key.Kid) == 0 || (len(key.Use) > 0 && key.Use != "sig") {
+			continue
+		}
+		public, err := key.publicKey()
+		if err != nil {
+			utils.Log.Warn().Msgf("Key %s of the JWKS %s skipped: %v", key.Kid, url, err)
+			continue
+		}
+		keys[key.Kid] = public
+	}
+	return keys, nil
+}
+
+// Fetch the urls again, an url failing keeps its last keys
+func (j *jwksKeys) Refresh(entries []string) {
+	for _, entry := range entries {
+		source := parseJwksSource(entry)
+		keys, err := j.fetch(source.url)
+		if err != nil {
+			utils.Log.Error().Msgf("Cannot refresh the JWKS %s, keeping the last keys: %v", source.url, err)
+			continue
+		}
+		j.Lock()
+		j.keys[source.url], j.instances[source.url] = keys, source.instance
+		j.Unlock()
+		utils.Log.Info().Msgf("JWKS loaded from %s, %d keys", source.url, len(keys))
+	}
+}
+
+// Key of a kid, from the urls of the kubi instance of the token and the
+// urls of any instance. A kid with different keys in several urls is
+// ambiguous and not used, the token is then checked like a token without kid
+func (j *jwksKeys) Lookup(kid string, instance string) (interface{}, bool) {
+	j.RLock()
+	defer j.RUnlock()
+	var found interface{}
+	var thumbprint string
+	for url, keys := range j.keys {
+		if scope := j.instances[url]; len(scope) > 0 && scope != instance {
+			continue
+		}
+		key, ok := keys[kid]
+		if !ok {
+			continue
+		}
+		jsonKey, _ := newJsonWebKey(key)
+		if found != nil && jwkThumbprint(jsonKey) != thumbprint {
+			utils.Log.Warn().Msgf("Kid %s has different keys in several JWKS, it is not used", kid)
+			return nil, false
+		}
+		found, thumbprint = key, jwkThumbprint(jsonKey)
+	}
+	return found, found != nil
+}
+
+// WatchJWKS fetch the JWKS urls, then again at each interval
+func WatchJWKS(urls []string, interval time.Duration) {
+	jwks.Refresh(urls)
+	if interval <= 0 {
+		utils.Log.Warn().Msgf("The JWKS are not refreshed, the refresh interval is %v", interval)
+		return
+	}
+
+	go func() {
+		for range time.NewTicker(interval).C {
+			jwks.Refresh(urls)
+		}
+	}()
+}
@@ -0,0 +1,187 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/ca-gip/kubi/types"
+	"github.com/ca-gip/kubi/utils"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestJWKS(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+
+	failing := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(jsonWebKeySet{Keys: []jsonWebKey{{
+			Kty: "RSA",
+			Kid: "issuer-a",
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes()),
+		}}})
+	}))
+	defer server.Close()
+
+	jwks = newJwksKeys()
+	defer func() { jwks = newJwksKeys() }()
+	withConfig(t, &types.Config{VerifyOnly: true, JwtVerifyAlgs: []string{"RS256"}})
+
+	sign := func(kid string) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, types.AuthJWTClaims{User: "demo"})
+		token.Header["kid"] = kid
+		signed, err := token.SignedString(rsaKey)
+		assert.Nil(t, err)
+		return signed
+	}
+	parse := func(token string) error {
+		_, err := jwt.ParseWithClaims(token, &types.AuthJWTClaims{}, verifyKeyFunc)
+		return err
+	}
+
+	t.Run("a token signed by a fetched key verifies", func(t *testing.T) {
+		jwks.Refresh([]string{server.URL})
+
+		assert.Nil(t, parse(sign("issuer-a")))
+	})
+
+	t.Run("a token of an unknown kid is rejected", func(t *testing.T) {
+		assert.NotNil(t, parse(sign("issuer-b")))
+	})
+
+	t.Run("a failed refresh keeps the last keys", func(t *testing.T) {
+		failing = true
+		defer func() { failing = false }()
+		jwks.Refresh([]string{server.URL})
+
+		assert.Nil(t, parse(sign("issuer-a")))
+	})
+
+	signFor := func(instance string) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, types.AuthJWTClaims{User: "demo", Instance: instance})
+		token.Header["kid"] = "issuer-a"
+		signed, err := token.SignedString(rsaKey)
+		assert.Nil(t, err)
+		return signed
+	}
+
+	t.Run("the keys of an instance url only verify the tokens of that instance", func(t *testing.T) {
+		jwks = newJwksKeys()
+		jwks.Refresh([]string{"kubi-a=" + server.URL})
+
+		assert.Nil(t, parse(signFor("kubi-a")))
+		assert.NotNil(t, parse(signFor("kubi-b")))
+		assert.NotNil(t, parse(signFor("")))
+	})
+
+	t.Run("a kid with different keys in several urls is not used", func(t *testing.T) {
+		otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		assert.Nil(t, err)
+		other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(jsonWebKeySet{Keys: []jsonWebKey{{
+				Kty: "RSA",
+				Kid: "issuer-a",
+				N:   base64.RawURLEncoding.EncodeToString(otherKey.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(otherKey.E)).Bytes()),
+			}}})
+		}))
+		defer other.Close()
+		jwks = newJwksKeys()
+		jwks.Refresh([]string{server.URL, other.URL})
+
+		assert.NotNil(t, parse(sign("issuer-a")))
+
+		jwks = newJwksKeys()
+		jwks.Refresh([]string{"kubi-a=" + server.URL, "kubi-b=" + other.URL})
+
+		assert.Nil(t, parse(signFor("kubi-a")))
+	})
+}
+
+func TestParseJwksSource(t *testing.T) {
+	assert.Equal(t, jwksSource{url: "https://issuer/jwks"}, parseJwksSource("https://issuer/jwks"))
+	assert.Equal(t, jwksSource{url: "https://issuer/jwks?a=b"}, parseJwksSource("https://issuer/jwks?a=b"))
+	assert.Equal(t, jwksSource{instance: "kubi-a", url: "https://issuer/jwks"}, parseJwksSource("kubi-a=https://issuer/jwks"))
+}
+
+func TestJWKSKeyId(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	withConfig(t, &types.Config{TokenLifeTime: "4h", JwtSigningMethod: "RS256", JwtVerifyAlgs: []string{"RS256"}})
+	signingKey = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})
+
+	server := httptest.NewServer(http.HandlerFunc(JWKS))
+	defer server.Close()
+
+	token, _, err := signUserToken(nil, "demo", false, tokenBinding{})
+	assert.Nil(t, err)
+	parsed, _, err := new(jwt.Parser).ParseUnverified(token, &types.AuthJWTClaims{})
+	assert.Nil(t, err)
+
+	t.Run("the token kid is the published key kid", func(t *testing.T) {
+		response, err := http.Get(server.URL)
+		assert.Nil(t, err)
+		defer response.Body.Close()
+
+		var set jsonWebKeySet
+		assert.Nil(t, json.NewDecoder(response.Body).Decode(&set))
+		assert.Len(t, set.Keys, 1)
+		assert.Equal(t, set.Keys[0].Kid, parsed.Header["kid"])
+	})
+
+	t.Run("a verify only kubi verifies the token with the published key", func(t *testing.T) {
+		jwks = newJwksKeys()
+		defer func() { jwks = newJwksKeys() }()
+		jwks.Refresh([]string{server.URL})
+		utils.Config.VerifyOnly = true
+
+		_, err := jwt.ParseWithClaims(token, &types.AuthJWTClaims{}, verifyKeyFunc)
+		assert.Nil(t, err)
+	})
+
+	t.Run("HMAC keys are not published", func(t *testing.T) {
+		withConfig(t, &types.Config{JwtSigningMethod: "HS512"})
+		recorder := httptest.NewRecorder()
+
+		JWKS(recorder, httptest.NewRequest(http.MethodGet, "/jwks", nil))
+
+		assert.Equal(t, http.StatusNotFound, recorder.Code)
+	})
+}
+
+func TestVerifyOnlyJWKS(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	publicDer, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	assert.Nil(t, err)
+	withConfig(t, &types.Config{
+		VerifyOnly: true,
+		VerifyKeys: [][]byte{pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDer})},
+	})
+	signingKey = nil
+
+	recorder := httptest.NewRecorder()
+	NewRouter(false, true).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/jwks", nil))
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var set jsonWebKeySet
+	assert.Nil(t, json.NewDecoder(recorder.Body).Decode(&set))
+	assert.Len(t, set.Keys, 1)
+	expected, err := newJsonWebKey(&rsaKey.PublicKey)
+	assert.Nil(t, err)
+	assert.Equal(t, jwkThumbprint(expected), set.Keys[0].Kid)
+}
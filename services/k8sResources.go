@@ -9,8 +9,6 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/api/rbac/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
 	"net/http"
 )
 
@@ -60,8 +58,11 @@ func GenerateNamespaces(context []*types.AuthJWTTupple) {
 // GenerateRolebinding from tupple
 // If exists, nothing is done, only creating !
 func GenerateRoleBinding(context *types.AuthJWTTupple) {
-	kconfig, err := rest.InClusterConfig()
-	clientSet, err := kubernetes.NewForConfig(kconfig)
+	clientSet, err := utils.KubeClient()
+	if err != nil {
+		utils.Log.Error().Msg(err.Error())
+		return
+	}
 	api := clientSet.RbacV1()
 
 	roleBindingName := fmt.Sprintf("%s-%s", context.Namespace, context.Role)
@@ -105,8 +106,11 @@ func GenerateRoleBinding(context *types.AuthJWTTupple) {
 // GenerateRolebinding from tupple
 // If exists, nothing is done, only creating !
 func GenerateAdminClusterRoleBinding() {
-	kconfig, err := rest.InClusterConfig()
-	clientSet, err := kubernetes.NewForConfig(kconfig)
+	clientSet, err := utils.KubeClient()
+	if err != nil {
+		utils.Log.Error().Msg(err.Error())
+		return
+	}
 	api := clientSet.RbacV1()
 
 	_, errRB := api.ClusterRoleBindings().Get(utils.KubiClusterRoleBindingName, metav1.GetOptions{})
@@ -149,8 +153,11 @@ func GenerateAdminClusterRoleBinding() {
 // GenerateRolebinding from tupple
 // If exists, nothing is done, only creating !
 func GenerateNamespace(context *types.AuthJWTTupple) {
-	kconfig, err := rest.InClusterConfig()
-	clientSet, err := kubernetes.NewForConfig(kconfig)
+	clientSet, err := utils.KubeClient()
+	if err != nil {
+		utils.Log.Error().Msg(err.Error())
+		return
+	}
 	api := clientSet.CoreV1()
 
 	_, errNs := api.Namespaces().Get(context.Namespace, metav1.GetOptions{})
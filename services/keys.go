@@ -0,0 +1,146 @@
+package services
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"fmt"
+	"github.com/ca-gip/kubi/types"
+	"github.com/ca-gip/kubi/utils"
+	"github.com/dgrijalva/jwt-go"
+	"strings"
+)
+
+// Signing method used to issue tokens
+func signingMethod() (jwt.SigningMethod, error) {
+	method := jwt.GetSigningMethod(utils.Config.JwtSigningMethod)
+	if method == nil {
+		return nil, fmt.Errorf("unknown JWT_SIGNING_METHOD %s", utils.Config.JwtSigningMethod)
+	}
+	return method, nil
+}
+
+// Key used to sign with a method, HMAC use the raw key file,
+// RSA and ECDSA the parsed private key
+func signKey(method jwt.SigningMethod, keyData []byte) (interface{}, error) {
+	switch method.(type) {
+	case *jwt.SigningMethodHMAC:
+		return keyData, nil
+	case *jwt.SigningMethodRSA:
+		return jwt.ParseRSAPrivateKeyFromPEM(keyData)
+	case *jwt.SigningMethodECDSA:
+		return jwt.ParseECPrivateKeyFromPEM(keyData)
+	default:
+		return nil, fmt.Errorf("unsupported signing method %s", method.Alg())
+	}
+}
+
+// Key used to verify a method, the public part for RSA and ECDSA
+func verifyKey(method jwt.SigningMethod, keyData []byte) (interface{}, error) {
+	switch method.(type) {
+	case *jwt.SigningMethodHMAC:
+		return keyData, nil
+	case *jwt.SigningMethodRSA:
+		key, err := jwt.ParseRSAPrivateKeyFromPEM(keyData)
+		if err != nil {
+			return nil, err
+		}
+		return &key.PublicKey, nil
+	case *jwt.SigningMethodECDSA:
+		key, err := jwt.ParseECPrivateKeyFromPEM(keyData)
+		if err != nil {
+			return nil, err
+		}
+		return &key.PublicKey, nil
+	default:
+		return nil, fmt.Errorf("unsupported signing method %s", method.Alg())
+	}
+}
+
+// Public part of a signing key, HMAC keys have none
+func publicPart(key interface{}) interface{} {
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return &key.PublicKey
+	case *ecdsa.PrivateKey:
+		return &key.PublicKey
+	default:
+		return key
+	}
+}
+
+// Key id of the issued tokens, JWT_KEY_ID or else derived from the key:
+// the JWK thumbprint of the public key for RSA and ECDSA, matching the
+// /jwks entry, and the non secret key fingerprint for HMAC
+func signingKeyId(public interface{}) string {
+	if len(utils.Config.JwtKeyId) > 0 {
+		return utils.Config.JwtKeyId
+	}
+	if key, err := newJsonWebKey(public); err == nil {
+		return jwkThumbprint(key)
+	}
+	return KeyFingerprint(signingKey)
+}
+
+// Key used to verify a method in verify only mode, from a public key alone
+// HMAC tokens cannot be verified without the signing secret
+func publicVerifyKey(method jwt.SigningMethod, keyData []byte) (interface{}, error) {
+	switch method.(type) {
+	case *jwt.SigningMethodRSA:
+		return jwt.ParseRSAPublicKeyFromPEM(keyData)
+	case *jwt.SigningMethodECDSA:
+		return jwt.ParseECPublicKeyFromPEM(keyData)
+	default:
+		return nil, fmt.Errorf("signing method %s cannot be verified in verify only mode", method.Alg())
+	}
+}
+
+// Key to verify a token in verify only mode: the JWKS key of its kid, the
+// local key whose thumbprint is its kid, or else the local key its signature
+// verifies with, as the issuer may set JWT_KEY_ID or no kid at all
+func verifyOnlyKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if len(kid) > 0 {
+		var instance string
+		if claims, ok := token.Claims.(*types.AuthJWTClaims); ok {
+			instance = claims.Instance
+		}
+		if key, found := jwks.Lookup(kid, instance); found {
+			return key, nil
+		}
+	}
+
+	var keys []interface{}
+	for _, keyData := range utils.Config.VerifyKeys {
+		key, err := publicVerifyKey(token.Method, keyData)
+		if err != nil {
+			continue
+		}
+		if jsonKey, err := newJsonWebKey(key); err == nil && len(kid) > 0 && jwkThumbprint(jsonKey) == kid {
+			return key, nil
+		}
+		keys = append(keys, key)
+	}
+
+	parts := strings.Split(token.Raw, ".")
+	if len(parts) == 3 {
+		for _, key := range keys {
+			if token.Method.Verify(strings.Join(parts[0:2], "."), parts[2], key) == nil {
+				return key, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no verification key for the %s token", token.Method.Alg())
+}
+
+// Keyfunc for token parsing, a token whose alg
+// is not in JWT_VERIFY_ALGS is rejected
+func verifyKeyFunc(token *jwt.Token) (interface{}, error) {
+	alg := token.Method.Alg()
+	if !utils.Include(utils.Config.JwtVerifyAlgs, alg) {
+		return nil, fmt.Errorf("unexpected signing method %s", alg)
+	}
+	if utils.Config.VerifyOnly {
+		return verifyOnlyKey(token)
+	}
+	return verifyKey(token.Method, signingKey)
+}
@@ -0,0 +1,126 @@
+package services
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/ca-gip/kubi/types"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestVerifyKeyFunc(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	withConfig(t, &types.Config{})
+	signingKey = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})
+
+	sign := func(method jwt.SigningMethod) string {
+		key, err := signKey(method, signingKey)
+		assert.Nil(t, err)
+		token, err := jwt.NewWithClaims(method, types.AuthJWTClaims{User: "demo"}).SignedString(key)
+		assert.Nil(t, err)
+		return token
+	}
+	parse := func(token string) error {
+		_, err := jwt.ParseWithClaims(token, &types.AuthJWTClaims{}, verifyKeyFunc)
+		return err
+	}
+
+	t.Run("tokens of each accepted alg verify", func(t *testing.T) {
+		withConfig(t, &types.Config{JwtVerifyAlgs: []string{"HS512", "RS512"}})
+
+		assert.Nil(t, parse(sign(jwt.SigningMethodHS512)))
+		assert.Nil(t, parse(sign(jwt.SigningMethodRS512)))
+	})
+
+	t.Run("a disallowed alg is rejected", func(t *testing.T) {
+		withConfig(t, &types.Config{JwtVerifyAlgs: []string{"RS512"}})
+
+		assert.NotNil(t, parse(sign(jwt.SigningMethodHS512)))
+		assert.NotNil(t, parse(sign(jwt.SigningMethodRS256)))
+	})
+}
+
+func TestVerifyOnly(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	publicDer, err := x509.MarshalPKIXPublicKey(&ecKey.PublicKey)
+	assert.Nil(t, err)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	otherDer, err := x509.MarshalPKIXPublicKey(&otherKey.PublicKey)
+	assert.Nil(t, err)
+
+	// The key of another issuer comes first
+	withConfig(t, &types.Config{
+		VerifyOnly: true,
+		VerifyKeys: [][]byte{
+			pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: otherDer}),
+			pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDer}),
+		},
+		JwtSigningMethod: "ES256",
+		JwtVerifyAlgs:    []string{"ES256", "HS512"},
+		TokenLifeTime:    "4h",
+	})
+	// No signing key at all, only the public key
+	signingKey = nil
+	parse := func(token string) error {
+		_, err := jwt.ParseWithClaims(token, &types.AuthJWTClaims{}, verifyKeyFunc)
+		return err
+	}
+
+	t.Run("tokens signed by the issuer verify with the public key", func(t *testing.T) {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodES256, types.AuthJWTClaims{User: "demo"}).SignedString(ecKey)
+		assert.Nil(t, err)
+
+		assert.Nil(t, parse(token))
+	})
+
+	t.Run("the key is picked by the kid thumbprint", func(t *testing.T) {
+		jsonKey, err := newJsonWebKey(&ecKey.PublicKey)
+		assert.Nil(t, err)
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, types.AuthJWTClaims{User: "demo"})
+		token.Header["kid"] = jwkThumbprint(jsonKey)
+		signed, err := token.SignedString(ecKey)
+		assert.Nil(t, err)
+
+		assert.Nil(t, parse(signed))
+	})
+
+	t.Run("a token with an unknown kid verifies with the key it is signed with", func(t *testing.T) {
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, types.AuthJWTClaims{User: "demo"})
+		token.Header["kid"] = "issuer-key-id"
+		signed, err := token.SignedString(ecKey)
+		assert.Nil(t, err)
+
+		assert.Nil(t, parse(signed))
+	})
+
+	t.Run("a token of an unknown key is rejected", func(t *testing.T) {
+		unknownKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.Nil(t, err)
+		token, err := jwt.NewWithClaims(jwt.SigningMethodES256, types.AuthJWTClaims{User: "demo"}).SignedString(unknownKey)
+		assert.Nil(t, err)
+
+		assert.NotNil(t, parse(token))
+	})
+
+	t.Run("HMAC tokens cannot be verified", func(t *testing.T) {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS512, types.AuthJWTClaims{User: "demo"}).SignedString([]byte("a-secret"))
+		assert.Nil(t, err)
+
+		assert.NotNil(t, parse(token))
+	})
+
+	t.Run("issuance is rejected", func(t *testing.T) {
+		token, _, err := signUserToken(nil, "demo", false, tokenBinding{})
+
+		assert.Equal(t, ErrVerifyOnly, err)
+		assert.Empty(t, token)
+	})
+}
@@ -0,0 +1,222 @@
+package services
+
+import (
+	"github.com/ca-gip/kubi/types"
+	"github.com/ca-gip/kubi/utils"
+	"github.com/pkg/errors"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const defaultClusterName = "kubernetes"
+
+// Build a kubeconfig for a user token
+// The embedded CA is KUBECONFIG_CA_DATA, the in cluster CA by default.
+// The default cluster is the kubi server itself. When namespaces are mapped
+// to other clusters, a context is added for each authorized namespace
+// pointing to its cluster. Other clusters embed their CLUSTER_CAS entry,
+// or no CA at all so the system trust store is used.
+func newKubeConfig(server string, username string, token string, auths []*types.AuthJWTTupple, hasAdminAccess bool) *types.KubeConfig {
+	userName := kubeConfigName(username)
+	config := &types.KubeConfig{
+		ApiVersion: "v1",
+		Kind:       "Config",
+		Clusters: []types.KubeConfigCluster{
+			{
+				Name: defaultClusterName,
+				Cluster: types.KubeConfigClusterData{
+					Server:          server,
+					CertificateData: utils.Config.KubeConfigCa,
+				},
+			},
+		},
+		CurrentContext: defaultClusterName + "-" + userName,
+		Contexts: []types.KubeConfigContext{
+			{
+				Name: defaultClusterName + "-" + userName,
+				Context: types.KubeConfigContextData{
+					Cluster:   defaultClusterName,
+					Namespace: defaultNamespace(auths, hasAdminAccess),
+					User:      userName,
+				},
+			},
+		},
+		Users: []types.KubeConfigUser{
+			{
+				User: kubeConfigUserToken(token),
+				Name: userName},
+		},
+	}
+
+	if len(utils.Config.NamespaceClusters) == 0 {
+		return config
+	}
+
+	// Sorted for a stable output
+	names := make([]string, 0, len(utils.Config.Clusters))
+	for name := range utils.Config.Clusters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		config.Clusters = append(config.Clusters, types.KubeConfigCluster{
+			Name: name,
+			Cluster: types.KubeConfigClusterData{
+				Server:          utils.Config.Clusters[name],
+				CertificateData: utils.Config.ClusterCas[name],
+			},
+		})
+	}
+
+	for _, auth := range auths {
+		cluster := namespaceCluster(auth.Namespace)
+		config.Contexts = append(config.Contexts, types.KubeConfigContext{
+			Name: cluster + "-" + auth.Namespace + "-" + userName,
+			Context: types.KubeConfigContextData{
+				Cluster:   cluster,
+				Namespace: auth.Namespace,
+				User:      userName,
+			},
+		})
+	}
+	return config
+}
+
+// Add a context impersonating the requested user and groups, with its
+// own user entry holding the same credentials. Only admins may impersonate
+func withImpersonation(config *types.KubeConfig, auth types.Auth, claims *types.AuthJWTClaims) error {
+	if len(auth.ImpersonateUser) == 0 {
+		return nil
+	}
+	if !claims.AdminAccess {
+		return errors.Wrapf(ErrImpersonationDenied, "%s asked to impersonate %s", utils.RedactUser(auth.Username), auth.ImpersonateUser)
+	}
+	if err := allowedImpersonation(auth.ImpersonateUser, auth.ImpersonateGroups); err != nil {
+		return errors.Wrapf(err, "%s asked to impersonate %s", utils.RedactUser(auth.Username), auth.ImpersonateUser)
+	}
+
+	name := kubeConfigName(auth.Username + "-as-" + auth.ImpersonateUser)
+	user := config.Users[0]
+	user.Name = name
+	user.User.As = auth.ImpersonateUser
+	user.User.AsGroups = auth.ImpersonateGroups
+	config.Users = append(config.Users, user)
+	config.Contexts = append(config.Contexts, types.KubeConfigContext{
+		Name: defaultClusterName + "-" + name,
+		Context: types.KubeConfigContextData{
+			Cluster: defaultClusterName,
+			User:    name,
+		},
+	})
+	return nil
+}
+
+// Keep only a cluster, its contexts and their users. A cluster where the
+// user has no context is reported unknown, as it is not granted
+func withSingleCluster(config *types.KubeConfig, cluster string) error {
+	if len(cluster) == 0 {
+		return nil
+	}
+
+	contexts := []types.KubeConfigContext{}
+	users := map[string]bool{}
+	for _, context := range config.Contexts {
+		if context.Context.Cluster == cluster {
+			contexts = append(contexts, context)
+			users[context.Context.User] = true
+		}
+	}
+	if len(contexts) == 0 {
+		return errors.Wrapf(ErrClusterNotFound, "%s, no namespace granted on it", cluster)
+	}
+
+	clusters := []types.KubeConfigCluster{}
+	for _, entry := range config.Clusters {
+		if entry.Name == cluster {
+			clusters = append(clusters, entry)
+		}
+	}
+	kept := []types.KubeConfigUser{}
+	for _, user := range config.Users {
+		if users[user.Name] {
+			kept = append(kept, user)
+		}
+	}
+
+	config.Clusters, config.Contexts, config.Users = clusters, contexts, kept
+	if !hasContext(config, config.CurrentContext) {
+		config.CurrentContext = contexts[0].Name
+	}
+	return nil
+}
+
+func hasContext(config *types.KubeConfig, name string) bool {
+	for _, context := range config.Contexts {
+		if context.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Name of the kubeconfig user and contexts of a user. With
+// KUBECONFIG_NORMALIZE_NAMES, it is lowercased and the runs of characters other
+// than letters, digits, dots and dashes are replaced by a dash. Only the names
+// change, the token is still issued to the original username
+func kubeConfigName(username string) string {
+	if !utils.Config.KubeConfigNormalizeNames {
+		return username
+	}
+	name := strings.Trim(invalidNameChars.ReplaceAllString(strings.ToLower(username), "-"), "-")
+	if len(name) == 0 {
+		return username
+	}
+	return name
+}
+
+var invalidNameChars = regexp.MustCompile(`[^a-z0-9.-]+`)
+
+// User credentials, a tokenFile reference when KUBECONFIG_TOKEN_FILE
+// is set so the token is not stored in the kubeconfig
+func kubeConfigUserToken(token string) types.KubeConfigUserToken {
+	if len(utils.Config.KubeConfigTokenFile) > 0 {
+		return types.KubeConfigUserToken{TokenFile: utils.Config.KubeConfigTokenFile}
+	}
+	return types.KubeConfigUserToken{Token: token}
+}
+
+// Set the token of the users of a kubeconfig built before signing
+func withToken(config *types.KubeConfig, token string) {
+	for i := range config.Users {
+		if len(config.Users[i].User.TokenFile) == 0 {
+			config.Users[i].User.Token = token
+		}
+	}
+}
+
+// Namespace of the default context, ADMIN_DEFAULT_NAMESPACE for admins
+// and the first authorized namespace otherwise
+func defaultNamespace(auths []*types.AuthJWTTupple, hasAdminAccess bool) string {
+	if hasAdminAccess && len(utils.Config.AdminDefaultNamespace) > 0 {
+		return utils.Config.AdminDefaultNamespace
+	}
+	if len(auths) > 0 {
+		return auths[0].Namespace
+	}
+	return ""
+}
+
+// Cluster hosting a namespace, the default cluster if not mapped
+// or mapped to an unknown cluster
+func namespaceCluster(namespace string) string {
+	cluster, ok := utils.Config.NamespaceClusters[namespace]
+	if !ok {
+		return defaultClusterName
+	}
+	if _, known := utils.Config.Clusters[cluster]; !known {
+		utils.Log.Warn().Msgf("Namespace %v is mapped to unknown cluster %v", namespace, cluster)
+		return defaultClusterName
+	}
+	return cluster
+}
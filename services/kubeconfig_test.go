@@ -0,0 +1,307 @@
+package services
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"github.com/ca-gip/kubi/types"
+	"github.com/ca-gip/kubi/utils"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewKubeConfig(t *testing.T) {
+	auths := []*types.AuthJWTTupple{
+		{Namespace: "demo", Role: "admin"},
+		{Namespace: "other", Role: "admin"},
+	}
+
+	t.Run("without mapping all namespaces are on the single cluster", func(t *testing.T) {
+		withConfig(t, &types.Config{KubeConfigCa: "ca"})
+
+		result := newKubeConfig("https://kubi", "alice", "token", auths, false)
+
+		assert.Len(t, result.Clusters, 1)
+		assert.Len(t, result.Contexts, 1)
+		assert.Equal(t, "kubernetes", result.Contexts[0].Context.Cluster)
+		assert.Equal(t, "kubernetes-alice", result.CurrentContext)
+	})
+
+	t.Run("with a namespace mapped to cluster b", func(t *testing.T) {
+		withConfig(t, &types.Config{
+			KubeConfigCa:      "ca",
+			Clusters:          map[string]string{"b": "https://cluster-b"},
+			NamespaceClusters: map[string]string{"demo": "b"},
+		})
+
+		result := newKubeConfig("https://kubi", "alice", "token", auths, false)
+
+		assert.Len(t, result.Clusters, 2)
+		assert.Equal(t, "https://cluster-b", result.Clusters[1].Cluster.Server)
+		assert.Len(t, result.Contexts, 3)
+		assert.Equal(t, "b-demo-alice", result.Contexts[1].Name)
+		assert.Equal(t, "b", result.Contexts[1].Context.Cluster)
+		assert.Equal(t, "demo", result.Contexts[1].Context.Namespace)
+		assert.Equal(t, "kubernetes", result.Contexts[2].Context.Cluster)
+		assert.Equal(t, "other", result.Contexts[2].Context.Namespace)
+	})
+
+	t.Run("each cluster embeds its own ca", func(t *testing.T) {
+		withConfig(t, &types.Config{
+			KubeConfigCa:      "ca",
+			Clusters:          map[string]string{"b": "https://cluster-b", "c": "https://cluster-c"},
+			ClusterCas:        map[string]string{"b": "ca-b", "c": "ca-c"},
+			NamespaceClusters: map[string]string{"demo": "b", "other": "c"},
+		})
+
+		result := newKubeConfig("https://kubi", "alice", "token", auths, false)
+
+		assert.Len(t, result.Clusters, 3)
+		assert.Equal(t, "ca", result.Clusters[0].Cluster.CertificateData)
+		assert.Equal(t, "ca-b", result.Clusters[1].Cluster.CertificateData)
+		assert.Equal(t, "ca-c", result.Clusters[2].Cluster.CertificateData)
+	})
+
+	t.Run("a cluster without ca does not embed the kubi ca", func(t *testing.T) {
+		withConfig(t, &types.Config{
+			KubeConfigCa:      "ca",
+			Clusters:          map[string]string{"b": "https://cluster-b"},
+			NamespaceClusters: map[string]string{"demo": "b"},
+		})
+
+		result := newKubeConfig("https://kubi", "alice", "token", auths, false)
+		encoded, _ := json.Marshal(result.Clusters[1])
+
+		assert.Empty(t, result.Clusters[1].Cluster.CertificateData)
+		assert.NotContains(t, string(encoded), "certificate-authority-data")
+	})
+
+	t.Run("with a namespace mapped to an unknown cluster", func(t *testing.T) {
+		withConfig(t, &types.Config{
+			KubeConfigCa:      "ca",
+			NamespaceClusters: map[string]string{"demo": "unknown"},
+		})
+
+		result := newKubeConfig("https://kubi", "alice", "token", auths, false)
+
+		assert.Equal(t, "kubernetes", result.Contexts[1].Context.Cluster)
+	})
+}
+
+func TestNewKubeConfigCa(t *testing.T) {
+	withConfig(t, &types.Config{
+		KubeCa:             "internal-ca",
+		KubeConfigCa:       "ingress-ca",
+		ApiServerTLSConfig: tls.Config{ServerName: "kubernetes"},
+	})
+
+	result := newKubeConfig("https://kubi", "alice", "token", nil, false)
+
+	assert.Equal(t, "ingress-ca", result.Clusters[0].Cluster.CertificateData)
+	assert.Equal(t, "internal-ca", utils.Config.KubeCa)
+	assert.Equal(t, "kubernetes", utils.Config.ApiServerTLSConfig.ServerName)
+}
+
+func TestNewKubeConfigDefaultNamespace(t *testing.T) {
+	auths := []*types.AuthJWTTupple{
+		{Namespace: "demo", Role: "admin"},
+		{Namespace: "other", Role: "admin"},
+	}
+	withConfig(t, &types.Config{AdminDefaultNamespace: "kube-system"})
+
+	t.Run("an admin context use the admin default namespace", func(t *testing.T) {
+		result := newKubeConfig("https://kubi", "alice", "token", auths, true)
+
+		assert.Equal(t, "kube-system", result.Contexts[0].Context.Namespace)
+	})
+
+	t.Run("a regular user context use its first namespace", func(t *testing.T) {
+		result := newKubeConfig("https://kubi", "bob", "token", auths, false)
+
+		assert.Equal(t, "demo", result.Contexts[0].Context.Namespace)
+	})
+
+	t.Run("a user without namespace has no default namespace", func(t *testing.T) {
+		result := newKubeConfig("https://kubi", "bob", "token", nil, false)
+
+		assert.Empty(t, result.Contexts[0].Context.Namespace)
+	})
+}
+
+func TestNewKubeConfigTokenFile(t *testing.T) {
+
+	t.Run("by default the token is inline", func(t *testing.T) {
+		withConfig(t, &types.Config{})
+
+		result := newKubeConfig("https://kubi", "alice", "a-token", nil, false)
+
+		assert.Equal(t, "a-token", result.Users[0].User.Token)
+		assert.Empty(t, result.Users[0].User.TokenFile)
+	})
+
+	t.Run("in token file mode there is no inline token", func(t *testing.T) {
+		withConfig(t, &types.Config{KubeConfigTokenFile: "kubi-token"})
+
+		result := newKubeConfig("https://kubi", "alice", "a-token", nil, false)
+		yml, err := yaml.Marshal(result)
+
+		assert.Nil(t, err)
+		assert.Equal(t, "kubi-token", result.Users[0].User.TokenFile)
+		assert.Empty(t, result.Users[0].User.Token)
+		assert.Contains(t, string(yml), "tokenFile: kubi-token")
+		assert.NotContains(t, string(yml), "a-token")
+	})
+}
+
+func TestWithImpersonation(t *testing.T) {
+	withConfig(t, &types.Config{KubeConfigCa: "a-ca", ImpersonateAllowedGroups: []string{"team-a"}})
+	auth := types.Auth{Username: "admin", ImpersonateUser: "alice", ImpersonateGroups: []string{"team-a"}}
+
+	t.Run("a non admin cannot impersonate", func(t *testing.T) {
+		config := newKubeConfig("https://kubi", "demo", "a-token", nil, false)
+
+		err := withImpersonation(config, auth, &types.AuthJWTClaims{})
+		recorder := httptest.NewRecorder()
+		writeTokenError(recorder, err)
+
+		assert.Equal(t, ErrImpersonationDenied, errors.Cause(err))
+		assert.Equal(t, http.StatusForbidden, recorder.Code)
+	})
+
+	t.Run("an admin get an impersonating context", func(t *testing.T) {
+		config := newKubeConfig("https://kubi", "admin", "a-token", nil, true)
+
+		err := withImpersonation(config, auth, &types.AuthJWTClaims{AdminAccess: true})
+		assert.Nil(t, err)
+
+		yml, err := yaml.Marshal(config)
+		assert.Nil(t, err)
+		assert.Contains(t, string(yml), "as: alice")
+		assert.Equal(t, []string{"team-a"}, config.Users[1].User.AsGroups)
+		assert.Equal(t, "kubernetes-admin", config.CurrentContext)
+		assert.Equal(t, "admin-as-alice", config.Contexts[1].Context.User)
+		assert.Equal(t, "a-token", config.Users[1].User.Token)
+	})
+
+	t.Run("an admin cannot impersonate system:masters", func(t *testing.T) {
+		config := newKubeConfig("https://kubi", "admin", "a-token", nil, true)
+		masters := types.Auth{Username: "admin", ImpersonateUser: "alice", ImpersonateGroups: []string{"system:masters"}}
+
+		err := withImpersonation(config, masters, &types.AuthJWTClaims{AdminAccess: true})
+		recorder := httptest.NewRecorder()
+		writeTokenError(recorder, err)
+
+		assert.Equal(t, ErrImpersonationRefused, errors.Cause(err))
+		assert.Equal(t, http.StatusForbidden, recorder.Code)
+		assert.Len(t, config.Contexts, 1)
+	})
+}
+
+func TestWithSingleCluster(t *testing.T) {
+	withConfig(t, &types.Config{
+		KubeConfigCa:      "ca",
+		Clusters:          map[string]string{"b": "https://cluster-b", "c": "https://cluster-c"},
+		NamespaceClusters: map[string]string{"demo": "b"},
+	})
+	auths := []*types.AuthJWTTupple{
+		{Namespace: "demo", Role: "admin"},
+		{Namespace: "other", Role: "admin"},
+	}
+
+	t.Run("all clusters are kept without selection", func(t *testing.T) {
+		config := newKubeConfig("https://kubi", "alice", "token", auths, false)
+
+		assert.Nil(t, withSingleCluster(config, ""))
+		assert.Len(t, config.Clusters, 3)
+		assert.Len(t, config.Contexts, 3)
+	})
+
+	t.Run("a selected cluster is the only one left", func(t *testing.T) {
+		config := newKubeConfig("https://kubi", "alice", "token", auths, false)
+
+		assert.Nil(t, withSingleCluster(config, "b"))
+		assert.Len(t, config.Clusters, 1)
+		assert.Equal(t, "https://cluster-b", config.Clusters[0].Cluster.Server)
+		assert.Len(t, config.Contexts, 1)
+		assert.Equal(t, "b-demo-alice", config.Contexts[0].Name)
+		assert.Equal(t, "b-demo-alice", config.CurrentContext)
+		assert.Len(t, config.Users, 1)
+	})
+
+	t.Run("a cluster without granted namespace is not found", func(t *testing.T) {
+		config := newKubeConfig("https://kubi", "alice", "token", auths, false)
+
+		err := withSingleCluster(config, "c")
+		recorder := httptest.NewRecorder()
+		writeTokenError(recorder, err)
+
+		assert.Equal(t, ErrClusterNotFound, errors.Cause(err))
+		assert.Equal(t, http.StatusNotFound, recorder.Code)
+	})
+}
+
+func TestRequestConfigCluster(t *testing.T) {
+	withConfig(t, &types.Config{Clusters: map[string]string{"b": "https://cluster-b"}})
+	request := func(query string) (string, error) {
+		return requestConfigCluster(httptest.NewRequest(http.MethodGet, "/config"+query, nil))
+	}
+
+	t.Run("a configured cluster is selected", func(t *testing.T) {
+		name, err := request("?cluster=b")
+
+		assert.Nil(t, err)
+		assert.Equal(t, "b", name)
+	})
+
+	t.Run("an unknown cluster name is rejected", func(t *testing.T) {
+		_, err := request("?cluster=nope")
+
+		assert.Equal(t, ErrClusterNotFound, errors.Cause(err))
+	})
+
+	t.Run("all clusters without parameter", func(t *testing.T) {
+		name, err := request("")
+
+		assert.Nil(t, err)
+		assert.Empty(t, name)
+	})
+}
+
+func TestKubeConfigNormalizeNames(t *testing.T) {
+	auths := []*types.AuthJWTTupple{{Namespace: "demo", Role: "admin"}}
+	username := "Alice Smith@corp"
+
+	t.Run("names are the username by default", func(t *testing.T) {
+		withConfig(t, &types.Config{})
+
+		result := newKubeConfig("https://kubi", username, "a-token", auths, false)
+
+		assert.Equal(t, "kubernetes-Alice Smith@corp", result.CurrentContext)
+		assert.Equal(t, username, result.Users[0].Name)
+	})
+
+	t.Run("normalized names are lowercase with safe characters", func(t *testing.T) {
+		withConfig(t, &types.Config{KubeConfigNormalizeNames: true})
+
+		result := newKubeConfig("https://kubi", username, "a-token", auths, false)
+
+		assert.Equal(t, "kubernetes-alice-smith-corp", result.CurrentContext)
+		assert.Equal(t, "kubernetes-alice-smith-corp", result.Contexts[0].Name)
+		assert.Equal(t, "alice-smith-corp", result.Contexts[0].Context.User)
+		assert.Equal(t, "alice-smith-corp", result.Users[0].Name)
+		assert.Equal(t, "a-token", result.Users[0].User.Token)
+	})
+
+	t.Run("the impersonating user is normalized too", func(t *testing.T) {
+		withConfig(t, &types.Config{KubeConfigNormalizeNames: true})
+		auth := types.Auth{Username: username, ImpersonateUser: "Bob"}
+		config := newKubeConfig("https://kubi", username, "a-token", nil, true)
+
+		assert.Nil(t, withImpersonation(config, auth, &types.AuthJWTClaims{AdminAccess: true}))
+		assert.Equal(t, "alice-smith-corp-as-bob", config.Users[1].Name)
+		assert.Equal(t, "Bob", config.Users[1].User.As)
+	})
+}
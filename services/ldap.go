@@ -9,27 +9,79 @@ import (
 	"strings"
 )
 
-var DnsParser = regexp.MustCompile("(?:.+_+)*(?P<namespace>.+)_(?P<role>.+)$")
-
 // Get Namespace, Role for a list of group name
+// Namespaces are lowercased, with NAMESPACE_DEDUPE groups differing
+// only by case give a single namespace. When their roles differ, the
+// most privileged by ROLE_PRIVILEGE_ORDER is kept
 func GetUserNamespaces(groups []string) []*types.AuthJWTTupple {
 	res := make([]*types.AuthJWTTupple, 0)
+	positions := map[string]int{}
 	for _, groupname := range groups {
 		tupple, err := GetUserNamespace(groupname)
-		if err == nil {
-			res = append(res, tupple)
-		} else {
-			utils.Log.Error().Msg(err.Error())
+		if err != nil {
+			utils.Log.Warn().Msg(err.Error())
+			continue
+		}
+		if utils.Config != nil && utils.Config.NamespaceDedupe {
+			if position, seen := positions[tupple.Namespace]; seen {
+				kept := res[position]
+				order := utils.Config.RolePrivilegeOrder
+				if rolePrivilege(tupple.Role, order) < rolePrivilege(kept.Role, order) {
+					kept, res[position] = tupple, tupple
+				}
+				utils.Log.Info().Msgf("LDAP: The ldap group %v is a duplicate of namespace %v, role %v is kept", groupname, tupple.Namespace, kept.Role)
+				continue
+			}
+			positions[tupple.Namespace] = len(res)
 		}
+		res = append(res, tupple)
 	}
 	return res
 }
 
+// Rank of a role in the ROLE_PRIVILEGE_ORDER list, most privileged first.
+// Unlisted roles rank last
+func rolePrivilege(role string, order []string) int {
+	if index := utils.Index(order, role); index >= 0 {
+		return index
+	}
+	return len(order)
+}
+
+// Keep a single role by namespace, the most privileged one by the
+// ROLE_PRIVILEGE_ORDER list, most privileged first. Unlisted roles rank last
+// and the first one found is kept among roles of the same rank.
+// Only tokens are merged, the resources of every group are still generated
+func mergeRoles(tupples []*types.AuthJWTTupple, order []string) []*types.AuthJWTTupple {
+	merged := make([]*types.AuthJWTTupple, 0, len(tupples))
+	positions := map[string]int{}
+	for _, tupple := range tupples {
+		position, seen := positions[tupple.Namespace]
+		if !seen {
+			positions[tupple.Namespace] = len(merged)
+			merged = append(merged, tupple)
+			continue
+		}
+		kept := merged[position]
+		if rolePrivilege(tupple.Role, order) < rolePrivilege(kept.Role, order) {
+			kept, merged[position] = tupple, tupple
+		}
+		utils.Log.Info().Msgf("LDAP: Several roles for namespace %v, %v is kept", tupple.Namespace, kept.Role)
+	}
+	return merged
+}
+
 // Get Namespace, Role for a group name
+// A group of the GROUP_NAMESPACE_MAP_FILE mapping is not parsed
 func GetUserNamespace(group string) (*types.AuthJWTTupple, error) {
 
+	if tupple, ok := groupMappings.Lookup(group); ok {
+		return tupple, nil
+	}
+
 	lowerGroup := strings.ToLower(group)
-	keys := DnsParser.SubexpNames()
+	parser := groupParsers.Get()
+	keys := parser.SubexpNames()
 	if len(keys) < 3 {
 		return nil, errors.New(fmt.Sprintf(`
 			LDAP: The ldap group parser doesn't have the two mandatory key: namespace and role,
@@ -37,7 +89,7 @@ func GetUserNamespace(group string) (*types.AuthJWTTupple, error) {
 			 `, keys))
 	}
 
-	countSplits := len(DnsParser.FindStringSubmatch(lowerGroup))
+	countSplits := len(parser.FindStringSubmatch(lowerGroup))
 
 	if countSplits != 3 {
 		return nil, errors.New(fmt.Sprintf(`
@@ -46,8 +98,12 @@ func GetUserNamespace(group string) (*types.AuthJWTTupple, error) {
 	}
 
 	//lowerGroup = strings.TrimPrefix(lowerGroup, )
-	namespace, role := DnsParser.ReplaceAllString(lowerGroup, "${namespace}"), DnsParser.ReplaceAllString(lowerGroup, "${role}")
+	namespace, role := parser.ReplaceAllString(lowerGroup, "${namespace}"), parser.ReplaceAllString(lowerGroup, "${role}")
+	return newTupple(group, namespace, role)
+}
 
+// Validate the namespace and role of a group
+func newTupple(group string, namespace string, role string) (*types.AuthJWTTupple, error) {
 	isNamespaceValid, _ := regexp.MatchString(utils.Dns1123LabelFmt, namespace)
 	isRoleValid, _ := regexp.MatchString(utils.Dns1123LabelFmt, role)
 
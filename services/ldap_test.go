@@ -1,9 +1,12 @@
 package services_test
 
 import (
+	"bytes"
 	"github.com/ca-gip/kubi/services"
+	"github.com/ca-gip/kubi/types"
+	"github.com/ca-gip/kubi/utils"
+	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
-	"regexp"
 	"testing"
 )
 
@@ -148,10 +151,11 @@ func TestGetUserNamespace(t *testing.T) {
 	})
 
 	t.Run("invalid regexp", func(t *testing.T) {
-		goodRegexp := services.DnsParser
-		services.DnsParser = regexp.MustCompile("(?:.+_+)*_(?P<role>.*)$")
+		goodRegexp := services.DnsParser().String()
+		assert.NotNil(t, services.SetGroupParser("(?:.+_+)*_(?P<role>.*)$"))
 		result, error := services.GetUserNamespace("")
-		services.DnsParser = goodRegexp
+		assert.Nil(t, services.SetGroupParser(goodRegexp))
+		assert.Equal(t, goodRegexp, services.DnsParser().String())
 		assert.NotNil(t, error)
 		assert.Nil(t, result)
 
@@ -195,4 +199,76 @@ func TestGetUserNamespaces(t *testing.T) {
 
 	})
 
+	t.Run("with case insensitive deduplication", func(t *testing.T) {
+		services.WithConfig(t, &types.Config{NamespaceDedupe: true})
+
+		result := services.GetUserNamespaces([]string{
+			"valid_TEAM-A_admin",
+			"valid_team-a_ADMIN",
+			"valid_Team-B_admin",
+			"valid_team_b_admin_",
+		})
+		assert.Len(t, result, 2)
+		assert.Equal(t, "team-a", result[0].Namespace)
+		assert.Equal(t, "team-b", result[1].Namespace)
+
+	})
+
+	t.Run("with deduplication of a namespace with several roles", func(t *testing.T) {
+		services.WithConfig(t, &types.Config{NamespaceDedupe: true, RolePrivilegeOrder: []string{"admin", "edit", "viewer"}})
+
+		result := services.GetUserNamespaces([]string{
+			"valid_Team-A_viewer",
+			"valid_team-a_ADMIN",
+			"valid_TEAM-A_edit",
+		})
+		assert.Len(t, result, 1)
+		assert.Equal(t, "team-a", result[0].Namespace)
+		assert.Equal(t, "admin", result[0].Role)
+
+	})
+
+	t.Run("an invalid namespace is dropped with a warning", func(t *testing.T) {
+		var output bytes.Buffer
+		defaultLog := utils.Log
+		utils.Log = zerolog.New(&output)
+		defer func() { utils.Log = defaultLog }()
+
+		result := services.GetUserNamespaces([]string{
+			"valid_team.a_admin",
+			"valid_team-b_admin",
+		})
+		assert.Len(t, result, 1)
+		assert.Equal(t, "team-b", result[0].Namespace)
+		assert.Contains(t, output.String(), `"level":"warn"`)
+		assert.Contains(t, output.String(), "The namespace team.a is not dns1123 compliant")
+
+	})
+
+	t.Run("without deduplication", func(t *testing.T) {
+		services.WithConfig(t, &types.Config{NamespaceDedupe: false})
+
+		result := services.GetUserNamespaces([]string{
+			"valid_TEAM-A_admin",
+			"valid_team-a_ADMIN",
+		})
+		assert.Len(t, result, 2)
+		assert.Equal(t, "team-a", result[0].Namespace)
+		assert.Equal(t, "team-a", result[1].Namespace)
+
+	})
+
+	t.Run("with several roles on a namespace", func(t *testing.T) {
+		services.WithConfig(t, &types.Config{RolePrivilegeOrder: []string{"admin", "edit", "viewer"}})
+
+		// The resources of every group are generated, roles are only merged in tokens
+		result := services.GetUserNamespaces([]string{
+			"valid_team-a_viewer",
+			"valid_team-b_edit",
+			"valid_team-a_admin",
+		})
+		assert.Len(t, result, 3)
+
+	})
+
 }
@@ -0,0 +1,171 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/ca-gip/kubi/types"
+	"github.com/ca-gip/kubi/utils"
+	"github.com/fsnotify/fsnotify"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Group to namespace and role mapping, read from GROUP_NAMESPACE_MAP_FILE
+// The file is re-read when it changes, a malformed file keeps the last good mapping
+type groupMapping struct {
+	sync.RWMutex
+	path    string
+	raw     []byte
+	entries map[string]*types.AuthJWTTupple
+}
+
+var groupMappings = &groupMapping{}
+
+// Parse a mapping file, one "group,namespace,role" by line
+// Blank lines and lines starting with # are ignored
+func parseGroupMapping(data []byte) (map[string]*types.AuthJWTTupple, error) {
+	entries := map[string]*types.AuthJWTTupple{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := utils.Map(strings.Split(line, ","), strings.TrimSpace)
+		if len(fields) != 3 || utils.IsEmpty(fields[0]) {
+			return nil, fmt.Errorf("line %d: expected group,namespace,role", number)
+		}
+		tupple, err := newTupple(fields[0], strings.ToLower(fields[1]), strings.ToLower(fields[2]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", number, strings.TrimSpace(err.Error()))
+		}
+		entries[strings.ToLower(fields[0])] = tupple
+	}
+	return entries, scanner.Err()
+}
+
+// Read the mapping file again, the mapping is only replaced
+// when the content changed and is valid
+func (m *groupMapping) Load() error {
+	raw, err := ioutil.ReadFile(m.path)
+	if err != nil {
+		return err
+	}
+
+	m.RLock()
+	unchanged := m.raw != nil && bytes.Equal(raw, m.raw)
+	m.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	entries, err := parseGroupMapping(raw)
+	m.Lock()
+	defer m.Unlock()
+	m.raw = raw
+	if err != nil {
+		return err
+	}
+	m.entries = entries
+	utils.Log.Info().Msgf("Group mapping loaded from %s, %d groups", m.path, len(entries))
+	return nil
+}
+
+// Namespace and role of a mapped group
+func (m *groupMapping) Lookup(group string) (*types.AuthJWTTupple, bool) {
+	m.RLock()
+	defer m.RUnlock()
+	tupple, ok := m.entries[strings.ToLower(group)]
+	return tupple, ok
+}
+
+// WatchGroupMapping load the mapping file, then re-read it when fsnotify
+// reports a change and at each interval, for the changes fsnotify misses
+// A zero interval means a reload on fsnotify events only
+func WatchGroupMapping(path string, interval time.Duration) {
+	watchGroupMapping(path, interval, nil)
+}
+
+// Watch the mapping file until stop is closed, a nil stop watches forever
+func watchGroupMapping(path string, interval time.Duration, stop <-chan struct{}) {
+	groupMappings.path = path
+	if err := groupMappings.Load(); err != nil {
+		utils.Log.Error().Msgf("Cannot load the group mapping %s: %v", path, err)
+	}
+
+	changes := watchDirectory(path, stop)
+	var ticks <-chan time.Time
+	var ticker *time.Ticker
+	if interval > 0 {
+		ticker = time.NewTicker(interval)
+		ticks = ticker.C
+	} else if changes == nil {
+		utils.Log.Warn().Msgf("The group mapping %s is not watched nor re-read periodically, it will not be reloaded", path)
+		return
+	}
+
+	go func() {
+		if ticker != nil {
+			defer ticker.Stop()
+		}
+		for {
+			select {
+			case <-changes:
+			case <-ticks:
+			case <-stop:
+				return
+			}
+			if err := groupMappings.Load(); err != nil {
+				utils.Log.Error().Msgf("Cannot reload the group mapping %s, keeping the last good one: %v", path, err)
+			}
+		}
+	}()
+}
+
+// Changes in the directory of a file, until stop is closed. The directory
+// is watched as a mounted ConfigMap is updated by swapping a symlink next
+// to the file. Nil when fsnotify cannot watch it
+func watchDirectory(path string, stop <-chan struct{}) <-chan struct{} {
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		err = watcher.Add(filepath.Dir(path))
+	}
+	if err != nil {
+		utils.Log.Warn().Msgf("Cannot watch %s, falling back to periodic re-reads: %v", path, err)
+		if watcher != nil {
+			watcher.Close()
+		}
+		return nil
+	}
+
+	changes := make(chan struct{}, 1)
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case _, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				// Changes during a reload are coalesced in a single one
+				select {
+				case changes <- struct{}{}:
+				default:
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				utils.Log.Warn().Msgf("Error watching %s: %v", path, err)
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return changes
+}
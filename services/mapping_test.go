@@ -0,0 +1,117 @@
+package services
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseGroupMapping(t *testing.T) {
+
+	t.Run("comments, blank lines and whitespace are ignored", func(t *testing.T) {
+		result, err := parseGroupMapping([]byte(`
+# platform teams
+  CN-Platform-Admins , platform , admin
+
+	cn-platform-readers,platform,viewer
+`))
+
+		assert.Nil(t, err)
+		assert.Len(t, result, 2)
+		assert.Equal(t, "platform", result["cn-platform-admins"].Namespace)
+		assert.Equal(t, "admin", result["cn-platform-admins"].Role)
+		assert.Equal(t, "viewer", result["cn-platform-readers"].Role)
+	})
+
+	t.Run("a line without a role is malformed", func(t *testing.T) {
+		_, err := parseGroupMapping([]byte("cn-platform-admins,platform\n"))
+
+		assert.NotNil(t, err)
+	})
+
+	t.Run("a protected namespace is malformed", func(t *testing.T) {
+		_, err := parseGroupMapping([]byte("cn-system,kube-system,admin\n"))
+
+		assert.NotNil(t, err)
+	})
+}
+
+func TestGroupMappingReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubi-mapping")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "mapping")
+	mapping := &groupMapping{path: path}
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte("cn-platform-admins,platform,admin\n"), 0600))
+	assert.Nil(t, mapping.Load())
+
+	t.Run("the mapping is loaded", func(t *testing.T) {
+		result, ok := mapping.Lookup("CN-Platform-Admins")
+
+		assert.True(t, ok)
+		assert.Equal(t, "platform", result.Namespace)
+	})
+
+	t.Run("a changed file is reloaded", func(t *testing.T) {
+		assert.Nil(t, ioutil.WriteFile(path, []byte("cn-platform-admins,tooling,admin\n"), 0600))
+		assert.Nil(t, mapping.Load())
+
+		result, ok := mapping.Lookup("cn-platform-admins")
+		assert.True(t, ok)
+		assert.Equal(t, "tooling", result.Namespace)
+	})
+
+	t.Run("a malformed file keeps the last good mapping", func(t *testing.T) {
+		assert.Nil(t, ioutil.WriteFile(path, []byte("cn-platform-admins,tooling\n"), 0600))
+		assert.NotNil(t, mapping.Load())
+
+		result, ok := mapping.Lookup("cn-platform-admins")
+		assert.True(t, ok)
+		assert.Equal(t, "tooling", result.Namespace)
+	})
+}
+
+func TestWatchGroupMapping(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubi-mapping")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mapping")
+	assert.Nil(t, ioutil.WriteFile(path, []byte("cn-platform-admins,platform,admin\n"), 0600))
+
+	defaultMappings := groupMappings
+	defer func() { groupMappings = defaultMappings }()
+	namespace := func() string {
+		if result, ok := groupMappings.Lookup("cn-platform-admins"); ok {
+			return result.Namespace
+		}
+		return ""
+	}
+
+	t.Run("a change is reloaded without periodic re-reads", func(t *testing.T) {
+		groupMappings = &groupMapping{}
+		stop := make(chan struct{})
+		defer close(stop)
+
+		watchGroupMapping(path, 0, stop)
+		assert.Equal(t, "platform", namespace())
+
+		assert.Nil(t, ioutil.WriteFile(path, []byte("cn-platform-admins,tooling,admin\n"), 0600))
+		reloaded := false
+		for deadline := time.Now().Add(5 * time.Second); !reloaded && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			reloaded = namespace() == "tooling"
+		}
+		assert.True(t, reloaded)
+	})
+
+	t.Run("a file in a missing directory is not watched", func(t *testing.T) {
+		stop := make(chan struct{})
+		defer close(stop)
+
+		assert.Nil(t, watchDirectory(filepath.Join(dir, "missing", "mapping"), stop))
+	})
+}
@@ -0,0 +1,50 @@
+package services
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrTokenReplayed = errors.New("single use token presented again")
+
+// Interval between two prunes of the used nonces
+const noncePruneInterval = time.Minute
+
+// Nonces of the single use tokens already verified, by nonce
+// Entries are kept until the token expiry, then pruned
+type usedNonces struct {
+	sync.Mutex
+	entries    map[string]time.Time
+	lastPruned time.Time
+	now        func() time.Time
+}
+
+var nonces = &usedNonces{entries: map[string]time.Time{}, now: time.Now}
+
+// Mark a nonce used, return false if it already was
+func (n *usedNonces) Use(nonce string, expiresAt int64) bool {
+	n.Lock()
+	defer n.Unlock()
+	now := n.now()
+	n.prune(now)
+
+	if _, used := n.entries[nonce]; used {
+		return false
+	}
+	n.entries[nonce] = time.Unix(expiresAt, 0)
+	return true
+}
+
+// Drop the nonces of expired tokens, at most once per interval
+func (n *usedNonces) prune(now time.Time) {
+	if now.Sub(n.lastPruned) < noncePruneInterval {
+		return
+	}
+	for nonce, expiresAt := range n.entries {
+		if now.After(expiresAt) {
+			delete(n.entries, nonce)
+		}
+	}
+	n.lastPruned = now
+}
@@ -0,0 +1,114 @@
+package services
+
+import (
+	"fmt"
+	"github.com/ca-gip/kubi/utils"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Default regex parsing the namespace and role of a group name
+const defaultGroupParser = "(?:.+_+)*(?P<namespace>.+)_(?P<role>.+)$"
+
+// Regex parsing the namespace and role of the group names,
+// swapped by the group parser, read it with DnsParser
+var dnsParser atomic.Value
+
+func init() {
+	dnsParser.Store(regexp.MustCompile(defaultGroupParser))
+}
+
+// DnsParser is the current regex parsing the namespace and role of the group names
+func DnsParser() *regexp.Regexp {
+	return dnsParser.Load().(*regexp.Regexp)
+}
+
+// Reloads of the regex from GROUP_PARSER_FILE when set
+// A reload swaps it, an invalid regex keeps the last good one
+type groupParser struct {
+	sync.Mutex
+	path string
+}
+
+var groupParsers = &groupParser{}
+
+// Current regex, a parse uses the same one from start to end
+func (p *groupParser) Get() *regexp.Regexp {
+	return DnsParser()
+}
+
+// Compile and swap the regex, it must name a namespace and a role group
+func (p *groupParser) Set(expression string) error {
+	parser, err := regexp.Compile(expression)
+	if err != nil {
+		return err
+	}
+	if !utils.Include(parser.SubexpNames(), "namespace") || !utils.Include(parser.SubexpNames(), "role") {
+		return fmt.Errorf("the regex must have the namespace and role named groups")
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	if parser.String() != DnsParser().String() {
+		dnsParser.Store(parser)
+		utils.Log.Info().Msgf("Group parser set to %s", expression)
+	}
+	return nil
+}
+
+// Read the regex file again
+func (p *groupParser) Load() error {
+	raw, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return err
+	}
+	return p.Set(strings.TrimSpace(string(raw)))
+}
+
+// WatchGroupParser load the regex file, then read it again
+// at each interval and when kubi receives a SIGHUP
+// A zero interval means a reload on SIGHUP only
+func WatchGroupParser(path string, interval time.Duration) {
+	watchGroupParser(path, interval, nil)
+}
+
+// Watch the regex file until stop is closed, a nil stop watches forever
+func watchGroupParser(path string, interval time.Duration, stop <-chan struct{}) {
+	groupParsers.path = path
+	if err := groupParsers.Load(); err != nil {
+		utils.Log.Error().Msgf("Cannot load the group parser %s, using the default one: %v", path, err)
+	}
+
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	var ticks <-chan time.Time
+	var ticker *time.Ticker
+	if interval > 0 {
+		ticker = time.NewTicker(interval)
+		ticks = ticker.C
+	}
+	go func() {
+		defer signal.Stop(hangups)
+		if ticker != nil {
+			defer ticker.Stop()
+		}
+		for {
+			select {
+			case <-ticks:
+			case <-hangups:
+			case <-stop:
+				return
+			}
+			if err := groupParsers.Load(); err != nil {
+				utils.Log.Error().Msgf("Cannot reload the group parser %s, keeping the last good one: %v", path, err)
+			}
+		}
+	}()
+}
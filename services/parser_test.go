@@ -0,0 +1,80 @@
+package services
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestGroupParser(t *testing.T) {
+	reset := func(path string) {
+		groupParsers = &groupParser{path: path}
+		groupParsers.Set(defaultGroupParser)
+	}
+	defer reset("")
+
+	t.Run("an invalid regexp keeps the previous parser", func(t *testing.T) {
+		reset("")
+
+		assert.NotNil(t, groupParsers.Set("(?:.+_+)*_(?P<role>.*)$"))
+		assert.NotNil(t, groupParsers.Set("(?P<namespace>.+_(?P<role>.+)$"))
+		assert.Equal(t, defaultGroupParser, groupParsers.Get().String())
+
+		result, err := GetUserNamespace("")
+		assert.NotNil(t, err)
+		assert.Nil(t, result)
+	})
+
+	t.Run("a reloaded parser is used", func(t *testing.T) {
+		file, err := ioutil.TempFile("", "parser")
+		assert.Nil(t, err)
+		defer os.Remove(file.Name())
+		file.WriteString("^team-(?P<namespace>.+)-(?P<role>[a-z]+)$\n")
+		file.Close()
+		reset(file.Name())
+
+		assert.Nil(t, groupParsers.Load())
+		result, err := GetUserNamespace("team-billing-admin")
+
+		assert.Nil(t, err)
+		assert.Equal(t, "billing", result.Namespace)
+		assert.Equal(t, "admin", result.Role)
+	})
+
+	t.Run("a zero interval loads the parser without periodic reloads", func(t *testing.T) {
+		file, err := ioutil.TempFile("", "parser")
+		assert.Nil(t, err)
+		defer os.Remove(file.Name())
+		file.WriteString("^team-(?P<namespace>.+)-(?P<role>[a-z]+)$\n")
+		file.Close()
+		reset("")
+
+		stop := make(chan struct{})
+		defer close(stop)
+		watchGroupParser(file.Name(), 0, stop)
+		assert.Equal(t, "^team-(?P<namespace>.+)-(?P<role>[a-z]+)$", groupParsers.Get().String())
+	})
+
+	t.Run("reloads are safe while groups are parsed", func(t *testing.T) {
+		reset("")
+		expressions := []string{defaultGroupParser, "(?:.+_+)*(?P<namespace>.+)_(?P<role>[a-z]+)$"}
+
+		var wait sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wait.Add(1)
+			go func() {
+				defer wait.Done()
+				for j := 0; j < 200; j++ {
+					result := GetUserNamespaces([]string{"valid_team-a_admin", "valid_team-b_edit"})
+					assert.Len(t, result, 2)
+				}
+			}()
+		}
+		for j := 0; j < 200; j++ {
+			assert.Nil(t, groupParsers.Set(expressions[j%2]))
+		}
+		wait.Wait()
+	})
+}
@@ -0,0 +1,79 @@
+package services
+
+import (
+	"github.com/ca-gip/kubi/types"
+	"github.com/ca-gip/kubi/utils"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sync"
+	"time"
+)
+
+// Namespaces granted by a group but missing from the cluster, by the time
+// they were first seen missing. They are kept in tokens for the
+// NAMESPACE_PENDING_GRACE, for the provisioning to catch up, then stripped
+type pendingNamespaces struct {
+	sync.Mutex
+	firstSeen map[string]time.Time
+	now       func() time.Time
+	exists    func(namespace string) (bool, error)
+}
+
+var pendings = &pendingNamespaces{firstSeen: map[string]time.Time{}, now: time.Now, exists: namespaceExists}
+
+// Check a namespace on the api server
+func namespaceExists(namespace string) (bool, error) {
+	clientSet, err := utils.KubeClient()
+	if err != nil {
+		return false, err
+	}
+	_, err = clientSet.CoreV1().Namespaces().Get(namespace, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Strip the namespaces missing for longer than the grace
+// A namespace that cannot be checked is kept. A zero grace means no check
+// The api server is called without the lock, other tokens are not delayed
+func (p *pendingNamespaces) Filter(auths []*types.AuthJWTTupple) []*types.AuthJWTTupple {
+	grace := utils.Config.NamespacePendingGrace
+	if grace <= 0 {
+		return auths
+	}
+
+	now := p.now()
+	kept := make([]*types.AuthJWTTupple, 0, len(auths))
+	for _, auth := range auths {
+		exists, err := p.exists(auth.Namespace)
+		if err != nil {
+			utils.Log.Warn().Msgf("Cannot check namespace %v, kept: %v", auth.Namespace, err)
+			kept = append(kept, auth)
+			continue
+		}
+		if !p.record(auth.Namespace, exists, now, grace) {
+			utils.Log.Info().Msgf("Namespace %v still missing after %v, stripped", auth.Namespace, grace)
+			continue
+		}
+		kept = append(kept, auth)
+	}
+	return kept
+}
+
+// Record whether a namespace exists, false once missing for longer than the grace
+func (p *pendingNamespaces) record(namespace string, exists bool, now time.Time, grace time.Duration) bool {
+	p.Lock()
+	defer p.Unlock()
+	if exists {
+		delete(p.firstSeen, namespace)
+		return true
+	}
+
+	firstSeen, ok := p.firstSeen[namespace]
+	if !ok {
+		firstSeen = now
+		p.firstSeen[namespace] = now
+	}
+	return now.Sub(firstSeen) <= grace
+}
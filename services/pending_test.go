@@ -0,0 +1,95 @@
+package services
+
+import (
+	"errors"
+	"github.com/ca-gip/kubi/types"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestPendingNamespaces(t *testing.T) {
+	withConfig(t, &types.Config{NamespacePendingGrace: 10 * time.Minute})
+	now := time.Date(2019, 3, 1, 10, 0, 0, 0, time.UTC)
+	existing := map[string]bool{"team-a": true}
+	pending := &pendingNamespaces{
+		firstSeen: map[string]time.Time{},
+		now:       func() time.Time { return now },
+		exists: func(namespace string) (bool, error) {
+			if namespace == "unreachable" {
+				return false, errors.New("api server unavailable")
+			}
+			return existing[namespace], nil
+		},
+	}
+	auths := []*types.AuthJWTTupple{
+		{Namespace: "team-a", Role: "admin"},
+		{Namespace: "team-b", Role: "admin"},
+	}
+	namespaces := func(auths []*types.AuthJWTTupple) []string {
+		result := []string{}
+		for _, auth := range auths {
+			result = append(result, auth.Namespace)
+		}
+		return result
+	}
+
+	t.Run("a newly mapped namespace is kept within the grace", func(t *testing.T) {
+		assert.Equal(t, []string{"team-a", "team-b"}, namespaces(pending.Filter(auths)))
+
+		now = now.Add(9 * time.Minute)
+		assert.Equal(t, []string{"team-a", "team-b"}, namespaces(pending.Filter(auths)))
+	})
+
+	t.Run("a namespace still missing after the grace is stripped", func(t *testing.T) {
+		now = now.Add(2 * time.Minute)
+		assert.Equal(t, []string{"team-a"}, namespaces(pending.Filter(auths)))
+	})
+
+	t.Run("a namespace provisioned later is kept", func(t *testing.T) {
+		existing["team-b"] = true
+		assert.Equal(t, []string{"team-a", "team-b"}, namespaces(pending.Filter(auths)))
+		assert.Empty(t, pending.firstSeen)
+	})
+
+	t.Run("a namespace that cannot be checked is kept", func(t *testing.T) {
+		now = now.Add(time.Hour)
+		unreachable := []*types.AuthJWTTupple{{Namespace: "unreachable", Role: "admin"}}
+		assert.Equal(t, []string{"unreachable"}, namespaces(pending.Filter(unreachable)))
+	})
+}
+
+func TestPendingNamespacesUnlockedCheck(t *testing.T) {
+	withConfig(t, &types.Config{NamespacePendingGrace: 10 * time.Minute})
+	started, release, finished := make(chan struct{}), make(chan struct{}), make(chan struct{})
+	pending := &pendingNamespaces{
+		firstSeen: map[string]time.Time{},
+		now:       time.Now,
+		exists: func(namespace string) (bool, error) {
+			if namespace == "slow" {
+				close(started)
+				<-release
+			}
+			return true, nil
+		},
+	}
+
+	go func() {
+		pending.Filter([]*types.AuthJWTTupple{{Namespace: "slow", Role: "admin"}})
+		close(finished)
+	}()
+	defer func() {
+		close(release)
+		<-finished
+	}()
+	<-started
+
+	done := make(chan []*types.AuthJWTTupple)
+	go func() { done <- pending.Filter([]*types.AuthJWTTupple{{Namespace: "team-a", Role: "admin"}}) }()
+	select {
+	case kept := <-done:
+		assert.Len(t, kept, 1)
+	case <-time.After(time.Second):
+		t.Fatal("a slow namespace check blocks the other tokens")
+	}
+}
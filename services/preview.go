@@ -0,0 +1,93 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/ca-gip/kubi/types"
+	"github.com/ca-gip/kubi/utils"
+	"io"
+	"net/http"
+	"time"
+)
+
+const redactedToken = "<redacted>"
+
+// Summary of the token replacing it in a preview
+type tokenPreview struct {
+	ExpiresAt   time.Time `json:"expiresAt"`
+	Namespaces  []string  `json:"namespaces"`
+	AdminAccess bool      `json:"adminAccess"`
+	UserDN      string    `json:"userDN,omitempty"`
+}
+
+type kubeConfigPreview struct {
+	KubeConfig *types.KubeConfig `json:"kubeconfig"`
+	Token      tokenPreview      `json:"token"`
+}
+
+// PreviewConfig authenticate like GenerateConfig but return the kubeconfig
+// as indented json, with the token redacted, to be checked before download
+// No token is signed, so the preview costs no quota and raises no alert
+func PreviewConfig(w http.ResponseWriter, r *http.Request) {
+	err, auth := basicAuth(r)
+	if err != nil {
+		utils.Log.Info().Msg(err.Error())
+		writeBasicAuthError(w, err)
+		return
+	}
+	if status, err := readConfigParams(r, auth); err != nil {
+		w.WriteHeader(status)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	config, claims, _, err := buildKubeConfig("https://"+r.Host, *auth)
+	if err != nil {
+		utils.Log.Info().Msg(err.Error())
+		writeTokenError(w, err)
+		return
+	}
+
+	body, err := marshalPreview(previewKubeConfig(config, claims))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// Indent the preview, keeping the redacted placeholder readable
+// instead of escaping its brackets
+func marshalPreview(preview *kubeConfigPreview) ([]byte, error) {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(preview); err != nil {
+		return nil, err
+	}
+	return body.Bytes(), nil
+}
+
+// Redact the user tokens of a kubeconfig and summarize the claims instead
+func previewKubeConfig(config *types.KubeConfig, claims *types.AuthJWTClaims) *kubeConfigPreview {
+	withToken(config, redactedToken)
+
+	namespaces := make([]string, 0, len(claims.Auths))
+	for _, auth := range claims.Auths {
+		namespaces = append(namespaces, auth.Namespace)
+	}
+
+	return &kubeConfigPreview{
+		KubeConfig: config,
+		Token: tokenPreview{
+			ExpiresAt:   time.Unix(claims.ExpiresAt, 0).UTC(),
+			Namespaces:  namespaces,
+			AdminAccess: claims.AdminAccess,
+			UserDN:      claims.UserDN,
+		},
+	}
+}
@@ -0,0 +1,48 @@
+package services
+
+import (
+	"github.com/ca-gip/kubi/types"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestPreviewKubeConfig(t *testing.T) {
+	withTokenConfig(t, &types.Config{KubeConfigCa: "a-ca"})
+
+	auths := []*types.AuthJWTTupple{{Namespace: "demo", Role: "admin"}, {Namespace: "other", Role: "admin"}}
+	token, claims, err := signUserToken(auths, "alice", false, tokenBinding{})
+	assert.Nil(t, err)
+
+	config := newKubeConfig("https://kubi.example.com", "alice", token, claims.Auths, claims.AdminAccess)
+	result, err := marshalPreview(previewKubeConfig(config, claims))
+
+	assert.Nil(t, err)
+	assert.NotContains(t, string(result), token)
+	assert.Contains(t, string(result), redactedToken)
+	assert.Contains(t, string(result), `"server": "https://kubi.example.com"`)
+	assert.Contains(t, string(result), `"namespaces": [
+      "demo",
+      "other"
+    ]`)
+}
+
+func TestPreviewUnsignedClaims(t *testing.T) {
+	withConfig(t, &types.Config{KubeConfigCa: "a-ca", TokenLifeTime: "4h", TokenDailyQuota: 1})
+	quotas := tokenQuotas
+	tokenQuotas = &tokenQuota{counts: map[string]int{}, now: time.Now}
+	defer func() { tokenQuotas = quotas }()
+
+	auth := types.Auth{Username: "alice", ImpersonateUser: "bob"}
+	claims, err := newUserClaims(nil, "alice", true, tokenBinding{})
+	assert.Nil(t, err)
+
+	config := newKubeConfig("https://kubi.example.com", "alice", "", claims.Auths, claims.AdminAccess)
+	assert.Nil(t, withImpersonation(config, auth, claims))
+	result, err := marshalPreview(previewKubeConfig(config, claims))
+
+	assert.Nil(t, err)
+	assert.Contains(t, string(result), `"token": "`+redactedToken+`"`)
+	assert.Contains(t, string(result), `"as": "bob"`)
+	assert.True(t, tokenQuotas.Allow(quotaAccount("alice", ""), false), "a preview must not be counted in the quota")
+}
@@ -2,30 +2,54 @@ package services
 
 import (
 	"github.com/ca-gip/kubi/utils"
+	"github.com/pkg/errors"
+	"io"
 	"net/http"
 	"net/http/httputil"
+	"net/url"
+	"strings"
 	"time"
 )
 
 // Unauthorized Header that could lead to security breach
-var blacklistedHeaders = []string{"Authorization", "authorization", "Impersonate-User", "impersonate-user", "Impersonate-Group", "impersonate-group"}
+var blacklistedHeaders = []string{"Authorization", "authorization", "Impersonate-User", "impersonate-user", "Impersonate-Group", "impersonate-group", "Impersonate-Uid"}
+
+// Prefix of the impersonated user extra fields, all are erased
+const impersonateExtraPrefix = "Impersonate-Extra-"
 
 // An authenticating proxy that forward all request to
 // Kubernetes api server. Modification here can lead to security breach.
 // The director erase dangerous headers < blacklisted header > to be protected
-// from header spoofing.
+// from header spoofing. An admin impersonation out of the allowed ones is refused
 func ProxyHandler(w http.ResponseWriter, r *http.Request) {
+	token, err := CurrentJWT(w, r)
+	asUser, asGroups := requestedImpersonation(r.Header)
+	if err == nil && token.AdminAccess && len(asUser) > 0 {
+		if errImpersonation := allowedImpersonation(asUser, asGroups); errImpersonation != nil {
+			countAuthFailure(errImpersonation)
+			utils.Log.Warn().Msgf("Proxy user %s cannot impersonate %s: %v", utils.RedactUser(token.User), asUser, errImpersonation)
+			w.WriteHeader(http.StatusForbidden)
+			io.WriteString(w, errImpersonation.Error())
+			return
+		}
+	}
 
 	director := func(req *http.Request) {
 
-		req.URL.Host = utils.Config.ApiServerURL
-		req.URL.Scheme = "https"
-		token, err := CurrentJWT(w, req)
+		// The api server url is validated as an https url
+		apiServer, _ := url.Parse(utils.Config.ApiServerURL)
+		req.URL.Host = apiServer.Host
+		req.URL.Scheme = apiServer.Scheme
 
 		// Header cleaning
 		for headerIdx := range blacklistedHeaders {
 			req.Header.Del(blacklistedHeaders[headerIdx])
 		}
+		for name := range req.Header {
+			if strings.HasPrefix(http.CanonicalHeaderKey(name), impersonateExtraPrefix) {
+				req.Header.Del(name)
+			}
+		}
 		req.Header.Set("Authorization", "Bearer "+utils.Config.KubeToken)
 		req.Header.Set("Impersonate-User", "system:anonymous")
 		req.Header.Set("Impersonate-Group", "system:unauthenticated")
@@ -42,10 +66,19 @@ func ProxyHandler(w http.ResponseWriter, r *http.Request) {
 				req.Header.Add("Impersonate-Group", auth.Namespace+"-"+auth.Role)
 			}
 			req.Header.Set("Impersonate-User", token.User)
+
+			// Admins impersonate whom their kubeconfig context asks for
+			if token.AdminAccess && len(asUser) > 0 {
+				req.Header.Set("Impersonate-User", asUser)
+				req.Header.Del("Impersonate-Group")
+				for _, group := range asGroups {
+					req.Header.Add("Impersonate-Group", group)
+				}
+			}
 		} else if err != nil {
 			utils.Log.Error().Err(err)
 		}
-		utils.Log.Info().Msgf("Proxy user %s, %s %s, client %s", req.Header.Get("Impersonate-User"), r.Method, r.RequestURI, r.RemoteAddr)
+		utils.Log.Info().Msgf("Proxy user %s, %s %s, client %s", utils.RedactUser(req.Header.Get("Impersonate-User")), r.Method, r.RequestURI, r.RemoteAddr)
 	}
 
 	proxy := &httputil.ReverseProxy{Director: director, Transport: &http.Transport{
@@ -55,3 +88,23 @@ func ProxyHandler(w http.ResponseWriter, r *http.Request) {
 	}}
 	proxy.ServeHTTP(w, r)
 }
+
+// Impersonation asked by the client, set by kubectl from the as and
+// as-groups fields of a kubeconfig user
+func requestedImpersonation(header http.Header) (string, []string) {
+	return header.Get("Impersonate-User"), append([]string(nil), header.Values("Impersonate-Group")...)
+}
+
+// Check an admin impersonation: system users and groups, like
+// system:masters, are refused, other groups must be in IMPERSONATE_ALLOWED_GROUPS
+func allowedImpersonation(user string, groups []string) error {
+	if strings.HasPrefix(user, "system:") {
+		return errors.Wrapf(ErrImpersonationRefused, "system user %s", user)
+	}
+	for _, group := range groups {
+		if strings.HasPrefix(group, "system:") || !utils.Include(utils.Config.ImpersonateAllowedGroups, group) {
+			return errors.Wrapf(ErrImpersonationRefused, "group %s", group)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package services
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/ca-gip/kubi/types"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProxyImpersonation(t *testing.T) {
+	var received http.Header
+	apiServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer apiServer.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(apiServer.Certificate())
+	withTokenConfig(t, &types.Config{
+		ApiServerURL:             apiServer.URL,
+		ApiServerTLSConfig:       tls.Config{RootCAs: roots},
+		KubeToken:                "a-service-account-token",
+		ImpersonateAllowedGroups: []string{"team-b"},
+	})
+
+	proxyAs := func(token string, user string, group string) *httptest.ResponseRecorder {
+		received = nil
+		request := httptest.NewRequest(http.MethodGet, "/api/v1/namespaces", nil)
+		request.Header.Set("Authorization", "Bearer "+token)
+		request.Header.Set("Impersonate-User", user)
+		request.Header.Add("Impersonate-Group", group)
+		request.Header.Set("Impersonate-Extra-Scopes", "view")
+		recorder := httptest.NewRecorder()
+
+		ProxyHandler(recorder, request)
+		return recorder
+	}
+	proxy := func(token string) http.Header {
+		recorder := proxyAs(token, "bob", "team-b")
+
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		return received
+	}
+
+	t.Run("an admin token impersonates the requested user", func(t *testing.T) {
+		token, _, err := signUserToken(nil, "alice", true, tokenBinding{})
+		assert.Nil(t, err)
+
+		header := proxy(token)
+
+		assert.Equal(t, "Bearer a-service-account-token", header.Get("Authorization"))
+		assert.Equal(t, "bob", header.Get("Impersonate-User"))
+		assert.Equal(t, []string{"team-b"}, header.Values("Impersonate-Group"))
+		assert.Empty(t, header.Get("Impersonate-Extra-Scopes"))
+	})
+
+	t.Run("an admin token cannot impersonate system:masters", func(t *testing.T) {
+		token, _, err := signUserToken(nil, "alice", true, tokenBinding{})
+		assert.Nil(t, err)
+
+		recorder := proxyAs(token, "bob", "system:masters")
+
+		assert.Equal(t, http.StatusForbidden, recorder.Code)
+		assert.Nil(t, received)
+	})
+
+	t.Run("an admin token cannot impersonate a system user", func(t *testing.T) {
+		token, _, err := signUserToken(nil, "alice", true, tokenBinding{})
+		assert.Nil(t, err)
+
+		recorder := proxyAs(token, "system:kube-controller-manager", "team-b")
+
+		assert.Equal(t, http.StatusForbidden, recorder.Code)
+		assert.Nil(t, received)
+	})
+
+	t.Run("an admin token cannot impersonate a group out of the allowlist", func(t *testing.T) {
+		token, _, err := signUserToken(nil, "alice", true, tokenBinding{})
+		assert.Nil(t, err)
+
+		recorder := proxyAs(token, "bob", "team-c")
+
+		assert.Equal(t, http.StatusForbidden, recorder.Code)
+		assert.Nil(t, received)
+	})
+
+	t.Run("a user token cannot impersonate", func(t *testing.T) {
+		auths := []*types.AuthJWTTupple{{Namespace: "demo", Role: "admin"}}
+		token, _, err := signUserToken(auths, "alice", false, tokenBinding{})
+		assert.Nil(t, err)
+
+		header := proxy(token)
+
+		assert.Equal(t, "alice", header.Get("Impersonate-User"))
+		assert.NotContains(t, header.Values("Impersonate-Group"), "team-b")
+		assert.Contains(t, header.Values("Impersonate-Group"), "demo-admin")
+		assert.Empty(t, header.Get("Impersonate-Extra-Scopes"))
+	})
+
+	t.Run("without a token the request is anonymous", func(t *testing.T) {
+		header := proxy("not-a-token")
+
+		assert.Equal(t, "system:anonymous", header.Get("Impersonate-User"))
+		assert.Equal(t, []string{"system:unauthenticated"}, header.Values("Impersonate-Group"))
+	})
+}
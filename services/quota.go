@@ -0,0 +1,54 @@
+package services
+
+import (
+	"errors"
+	"github.com/ca-gip/kubi/utils"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrTokenQuotaExceeded = errors.New("daily token quota exceeded")
+
+// Count tokens issued per user for the current day
+// The counters are reset when the day boundary is crossed
+type tokenQuota struct {
+	sync.Mutex
+	day    string
+	counts map[string]int
+	now    func() time.Time
+}
+
+var tokenQuotas = &tokenQuota{counts: map[string]int{}, now: time.Now}
+
+// Count a token for the account, return false if its daily quota is exceeded
+// A zero quota means no limit
+func (q *tokenQuota) Allow(account string, hasAdminAccess bool) bool {
+	if utils.Config.TokenDailyQuota <= 0 || (hasAdminAccess && utils.Config.TokenQuotaExemptAdmins) {
+		return true
+	}
+
+	// The day starts at the reset hour, in UTC
+	resetHour := time.Duration(utils.Config.TokenQuotaResetHour) * time.Hour
+	day := q.now().UTC().Add(-resetHour).Format("2006-01-02")
+
+	q.Lock()
+	defer q.Unlock()
+	if day != q.day {
+		q.day, q.counts = day, map[string]int{}
+	}
+	if q.counts[account] >= utils.Config.TokenDailyQuota {
+		return false
+	}
+	q.counts[account]++
+	return true
+}
+
+// The quota is counted per directory account, the lowercased user DN, as
+// every login form of a user (case, email/UPN) binds to the same entry
+func quotaAccount(username string, userDN string) string {
+	if len(userDN) == 0 {
+		return strings.ToLower(username)
+	}
+	return strings.ToLower(userDN)
+}
@@ -0,0 +1,59 @@
+package services
+
+import (
+	"github.com/ca-gip/kubi/types"
+	"github.com/ca-gip/kubi/utils"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestTokenQuota(t *testing.T) {
+	withConfig(t, &types.Config{TokenDailyQuota: 2, TokenQuotaExemptAdmins: true, TokenQuotaResetHour: 6})
+	now := time.Date(2019, 3, 1, 10, 0, 0, 0, time.UTC)
+	quota := &tokenQuota{counts: map[string]int{}, now: func() time.Time { return now }}
+
+	t.Run("under quota succeed", func(t *testing.T) {
+		assert.True(t, quota.Allow("alice", false))
+		assert.True(t, quota.Allow("alice", false))
+		assert.True(t, quota.Allow("bob", false))
+	})
+
+	t.Run("over quota is rejected", func(t *testing.T) {
+		assert.False(t, quota.Allow("alice", false))
+	})
+
+	t.Run("admins are exempt", func(t *testing.T) {
+		assert.True(t, quota.Allow("alice", true))
+	})
+
+	t.Run("counters reset at the day boundary", func(t *testing.T) {
+		now = time.Date(2019, 3, 2, 5, 59, 0, 0, time.UTC)
+		assert.False(t, quota.Allow("alice", false))
+
+		now = time.Date(2019, 3, 2, 6, 0, 0, 0, time.UTC)
+		assert.True(t, quota.Allow("alice", false))
+	})
+
+	t.Run("a zero quota means no limit", func(t *testing.T) {
+		utils.Config.TokenDailyQuota = 0
+		for i := 0; i < 10; i++ {
+			assert.True(t, quota.Allow("bob", false))
+		}
+	})
+}
+
+func TestQuotaAccount(t *testing.T) {
+	withConfig(t, &types.Config{TokenDailyQuota: 1})
+	quota := &tokenQuota{counts: map[string]int{}, now: time.Now}
+
+	t.Run("every login form of a user share its quota", func(t *testing.T) {
+		assert.True(t, quota.Allow(quotaAccount("alice", "CN=Alice,OU=Users"), false))
+		assert.False(t, quota.Allow(quotaAccount("Alice", "cn=alice,ou=users"), false))
+		assert.False(t, quota.Allow(quotaAccount("alice@corp.com", "CN=Alice,OU=Users"), false))
+	})
+
+	t.Run("the username is counted without user DN", func(t *testing.T) {
+		assert.Equal(t, "bob", quotaAccount("Bob", ""))
+	})
+}
@@ -0,0 +1,152 @@
+package services
+
+import (
+	"expvar"
+	"fmt"
+	"github.com/ca-gip/kubi/utils"
+	"github.com/gorilla/mux"
+	"io"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+)
+
+// Prefix of the ops endpoints when served on the main port,
+// their plain paths are proxied to the api server
+const opsPrefix = "/kubi"
+
+// NewRouter return the main router, with the auth endpoints and the proxy
+// The ops endpoints are mounted under /kubi unless served on their own port,
+// only for admin tokens as they expose the metrics and the profiles.
+// In verify only mode, only the verify endpoints and /jwks are served
+func NewRouter(withOps bool, verifyOnly bool) *mux.Router {
+	router := mux.NewRouter()
+	router.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		utils.Log.Warn().Msgf("%d %s %s", http.StatusNotFound, req.Method, req.URL.String())
+	})
+	//router.Use(middlewares.LoggingMiddleware)
+
+	if withOps {
+		router.HandleFunc("/readyz", Readyz).Methods(http.MethodGet)
+		router.PathPrefix(opsPrefix + "/").Handler(adminOnly(http.StripPrefix(opsPrefix, NewOpsRouter())))
+	}
+
+	if !verifyOnly {
+		for _, prefix := range utils.ApiPrefix() {
+			router.PathPrefix(prefix).Methods(http.MethodGet, http.MethodPost, http.MethodPatch, http.MethodPut, http.MethodDelete, http.MethodOptions).HandlerFunc(ProxyHandler)
+		}
+
+		router.HandleFunc("/ca", CA).Methods(http.MethodGet)
+		router.HandleFunc("/refresh", RefreshK8SResources).Methods(http.MethodGet) // TODO, protect from users
+		router.HandleFunc("/config", allowMethods(allowParams(withFaults(GenerateConfig), "ttl", "type", "impersonate-user", "impersonate-group", "format", "cluster"), http.MethodGet))
+		router.HandleFunc("/config/preview", allowMethods(allowParams(withFaults(PreviewConfig), "ttl", "impersonate-user", "impersonate-group", "cluster"), http.MethodGet))
+		router.HandleFunc("/config/link", allowMethods(allowParams(withFaults(GenerateConfigLink)), http.MethodGet))
+		router.HandleFunc("/config/download/{id}", allowMethods(allowParams(withFaults(DownloadConfig)), http.MethodGet))
+		router.HandleFunc("/token", allowMethods(allowParams(withFaults(GenerateJWT), "ttl", "format"), http.MethodGet))
+		router.HandleFunc("/token/refresh", allowMethods(allowParams(withFaults(RefreshJWT)), http.MethodGet))
+		router.HandleFunc("/whoami", allowMethods(allowParams(Whoami), http.MethodGet))
+		router.HandleFunc("/faults", allowMethods(InjectFaults, http.MethodPut, http.MethodDelete))
+	}
+	router.HandleFunc("/jwks", JWKS).Methods(http.MethodGet)
+	router.HandleFunc("/token/{username}", allowMethods(VerifyJWT, http.MethodPost))
+	router.HandleFunc("/clusters/{cluster}/token/{username}", allowMethods(VerifyJWT, http.MethodPost))
+
+	return router
+}
+
+// Serve a handler to admin tokens only
+func adminOnly(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, err := CurrentJWT(w, r)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if !claims.AdminAccess {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// Serve the auth endpoints for the given methods only, others get a 405
+// listing the allowed methods, which the mux method matcher does not send
+func allowMethods(handler http.HandlerFunc, methods ...string) http.HandlerFunc {
+	allow := strings.Join(methods, ", ")
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, method := range methods {
+			if r.Method == method {
+				handler(w, r)
+				return
+			}
+		}
+		w.Header().Set("Allow", allow)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		utils.Log.Warn().Msgf("%d %s %s", http.StatusMethodNotAllowed, r.Method, r.URL.Path)
+	}
+}
+
+// In STRICT_PARAMS mode, a query parameter the endpoint does not read
+// is a 400 listing the allowed ones, instead of being silently ignored
+func allowParams(handler http.HandlerFunc, params ...string) http.HandlerFunc {
+	allowed := "none"
+	if len(params) > 0 {
+		allowed = strings.Join(params, ", ")
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if utils.Config.StrictParams {
+			for name := range r.URL.Query() {
+				if !utils.Include(params, name) {
+					w.WriteHeader(http.StatusBadRequest)
+					io.WriteString(w, fmt.Sprintf("Unknown query parameter %s, allowed parameters: %s", name, allowed))
+					return
+				}
+			}
+		}
+		handler(w, r)
+	}
+}
+
+// NewOpsRouter return the router of operational endpoints:
+// health, metrics, version and pprof
+func NewOpsRouter() *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/readyz", Readyz).Methods(http.MethodGet)
+	router.Handle("/metrics", expvar.Handler()).Methods(http.MethodGet)
+	router.HandleFunc("/version", Version).Methods(http.MethodGet)
+	router.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	router.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	router.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	router.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	router.PathPrefix("/debug/pprof/").HandlerFunc(pprof.Index)
+	return router
+}
+
+// ListenOps serve the ops endpoints on their own address, in background
+// Failing to listen does not stop kubi from serving auth on the main port,
+// unless OPS_REQUIRED is set
+func ListenOps(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		if utils.Config.OpsRequired {
+			return err
+		}
+		utils.Log.Error().Msgf("Cannot serve ops requests on %s, continuing without: %v", address, err)
+		return nil
+	}
+
+	utils.Log.Info().Msgf(" Preparing to serve ops request, address: %s", address)
+	go func() {
+		utils.Log.Error().Err(http.Serve(listener, NewOpsRouter())).Msg("Ops listener stopped")
+	}()
+	return nil
+}
+
+// Version handler, return the kubi build version
+func Version(w http.ResponseWriter, _ *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, utils.Version)
+}
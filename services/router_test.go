@@ -0,0 +1,183 @@
+package services_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/ca-gip/kubi/services"
+	"github.com/ca-gip/kubi/types"
+	"github.com/ca-gip/kubi/utils"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOpsRouter(t *testing.T) {
+	get := func(handler http.Handler, path string) int {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		return recorder.Code
+	}
+
+	t.Run("metrics are reachable on the ops port", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, get(services.NewOpsRouter(), "/metrics"))
+		assert.Equal(t, http.StatusOK, get(services.NewOpsRouter(), "/version"))
+	})
+
+	t.Run("metrics are not on the main port when split", func(t *testing.T) {
+		assert.Equal(t, http.StatusNotFound, get(services.NewRouter(false, false), "/kubi/metrics"))
+	})
+
+	t.Run("metrics need an admin token on the main port when not split", func(t *testing.T) {
+		services.WithConfig(t, &types.Config{JwtVerifyAlgs: []string{"HS512"}})
+
+		assert.Equal(t, http.StatusUnauthorized, get(services.NewRouter(true, false), "/kubi/metrics"))
+		assert.Equal(t, http.StatusUnauthorized, get(services.NewRouter(true, false), "/kubi/debug/pprof/heap"))
+	})
+
+	t.Run("readiness stays public on the main port", func(t *testing.T) {
+		services.WithConfig(t, &types.Config{JwtVerifyAlgs: []string{"HS512"}})
+
+		assert.NotEqual(t, http.StatusUnauthorized, get(services.NewRouter(true, false), "/readyz"))
+	})
+}
+
+func TestVerifyOnlyRouter(t *testing.T) {
+	get := func(handler http.Handler, path string) int {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		return recorder.Code
+	}
+
+	t.Run("issuing endpoints are not served", func(t *testing.T) {
+		router := services.NewRouter(false, true)
+
+		assert.Equal(t, http.StatusNotFound, get(router, "/token"))
+		assert.Equal(t, http.StatusNotFound, get(router, "/config"))
+		assert.Equal(t, http.StatusNotFound, get(router, "/config/link"))
+		assert.Equal(t, http.StatusNotFound, get(router, "/whoami"))
+	})
+
+	t.Run("the cluster facing endpoints are not served", func(t *testing.T) {
+		router := services.NewRouter(false, true)
+		faults := httptest.NewRecorder()
+		router.ServeHTTP(faults, httptest.NewRequest(http.MethodPut, "/faults", nil))
+
+		assert.Equal(t, http.StatusNotFound, get(router, "/refresh"))
+		assert.Equal(t, http.StatusNotFound, get(router, "/ca"))
+		assert.Equal(t, http.StatusNotFound, faults.Code)
+		for _, prefix := range utils.ApiPrefix() {
+			assert.Equal(t, http.StatusNotFound, get(router, "/"+strings.TrimPrefix(prefix, "/")), prefix)
+		}
+	})
+
+	t.Run("the verify endpoints are served", func(t *testing.T) {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		assert.Nil(t, err)
+		publicDer, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		assert.Nil(t, err)
+		services.WithConfig(t, &types.Config{
+			VerifyOnly:    true,
+			VerifyKeys:    [][]byte{pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDer})},
+			JwtVerifyAlgs: []string{"RS256"},
+		})
+		router := services.NewRouter(false, true)
+		verify := httptest.NewRecorder()
+		router.ServeHTTP(verify, httptest.NewRequest(http.MethodPost, "/token/demo", strings.NewReader("not-a-token")))
+
+		assert.Equal(t, http.StatusUnauthorized, verify.Code)
+		assert.Equal(t, http.StatusOK, get(router, "/jwks"))
+	})
+}
+
+func TestListenOps(t *testing.T) {
+	services.WithConfig(t, &types.Config{KubeCaText: "a-ca"})
+
+	// The ops port is already bound
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer busy.Close()
+
+	t.Run("auth is still served when ops are not required", func(t *testing.T) {
+		assert.Nil(t, services.ListenOps(busy.Addr().String()))
+
+		server := httptest.NewServer(services.NewRouter(false, false))
+		defer server.Close()
+
+		response, err := http.Get(server.URL + "/ca")
+		assert.Nil(t, err)
+		defer response.Body.Close()
+		body, _ := ioutil.ReadAll(response.Body)
+		assert.Equal(t, http.StatusOK, response.StatusCode)
+		assert.Equal(t, "a-ca", string(body))
+	})
+
+	t.Run("the failure is returned when ops are required", func(t *testing.T) {
+		utils.Config.OpsRequired = true
+		defer func() { utils.Config.OpsRequired = false }()
+
+		assert.NotNil(t, services.ListenOps(busy.Addr().String()))
+	})
+}
+
+func TestAllowedMethods(t *testing.T) {
+	request := func(method string, path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		services.NewRouter(false, false).ServeHTTP(recorder, httptest.NewRequest(method, path, nil))
+		return recorder
+	}
+
+	t.Run("the token endpoint only accepts GET", func(t *testing.T) {
+		result := request(http.MethodPost, "/token")
+
+		assert.Equal(t, http.StatusMethodNotAllowed, result.Code)
+		assert.Equal(t, http.MethodGet, result.Header().Get("Allow"))
+	})
+
+	t.Run("the config endpoint only accepts GET", func(t *testing.T) {
+		result := request(http.MethodDelete, "/config")
+
+		assert.Equal(t, http.StatusMethodNotAllowed, result.Code)
+		assert.Equal(t, http.MethodGet, result.Header().Get("Allow"))
+	})
+
+	t.Run("the verify endpoint only accepts POST", func(t *testing.T) {
+		result := request(http.MethodGet, "/token/demo")
+
+		assert.Equal(t, http.StatusMethodNotAllowed, result.Code)
+		assert.Equal(t, http.MethodPost, result.Header().Get("Allow"))
+	})
+}
+
+func TestStrictParams(t *testing.T) {
+	services.WithConfig(t, &types.Config{MaxAuthHeader: 8192, MinPasswordLength: 12})
+	request := func(path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodGet, path, nil)
+		request.SetBasicAuth("alice", "short")
+		services.NewRouter(false, false).ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	t.Run("an unknown parameter is a bad request in strict mode", func(t *testing.T) {
+		utils.Config.StrictParams = true
+		defer func() { utils.Config.StrictParams = false }()
+
+		result := request("/token?tll=1h")
+
+		assert.Equal(t, http.StatusBadRequest, result.Code)
+		assert.Equal(t, "Unknown query parameter tll, allowed parameters: ttl, format", result.Body.String())
+	})
+
+	t.Run("an unknown parameter is ignored otherwise", func(t *testing.T) {
+		result := request("/token?tll=1h")
+
+		// Reaches the handler, which refuses the short password
+		assert.Equal(t, http.StatusUnauthorized, result.Code)
+	})
+}
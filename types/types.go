@@ -4,79 +4,186 @@ import (
 	"crypto/tls"
 	"github.com/dgrijalva/jwt-go"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net"
+	"time"
 )
 
 type LdapConfig struct {
-	UserBase            string
-	GroupBase           string
-	AdminUserBase       string
-	AdminGroupBase      string
-	Host                string
-	Port                int
-	UseSSL              bool
-	StartTLS            bool
-	SkipTLSVerification bool
-	BindDN              string
-	BindPassword        string
-	UserFilter          string
-	GroupFilter         string
-	Attributes          []string
+	UserBase             string
+	GroupBase            string
+	AdminUserBase        string
+	AdminGroupBase       string
+	AdminAttribute       string
+	AdminAttributeValue  string
+	AdminDenyGroups      []string
+	SearchAsUser         bool
+	ReuseConnection      bool
+	SearchAdminGroupBase bool
+	Host                 string
+	Port                 int
+	UseSSL               bool
+	StartTLS             bool
+	SkipTLSVerification  bool
+	// Presented to directories requiring mutual TLS
+	ClientCertificates []tls.Certificate
+	BindDN             string
+	BindPassword       string
+	UserFilter         string
+	UpnFilter          string
+	DialTimeout        time.Duration
+	SearchTimeout      time.Duration
+	RetryAfter         int
+	MaxPages           int
+	MaxEntries         int
+	MaxAttrSize        int
+	MaxGroups          int
+	WarnNoGroups       bool
+	GroupFilter        string
+	Attributes         []string
+	// Attribute used to pick one entry when the user filter
+	// matches several users. Empty means the login is rejected.
+	UserTiebreakerAttribute string
 }
 
 type Config struct {
-	Ldap               LdapConfig
-	ApiServerURL       string
-	KubeCa             string
-	KubeCaText         string
-	KubeToken          string
-	ApiServerTLSConfig tls.Config
-	TokenLifeTime      string
+	Ldap                      LdapConfig
+	ApiServerURL              string
+	KubeCa                    string
+	KubeCaText                string
+	KubeConfigCa              string
+	KubeToken                 string
+	ApiServerTLSConfig        tls.Config
+	TokenLifeTime             string
+	TokenRefreshGrace         string
+	TokenRefreshMaxAge        time.Duration
+	GrantLog                  bool
+	InstanceName              string
+	MaxAuthHeader             int
+	Clusters                  map[string]string
+	ClusterCas                map[string]string
+	NamespaceClusters         map[string]string
+	DownloadLinkTTL           string
+	JwtSigningMethod          string
+	JwtKeyId                  string
+	JwtVerifyAlgs             []string
+	KubeClientTimeout         time.Duration
+	KubeClientRetries         int
+	LogRedactUsernames        bool
+	LogRedactSalt             string
+	TokenDailyQuota           int
+	TokenQuotaResetHour       int
+	TokenQuotaExemptAdmins    bool
+	OpsPort                   int
+	OpsAddress                string
+	OpsRequired               bool
+	AssertionKey              []byte
+	AssertionSigningMethod    string
+	NamespaceDedupe           bool
+	AdminDefaultNamespace     string
+	MinPasswordLength         int
+	KubeConfigTokenFile       string
+	KubeConfigNormalizeNames  bool
+	TokenIdleTimeout          time.Duration
+	ClusterAudiences          map[string]string
+	TrustedProxies            []*net.IPNet
+	BindTokenToIp             bool
+	AdminConfigBanner         bool
+	ImpersonateAllowedGroups  []string
+	VerifyOnly                bool
+	VerifyKeys                [][]byte
+	JwksURLs                  []string
+	JwksRefreshInterval       time.Duration
+	MaxTokenLifetimeAccepted  time.Duration
+	MinTTL                    time.Duration
+	MaxTTL                    time.Duration
+	GroupNamespaceMapFile     string
+	GroupNamespaceMapInterval time.Duration
+	GroupParserFile           string
+	GroupParserInterval       time.Duration
+	RequireClaims             bool
+	AllowBootstrapTokens      bool
+	BootstrapTokenTTL         time.Duration
+	BootstrapTokenUsages      []string
+	AuthRealm                 string
+	MinTokenVersion           int
+	MinNamespacesForConfig    int
+	StrictParams              bool
+	IncludeUserDN             bool
+	EnableFaultInjection      bool
+	RolePrivilegeOrder        []string
+	SingleUseTokens           bool
+	AdminAlertWebhookURL      string
+	NamespacePendingGrace     time.Duration
+	LinkHeaders               bool
+	RoutePrefix               string
+	DuplicateJtiCheck         bool
+	DuplicateJtiReject        bool
+	ExpiryWarningWindow       time.Duration
+	AccessLog                 bool
 }
 
 // Note: struct fields must be public in order for unmarshal to
 // correctly populate the data.
 type KubeConfig struct {
-	ApiVersion     string              `yaml:"apiVersion"`
-	Clusters       []KubeConfigCluster `yaml:"clusters"`
-	Contexts       []KubeConfigContext `yaml:"contexts"`
-	CurrentContext string              `yaml:"current-context"`
-	Kind           string              `yaml:"kind"`
-	Users          []KubeConfigUser    `yaml:"users"`
+	ApiVersion     string              `yaml:"apiVersion" json:"apiVersion"`
+	Clusters       []KubeConfigCluster `yaml:"clusters" json:"clusters"`
+	Contexts       []KubeConfigContext `yaml:"contexts" json:"contexts"`
+	CurrentContext string              `yaml:"current-context" json:"current-context"`
+	Kind           string              `yaml:"kind" json:"kind"`
+	Users          []KubeConfigUser    `yaml:"users" json:"users"`
 }
 
 type KubeConfigCluster struct {
-	Cluster KubeConfigClusterData `yaml:"cluster"`
-	Name    string                `yaml:"name"`
+	Cluster KubeConfigClusterData `yaml:"cluster" json:"cluster"`
+	Name    string                `yaml:"name" json:"name"`
 }
 
 type KubeConfigClusterData struct {
-	CertificateData string `yaml:"certificate-authority-data"`
-	Server          string `yaml:"server"`
+	CertificateData string `yaml:"certificate-authority-data,omitempty" json:"certificate-authority-data,omitempty"`
+	Server          string `yaml:"server" json:"server"`
 }
 
 type KubeConfigContext struct {
-	Context KubeConfigContextData `yaml:"context"`
-	Name    string                `yaml:"name"`
+	Context KubeConfigContextData `yaml:"context" json:"context"`
+	Name    string                `yaml:"name" json:"name"`
 }
 
 type KubeConfigContextData struct {
-	Cluster string `yaml:"cluster"`
-	User    string `yaml:"user"`
+	Cluster   string `yaml:"cluster" json:"cluster"`
+	Namespace string `yaml:"namespace,omitempty" json:"namespace,omitempty"`
+	User      string `yaml:"user" json:"user"`
 }
 
 type KubeConfigUser struct {
-	Name string              `yaml:"name"`
-	User KubeConfigUserToken `yaml:"user"`
+	Name string              `yaml:"name" json:"name"`
+	User KubeConfigUserToken `yaml:"user" json:"user"`
 }
 
 type KubeConfigUserToken struct {
-	Token string `yaml:"token"`
+	Token     string   `yaml:"token,omitempty" json:"token,omitempty"`
+	TokenFile string   `yaml:"tokenFile,omitempty" json:"tokenFile,omitempty"`
+	As        string   `yaml:"as,omitempty" json:"as,omitempty"`
+	AsGroups  []string `yaml:"as-groups,omitempty" json:"as-groups,omitempty"`
 }
 
 type AuthJWTClaims struct {
 	Auths       []*AuthJWTTupple `json:"auths"`
 	User        string           `json:"user"`
 	AdminAccess bool             `json:"adminAccess"`
+	Instance    string           `json:"kubi_instance,omitempty"`
+	IssuedIP    string           `json:"issued_ip,omitempty"`
+	Version     int              `json:"ver,omitempty"`
+	UserDN      string           `json:"user_dn,omitempty"`
+	Nonce       string           `json:"nonce,omitempty"`
+	// Issue time of the token first issued at login, kept by refreshes
+	LoginAt int64 `json:"login_at,omitempty"`
+	jwt.StandardClaims
+}
+
+// Login assertion for a downstream system
+type AssertionClaims struct {
+	User   string `json:"user"`
+	Source string `json:"source"`
 	jwt.StandardClaims
 }
 
@@ -93,4 +200,12 @@ type ResponseError struct {
 type Auth struct {
 	Username string
 	Password string
+	Cluster  string
+	SourceIP string
+	Lifetime time.Duration
+	// Impersonation asked by an admin for its kubeconfig
+	ImpersonateUser   string
+	ImpersonateGroups []string
+	// Single cluster of the kubeconfig, all clusters when empty
+	ConfigCluster string
 }
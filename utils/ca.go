@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"github.com/pkg/errors"
+)
+
+// EncodeCaChain validate every certificate of a PEM bundle
+// and return the whole chain base64 encoded for a kubeconfig
+func EncodeCaChain(data []byte) (string, error) {
+	count := 0
+	for rest := data; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+			return "", errors.Wrapf(err, "invalid certificate %d in the CA chain", count+1)
+		}
+		count++
+	}
+	if count == 0 {
+		return "", errors.New("no certificate found in the CA chain")
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// LoadClientCertificates load a client certificate and its key, checking they
+// match. No certificate is loaded when both paths are empty
+func LoadClientCertificates(certFile string, keyFile string) ([]tls.Certificate, error) {
+	if len(certFile) == 0 && len(keyFile) == 0 {
+		return nil, nil
+	}
+	if len(certFile) == 0 || len(keyFile) == 0 {
+		return nil, errors.New("a client certificate needs both a certificate and a key")
+	}
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return []tls.Certificate{certificate}, nil
+}
@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func newTestCertificate(t *testing.T, name string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestEncodeCaChain(t *testing.T) {
+	root, intermediate := newTestCertificate(t, "root"), newTestCertificate(t, "intermediate")
+
+	t.Run("every certificate of the chain is kept", func(t *testing.T) {
+		chain := append(append([]byte{}, intermediate...), root...)
+
+		result, err := EncodeCaChain(chain)
+		assert.Nil(t, err)
+
+		decoded, err := base64.StdEncoding.DecodeString(result)
+		assert.Nil(t, err)
+		first, rest := pem.Decode(decoded)
+		second, _ := pem.Decode(rest)
+		assert.NotNil(t, first)
+		assert.NotNil(t, second)
+		assert.Equal(t, chain, decoded)
+	})
+
+	t.Run("with an invalid certificate in the chain", func(t *testing.T) {
+		invalid := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("garbage")})
+
+		_, err := EncodeCaChain(append(append([]byte{}, root...), invalid...))
+		assert.NotNil(t, err)
+	})
+
+	t.Run("without certificate", func(t *testing.T) {
+		_, err := EncodeCaChain([]byte("not a pem"))
+		assert.NotNil(t, err)
+	})
+}
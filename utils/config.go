@@ -4,6 +4,8 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
+	"errors"
+	"fmt"
 	"github.com/ca-gip/kubi/types"
 	"github.com/go-ozzo/ozzo-validation"
 	"github.com/go-ozzo/ozzo-validation/is"
@@ -11,9 +13,11 @@ import (
 	"k8s.io/client-go/rest"
 	"log"
 	"net"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var Config *types.Config
@@ -35,7 +39,9 @@ func MakeConfig() (*types.Config, error) {
 	kubeCA, errCA := ioutil.ReadFile(TlsCaFile)
 	check(errCA)
 
-	caEncoded := base64.StdEncoding.EncodeToString(kubeCA)
+	// The whole chain is kept, for API servers with an intermediate signed certificate
+	caEncoded, errCaChain := EncodeCaChain(kubeCA)
+	checkf(errCaChain, "Invalid Kubernetes CA")
 
 	// Get the SystemCertPool, continue with an empty pool on error
 	rootCAs, _ := x509.SystemCertPool()
@@ -54,20 +60,23 @@ func MakeConfig() (*types.Config, error) {
 	}
 
 	// LDAP validation
-	ldapPort, errLdapPort := strconv.Atoi(getEnv("LDAP_PORT", "389"))
+	ldapPort, errLdapPort := strconv.Atoi(getLdapEnv("LDAP_PORT", "389"))
 	checkf(errLdapPort, "Invalid LDAP_PORT, must be an integer")
 
-	useSSL, errLdapSSL := strconv.ParseBool(getEnv("LDAP_USE_SSL", "false"))
+	useSSL, errLdapSSL := strconv.ParseBool(getLdapEnv("LDAP_USE_SSL", "false"))
 	checkf(errLdapSSL, "Invalid LDAP_USE_SSL, must be a boolean")
 
-	skipTLSVerification, errSkipTLS := strconv.ParseBool(getEnv("LDAP_SKIP_TLS_VERIFICATION", "true"))
+	skipTLSVerification, errSkipTLS := strconv.ParseBool(getLdapEnv("LDAP_SKIP_TLS_VERIFICATION", "true"))
 	checkf(errSkipTLS, "Invalid LDAP_SKIP_TLS_VERIFICATION, must be a boolean")
 
-	startTLS, errStartTLS := strconv.ParseBool(getEnv("LDAP_START_TLS", "false"))
+	startTLS, errStartTLS := strconv.ParseBool(getLdapEnv("LDAP_START_TLS", "false"))
 	checkf(errStartTLS, "Invalid LDAP_START_TLS, must be a boolean")
 
+	ldapClientCertificates, errLdapClientCert := LoadClientCertificates(getLdapEnv("LDAP_CLIENT_CERT", ""), getLdapEnv("LDAP_CLIENT_KEY", ""))
+	checkf(errLdapClientCert, "Invalid LDAP_CLIENT_CERT or LDAP_CLIENT_KEY")
+
 	if len(os.Getenv("LDAP_PORT")) > 0 {
-		envLdapPort, err := strconv.Atoi(os.Getenv("LDAP_PORT"))
+		envLdapPort, err := strconv.Atoi(getLdapEnv("LDAP_PORT", ""))
 		check(err)
 		ldapPort = envLdapPort
 		if ldapPort == 389 && os.Getenv("LDAP_SKIP_TLS") == "false" {
@@ -79,47 +88,344 @@ func MakeConfig() (*types.Config, error) {
 		}
 	}
 
-	ldapUserFilter := getEnv("LDAP_USERFILTER", "(cn=%s)")
+	grantLog, errGrantLog := strconv.ParseBool(getEnv("GRANT_LOG", "false"))
+	checkf(errGrantLog, "Invalid GRANT_LOG, must be a boolean")
+
+	maxAuthHeader, errMaxAuthHeader := strconv.Atoi(getEnv("MAX_AUTH_HEADER", "8192"))
+	checkf(errMaxAuthHeader, "Invalid MAX_AUTH_HEADER, must be an integer")
+
+	jwtSigningMethod := getEnv("JWT_SIGNING_METHOD", "HS512")
+	jwtVerifyAlgs := Map(strings.Split(getEnv("JWT_VERIFY_ALGS", jwtSigningMethod), ","), strings.TrimSpace)
+
+	kubeClientTimeout, errKubeClientTimeout := time.ParseDuration(getEnv("KUBE_CLIENT_TIMEOUT", "10s"))
+	checkf(errKubeClientTimeout, "Invalid KUBE_CLIENT_TIMEOUT, must be a duration")
+
+	kubeClientRetries, errKubeClientRetries := strconv.Atoi(getEnv("KUBE_CLIENT_RETRIES", "3"))
+	checkf(errKubeClientRetries, "Invalid KUBE_CLIENT_RETRIES, must be an integer")
+
+	logRedactUsernames, errLogRedact := strconv.ParseBool(getEnv("LOG_REDACT_USERNAMES", "false"))
+	checkf(errLogRedact, "Invalid LOG_REDACT_USERNAMES, must be a boolean")
+
+	tokenDailyQuota, errTokenDailyQuota := strconv.Atoi(getEnv("TOKEN_DAILY_QUOTA", "0"))
+	checkf(errTokenDailyQuota, "Invalid TOKEN_DAILY_QUOTA, must be an integer")
+
+	tokenQuotaResetHour, errTokenQuotaResetHour := strconv.Atoi(getEnv("TOKEN_QUOTA_RESET_HOUR", "0"))
+	checkf(errTokenQuotaResetHour, "Invalid TOKEN_QUOTA_RESET_HOUR, must be an integer")
+
+	tokenQuotaExemptAdmins, errTokenQuotaExemptAdmins := strconv.ParseBool(getEnv("TOKEN_QUOTA_EXEMPT_ADMINS", "true"))
+	checkf(errTokenQuotaExemptAdmins, "Invalid TOKEN_QUOTA_EXEMPT_ADMINS, must be a boolean")
+
+	ldapDialTimeout, errLdapDialTimeout := time.ParseDuration(getEnv("LDAP_DIAL_TIMEOUT", "10s"))
+	checkf(errLdapDialTimeout, "Invalid LDAP_DIAL_TIMEOUT, must be a duration")
+
+	ldapSearchTimeout, errLdapSearchTimeout := time.ParseDuration(getEnv("LDAP_SEARCH_TIMEOUT", "30s"))
+	checkf(errLdapSearchTimeout, "Invalid LDAP_SEARCH_TIMEOUT, must be a duration")
+
+	tokenRefreshMaxAge, errTokenRefreshMaxAge := time.ParseDuration(getEnv("TOKEN_REFRESH_MAX_AGE", "24h"))
+	checkf(errTokenRefreshMaxAge, "Invalid TOKEN_REFRESH_MAX_AGE, must be a duration")
+
+	tokenIdleTimeout, errTokenIdleTimeout := time.ParseDuration(getEnv("TOKEN_IDLE_TIMEOUT", "0s"))
+	checkf(errTokenIdleTimeout, "Invalid TOKEN_IDLE_TIMEOUT, must be a duration")
+
+	var trustedProxies []*net.IPNet
+	for _, cidr := range getEnvList("TRUSTED_PROXIES") {
+		_, network, errTrustedProxy := net.ParseCIDR(cidr)
+		checkf(errTrustedProxy, "Invalid TRUSTED_PROXIES, must be a list of CIDR")
+		if network != nil {
+			trustedProxies = append(trustedProxies, network)
+		}
+	}
+
+	bindTokenToIp, errBindTokenToIp := strconv.ParseBool(getEnv("BIND_TOKEN_TO_IP", "false"))
+	checkf(errBindTokenToIp, "Invalid BIND_TOKEN_TO_IP, must be a boolean")
+
+	adminConfigBanner, errAdminConfigBanner := strconv.ParseBool(getEnv("ADMIN_CONFIG_BANNER", "true"))
+	checkf(errAdminConfigBanner, "Invalid ADMIN_CONFIG_BANNER, must be a boolean")
+
+	// In verify only mode, only a public key is loaded, no signing key is needed
+	verifyOnly, errVerifyOnly := strconv.ParseBool(getEnv("VERIFY_ONLY", "false"))
+	checkf(errVerifyOnly, "Invalid VERIFY_ONLY, must be a boolean")
+
+	// Verification keys come from files, the env and JWKS urls, all are used
+	var verifyKeys [][]byte
+	for _, verifyKeyFile := range getEnvList("VERIFY_KEY_FILE") {
+		key, errVerifyKey := ioutil.ReadFile(verifyKeyFile)
+		checkf(errVerifyKey, "Invalid VERIFY_KEY_FILE, cannot be read")
+		verifyKeys = append(verifyKeys, key)
+	}
+	if verifyKey := os.Getenv("VERIFY_KEY"); len(verifyKey) > 0 {
+		verifyKeys = append(verifyKeys, []byte(verifyKey))
+	}
+	jwksURLs := getEnvList("VERIFY_JWKS_URLS")
+	if verifyOnly && len(verifyKeys) == 0 && len(jwksURLs) == 0 {
+		log.Fatalf("VERIFY_KEY_FILE, VERIFY_KEY or VERIFY_JWKS_URLS is required in verify only mode, exiting")
+	}
+
+	jwksRefreshInterval, errJwksRefreshInterval := time.ParseDuration(getEnv("VERIFY_JWKS_REFRESH_INTERVAL", "5m"))
+	if len(jwksURLs) > 0 && (errJwksRefreshInterval != nil || jwksRefreshInterval <= 0) {
+		log.Fatalf("Invalid VERIFY_JWKS_REFRESH_INTERVAL, must be a positive duration, exiting")
+	}
+
+	maxTokenLifetimeAccepted, errMaxTokenLifetime := time.ParseDuration(getEnv("MAX_TOKEN_LIFETIME_ACCEPTED", "0s"))
+	checkf(errMaxTokenLifetime, "Invalid MAX_TOKEN_LIFETIME_ACCEPTED, must be a duration")
+
+	minTTL, errMinTTL := time.ParseDuration(getEnv("MIN_TTL", "5m"))
+	if errMinTTL != nil {
+		log.Fatalf("Invalid MIN_TTL, must be a duration: %v, exiting", errMinTTL)
+	}
+
+	// Requested lifetimes cannot exceed the default one, unless allowed
+	maxTTL, errMaxTTL := time.ParseDuration(getEnv("MAX_TTL", getEnv("TOKEN_LIFETIME", "4h")))
+	if errMaxTTL != nil {
+		log.Fatalf("Invalid MAX_TTL, must be a duration: %v, exiting", errMaxTTL)
+	}
+	if errTTL := ttlBounds(minTTL, maxTTL); errTTL != nil {
+		log.Fatalf("Invalid MIN_TTL or MAX_TTL, %v, exiting", errTTL)
+	}
+
+	groupParserInterval, errGroupParserInterval := time.ParseDuration(getEnv("GROUP_PARSER_INTERVAL", "30s"))
+	checkf(errGroupParserInterval, "Invalid GROUP_PARSER_INTERVAL, must be a duration")
+
+	groupNamespaceMapInterval, errGroupNamespaceMapInterval := time.ParseDuration(getEnv("GROUP_NAMESPACE_MAP_INTERVAL", "30s"))
+	checkf(errGroupNamespaceMapInterval, "Invalid GROUP_NAMESPACE_MAP_INTERVAL, must be a duration")
+
+	requireClaims, errRequireClaims := strconv.ParseBool(getEnv("REQUIRE_CLAIMS", "true"))
+	checkf(errRequireClaims, "Invalid REQUIRE_CLAIMS, must be a boolean")
+
+	allowBootstrapTokens, errAllowBootstrapTokens := strconv.ParseBool(getEnv("ALLOW_BOOTSTRAP_TOKENS", "false"))
+	checkf(errAllowBootstrapTokens, "Invalid ALLOW_BOOTSTRAP_TOKENS, must be a boolean")
+
+	bootstrapTokenTTL, errBootstrapTokenTTL := time.ParseDuration(getEnv("BOOTSTRAP_TOKEN_TTL", "1h"))
+	checkf(errBootstrapTokenTTL, "Invalid BOOTSTRAP_TOKEN_TTL, must be a duration")
+
+	bootstrapTokenUsages := []string{"authentication", "signing"}
+	if len(os.Getenv("BOOTSTRAP_TOKEN_USAGES")) > 0 {
+		bootstrapTokenUsages = getEnvList("BOOTSTRAP_TOKEN_USAGES")
+	}
+
+	minTokenVersion, errMinTokenVersion := strconv.Atoi(getEnv("MIN_TOKEN_VERSION", "0"))
+	checkf(errMinTokenVersion, "Invalid MIN_TOKEN_VERSION, must be an integer")
+
+	minNamespacesForConfig, errMinNamespacesForConfig := strconv.Atoi(getEnv("MIN_NAMESPACES_FOR_CONFIG", "0"))
+	checkf(errMinNamespacesForConfig, "Invalid MIN_NAMESPACES_FOR_CONFIG, must be an integer")
+
+	strictParams, errStrictParams := strconv.ParseBool(getEnv("STRICT_PARAMS", "false"))
+	checkf(errStrictParams, "Invalid STRICT_PARAMS, must be a boolean")
+
+	includeUserDN, errIncludeUserDN := strconv.ParseBool(getEnv("INCLUDE_USER_DN", "false"))
+	checkf(errIncludeUserDN, "Invalid INCLUDE_USER_DN, must be a boolean")
+
+	enableFaultInjection, errEnableFaultInjection := strconv.ParseBool(getEnv("ENABLE_FAULT_INJECTION", "false"))
+	checkf(errEnableFaultInjection, "Invalid ENABLE_FAULT_INJECTION, must be a boolean")
+	if enableFaultInjection {
+		Log.Warn().Msg("ENABLE_FAULT_INJECTION is set, admins can make kubi fail on purpose. Never set it in production")
+	}
+
+	singleUseTokens, errSingleUseTokens := strconv.ParseBool(getEnv("SINGLE_USE_TOKENS", "false"))
+	checkf(errSingleUseTokens, "Invalid SINGLE_USE_TOKENS, must be a boolean")
+
+	namespacePendingGrace, errNamespacePendingGrace := time.ParseDuration(getEnv("NAMESPACE_PENDING_GRACE", "0s"))
+	checkf(errNamespacePendingGrace, "Invalid NAMESPACE_PENDING_GRACE, must be a duration")
+
+	linkHeaders, errLinkHeaders := strconv.ParseBool(getEnv("LINK_HEADERS", "true"))
+	checkf(errLinkHeaders, "Invalid LINK_HEADERS, must be a boolean")
+
+	routePrefix := strings.TrimSuffix(getEnv("ROUTE_PREFIX", ""), "/")
+	if len(routePrefix) > 0 && !strings.HasPrefix(routePrefix, "/") {
+		log.Fatalf("Invalid ROUTE_PREFIX %s, must start with a /, exiting", routePrefix)
+	}
+
+	duplicateJtiCheck, errDuplicateJtiCheck := strconv.ParseBool(getEnv("DUPLICATE_JTI_CHECK", "false"))
+	checkf(errDuplicateJtiCheck, "Invalid DUPLICATE_JTI_CHECK, must be a boolean")
+
+	duplicateJtiReject, errDuplicateJtiReject := strconv.ParseBool(getEnv("DUPLICATE_JTI_REJECT", "false"))
+	checkf(errDuplicateJtiReject, "Invalid DUPLICATE_JTI_REJECT, must be a boolean")
+
+	kubeConfigNormalizeNames, errKubeConfigNormalizeNames := strconv.ParseBool(getEnv("KUBECONFIG_NORMALIZE_NAMES", "false"))
+	checkf(errKubeConfigNormalizeNames, "Invalid KUBECONFIG_NORMALIZE_NAMES, must be a boolean")
+
+	expiryWarningWindow, errExpiryWarningWindow := time.ParseDuration(getEnv("EXPIRY_WARNING_WINDOW", "0s"))
+	checkf(errExpiryWarningWindow, "Invalid EXPIRY_WARNING_WINDOW, must be a duration")
+
+	accessLog, errAccessLog := strconv.ParseBool(getEnv("ACCESS_LOG", "false"))
+	checkf(errAccessLog, "Invalid ACCESS_LOG, must be a boolean")
+
+	opsPort, errOpsPort := strconv.Atoi(getEnv("OPS_PORT", "0"))
+	checkf(errOpsPort, "Invalid OPS_PORT, must be an integer")
+
+	opsRequired, errOpsRequired := strconv.ParseBool(getEnv("OPS_REQUIRED", "false"))
+	checkf(errOpsRequired, "Invalid OPS_REQUIRED, must be a boolean")
+
+	var assertionKey []byte
+	if assertionKeyFile := os.Getenv("ASSERTION_KEY_FILE"); len(assertionKeyFile) > 0 {
+		key, errAssertionKey := ioutil.ReadFile(assertionKeyFile)
+		checkf(errAssertionKey, "Invalid ASSERTION_KEY_FILE, cannot be read")
+		assertionKey = key
+	}
+
+	namespaceDedupe, errNamespaceDedupe := strconv.ParseBool(getEnv("NAMESPACE_DEDUPE", "false"))
+	checkf(errNamespaceDedupe, "Invalid NAMESPACE_DEDUPE, must be a boolean")
+
+	ldapRetryAfter, errLdapRetryAfter := strconv.Atoi(getEnv("LDAP_RETRY_AFTER", "30"))
+	checkf(errLdapRetryAfter, "Invalid LDAP_RETRY_AFTER, must be an integer")
+
+	ldapSearchAsUser, errLdapSearchAsUser := strconv.ParseBool(getLdapEnv("LDAP_SEARCH_AS_USER", "false"))
+	checkf(errLdapSearchAsUser, "Invalid LDAP_SEARCH_AS_USER, must be a boolean")
+
+	ldapReuseConnection, errLdapReuseConnection := strconv.ParseBool(getLdapEnv("LDAP_REUSE_CONNECTION", "false"))
+	checkf(errLdapReuseConnection, "Invalid LDAP_REUSE_CONNECTION, must be a boolean")
+
+	ldapSearchAdminGroupBase, errLdapSearchAdminGroupBase := strconv.ParseBool(getLdapEnv("LDAP_SEARCH_ADMIN_GROUP_BASE", "false"))
+	checkf(errLdapSearchAdminGroupBase, "Invalid LDAP_SEARCH_ADMIN_GROUP_BASE, must be a boolean")
+
+	ldapMaxPages, errLdapMaxPages := strconv.Atoi(getLdapEnv("LDAP_MAX_PAGES", "100"))
+	checkf(errLdapMaxPages, "Invalid LDAP_MAX_PAGES, must be an integer")
+
+	ldapMaxEntries, errLdapMaxEntries := strconv.Atoi(getLdapEnv("LDAP_MAX_ENTRIES", "10000"))
+	checkf(errLdapMaxEntries, "Invalid LDAP_MAX_ENTRIES, must be an integer")
+
+	ldapMaxAttrSize, errLdapMaxAttrSize := strconv.Atoi(getLdapEnv("LDAP_MAX_ATTR_SIZE", "4096"))
+	checkf(errLdapMaxAttrSize, "Invalid LDAP_MAX_ATTR_SIZE, must be an integer")
+
+	ldapMaxGroups, errLdapMaxGroups := strconv.Atoi(getLdapEnv("LDAP_MAX_GROUPS", "0"))
+	checkf(errLdapMaxGroups, "Invalid LDAP_MAX_GROUPS, must be an integer")
+
+	ldapWarnNoGroups, errLdapWarnNoGroups := strconv.ParseBool(getLdapEnv("LDAP_WARN_NO_GROUPS", "false"))
+	checkf(errLdapWarnNoGroups, "Invalid LDAP_WARN_NO_GROUPS, must be a boolean")
+
+	minPasswordLength, errMinPasswordLength := strconv.Atoi(getEnv("MIN_PASSWORD_LENGTH", "0"))
+	checkf(errMinPasswordLength, "Invalid MIN_PASSWORD_LENGTH, must be an integer")
+
+	ldapUserFilter := getLdapEnv("LDAP_USERFILTER", "(cn=%s)")
 
 	ldapConfig := types.LdapConfig{
-		UserBase:            os.Getenv("LDAP_USERBASE"),
-		GroupBase:           os.Getenv("LDAP_GROUPBASE"),
-		AdminUserBase:       getEnv("LDAP_ADMIN_USERBASE", ""),
-		AdminGroupBase:      getEnv("LDAP_ADMIN_GROUPBASE", ""),
-		Host:                os.Getenv("LDAP_SERVER"),
-		Port:                ldapPort,
-		UseSSL:              useSSL,
-		StartTLS:            startTLS,
-		SkipTLSVerification: skipTLSVerification,
-		BindDN:              os.Getenv("LDAP_BINDDN"),
-		BindPassword:        os.Getenv("LDAP_PASSWD"),
-		UserFilter:          ldapUserFilter,
-		GroupFilter:         "(member=%s)",
-		Attributes:          []string{"givenName", "sn", "mail", "uid", "cn", "userPrincipalName"},
+		UserBase:                getLdapEnv("LDAP_USERBASE", ""),
+		GroupBase:               getLdapEnv("LDAP_GROUPBASE", ""),
+		AdminUserBase:           getLdapEnv("LDAP_ADMIN_USERBASE", ""),
+		AdminGroupBase:          getLdapEnv("LDAP_ADMIN_GROUPBASE", ""),
+		AdminAttribute:          getLdapEnv("LDAP_ADMIN_ATTRIBUTE", ""),
+		AdminAttributeValue:     getLdapEnv("LDAP_ADMIN_ATTRIBUTE_VALUE", "TRUE"),
+		AdminDenyGroups:         getEnvList("ADMIN_DENY_GROUPS"),
+		SearchAsUser:            ldapSearchAsUser,
+		ReuseConnection:         ldapReuseConnection,
+		SearchAdminGroupBase:    ldapSearchAdminGroupBase,
+		Host:                    getLdapEnv("LDAP_SERVER", ""),
+		Port:                    ldapPort,
+		UseSSL:                  useSSL,
+		StartTLS:                startTLS,
+		SkipTLSVerification:     skipTLSVerification,
+		ClientCertificates:      ldapClientCertificates,
+		BindDN:                  getLdapEnv("LDAP_BINDDN", ""),
+		BindPassword:            os.Getenv("LDAP_PASSWD"),
+		UserFilter:              ldapUserFilter,
+		UpnFilter:               getLdapEnv("LDAP_UPN_FILTER", "(userPrincipalName=%s)"),
+		DialTimeout:             ldapDialTimeout,
+		SearchTimeout:           ldapSearchTimeout,
+		RetryAfter:              ldapRetryAfter,
+		MaxPages:                ldapMaxPages,
+		MaxEntries:              ldapMaxEntries,
+		MaxAttrSize:             ldapMaxAttrSize,
+		MaxGroups:               ldapMaxGroups,
+		WarnNoGroups:            ldapWarnNoGroups,
+		GroupFilter:             "(member=%s)",
+		Attributes:              []string{"givenName", "sn", "mail", "uid", "cn", "userPrincipalName"},
+		UserTiebreakerAttribute: getLdapEnv("LDAP_USER_TIEBREAKER_ATTRIBUTE", ""),
 	}
 	config := &types.Config{
-		Ldap:               ldapConfig,
-		KubeCa:             caEncoded,
-		KubeCaText:         string(kubeCA),
-		KubeToken:          string(kubeToken),
-		ApiServerURL:       net.JoinHostPort(host, port),
-		ApiServerTLSConfig: *tlsConfig,
-		TokenLifeTime:      getEnv("TOKEN_LIFETIME", "4h"),
+		Ldap:                      ldapConfig,
+		KubeCa:                    caEncoded,
+		KubeCaText:                string(kubeCA),
+		KubeConfigCa:              getEnv("KUBECONFIG_CA_DATA", caEncoded),
+		KubeToken:                 string(kubeToken),
+		ApiServerURL:              getEnv("API_SERVER_URL", "https://"+net.JoinHostPort(host, port)),
+		ApiServerTLSConfig:        *tlsConfig,
+		TokenLifeTime:             getEnv("TOKEN_LIFETIME", "4h"),
+		TokenRefreshGrace:         getEnv("TOKEN_REFRESH_GRACE", "0s"),
+		TokenRefreshMaxAge:        tokenRefreshMaxAge,
+		GrantLog:                  grantLog,
+		InstanceName:              getEnv("KUBI_INSTANCE_NAME", ""),
+		MaxAuthHeader:             maxAuthHeader,
+		Clusters:                  getEnvMap("CLUSTERS"),
+		ClusterCas:                getEnvMap("CLUSTER_CAS"),
+		NamespaceClusters:         getEnvMap("NAMESPACE_CLUSTERS"),
+		DownloadLinkTTL:           getEnv("DOWNLOAD_LINK_TTL", "60s"),
+		JwtSigningMethod:          jwtSigningMethod,
+		JwtKeyId:                  os.Getenv("JWT_KEY_ID"),
+		JwtVerifyAlgs:             jwtVerifyAlgs,
+		KubeClientTimeout:         kubeClientTimeout,
+		KubeClientRetries:         kubeClientRetries,
+		LogRedactUsernames:        logRedactUsernames,
+		LogRedactSalt:             os.Getenv("LOG_REDACT_SALT"),
+		TokenDailyQuota:           tokenDailyQuota,
+		TokenQuotaResetHour:       tokenQuotaResetHour,
+		TokenQuotaExemptAdmins:    tokenQuotaExemptAdmins,
+		OpsPort:                   opsPort,
+		OpsAddress:                getEnv("OPS_ADDRESS", ""),
+		OpsRequired:               opsRequired,
+		AssertionKey:              assertionKey,
+		AssertionSigningMethod:    getEnv("ASSERTION_SIGNING_METHOD", "HS256"),
+		NamespaceDedupe:           namespaceDedupe,
+		AdminDefaultNamespace:     getEnv("ADMIN_DEFAULT_NAMESPACE", ""),
+		MinPasswordLength:         minPasswordLength,
+		KubeConfigTokenFile:       getEnv("KUBECONFIG_TOKEN_FILE", ""),
+		KubeConfigNormalizeNames:  kubeConfigNormalizeNames,
+		TokenIdleTimeout:          tokenIdleTimeout,
+		ClusterAudiences:          getEnvMap("CLUSTER_AUDIENCES"),
+		TrustedProxies:            trustedProxies,
+		BindTokenToIp:             bindTokenToIp,
+		AdminConfigBanner:         adminConfigBanner,
+		ImpersonateAllowedGroups:  getEnvList("IMPERSONATE_ALLOWED_GROUPS"),
+		VerifyOnly:                verifyOnly,
+		VerifyKeys:                verifyKeys,
+		JwksURLs:                  jwksURLs,
+		JwksRefreshInterval:       jwksRefreshInterval,
+		MaxTokenLifetimeAccepted:  maxTokenLifetimeAccepted,
+		MinTTL:                    minTTL,
+		MaxTTL:                    maxTTL,
+		GroupNamespaceMapFile:     getEnv("GROUP_NAMESPACE_MAP_FILE", ""),
+		GroupNamespaceMapInterval: groupNamespaceMapInterval,
+		GroupParserFile:           getEnv("GROUP_PARSER_FILE", ""),
+		GroupParserInterval:       groupParserInterval,
+		RequireClaims:             requireClaims,
+		AllowBootstrapTokens:      allowBootstrapTokens,
+		BootstrapTokenTTL:         bootstrapTokenTTL,
+		BootstrapTokenUsages:      bootstrapTokenUsages,
+		AuthRealm:                 getEnv("AUTH_REALM", "Kubi"),
+		MinTokenVersion:           minTokenVersion,
+		MinNamespacesForConfig:    minNamespacesForConfig,
+		StrictParams:              strictParams,
+		IncludeUserDN:             includeUserDN,
+		EnableFaultInjection:      enableFaultInjection,
+		RolePrivilegeOrder:        getEnvList("ROLE_PRIVILEGE_ORDER"),
+		SingleUseTokens:           singleUseTokens,
+		AdminAlertWebhookURL:      os.Getenv("ADMIN_ALERT_WEBHOOK_URL"),
+		NamespacePendingGrace:     namespacePendingGrace,
+		LinkHeaders:               linkHeaders,
+		RoutePrefix:               routePrefix,
+		DuplicateJtiCheck:         duplicateJtiCheck,
+		DuplicateJtiReject:        duplicateJtiReject,
+		ExpiryWarningWindow:       expiryWarningWindow,
+		AccessLog:                 accessLog,
 	}
 
 	err := validation.ValidateStruct(config,
-		validation.Field(&config.ApiServerURL, validation.Required, is.URL),
+		validation.Field(&config.TokenQuotaResetHour, validation.Min(0), validation.Max(23)),
+		validation.Field(&config.ApiServerURL, validation.Required, validation.By(httpsURL)),
 		validation.Field(&config.KubeToken, validation.Required),
 		validation.Field(&config.KubeCa, validation.Required, is.Base64),
-		validation.Field(&config.ApiServerURL, validation.Required, is.URL),
-	)
-	errLdap := validation.ValidateStruct(&ldapConfig,
-		validation.Field(&ldapConfig.UserBase, validation.Required, validation.Length(2, 200)),
-		validation.Field(&ldapConfig.GroupBase, validation.Required, validation.Length(2, 200)),
-		validation.Field(&ldapConfig.Host, validation.Required, is.URL),
-		validation.Field(&ldapConfig.BindDN, validation.Required, validation.Length(2, 200)),
-		validation.Field(&ldapConfig.BindPassword, validation.Required, validation.Length(2, 200)),
+		validation.Field(&config.KubeConfigCa, validation.Required, is.Base64, validation.By(caData)),
 	)
+	// The directory is not used in verify only mode
+	var errLdap error
+	if !verifyOnly {
+		errLdap = validation.ValidateStruct(&ldapConfig,
+			validation.Field(&ldapConfig.UserBase, validation.Required, validation.Length(2, 200)),
+			validation.Field(&ldapConfig.GroupBase, validation.Required, validation.Length(2, 200)),
+			validation.Field(&ldapConfig.Host, validation.Required, is.URL),
+			validation.Field(&ldapConfig.BindDN, validation.Required, validation.Length(2, 200)),
+			validation.Field(&ldapConfig.BindPassword, validation.Required, validation.Length(2, 200)),
+		)
+	}
 
 	if err != nil {
 		Log.Error().Err(err)
@@ -131,3 +437,41 @@ func MakeConfig() (*types.Config, error) {
 	}
 	return config, nil
 }
+
+// Validate an absolute https url, plaintext urls are rejected
+func httpsURL(value interface{}) error {
+	s, _ := value.(string)
+	parsed, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if parsed.Scheme != "https" || len(parsed.Host) == 0 {
+		return errors.New("must be an https url")
+	}
+	return nil
+}
+
+// Validate the bounds of the requested lifetimes
+func ttlBounds(minTTL time.Duration, maxTTL time.Duration) error {
+	if minTTL < 0 {
+		return errors.New("MIN_TTL must not be negative")
+	}
+	if maxTTL <= 0 {
+		return errors.New("MAX_TTL must be positive")
+	}
+	if minTTL > maxTTL {
+		return fmt.Errorf("MIN_TTL %v is over MAX_TTL %v", minTTL, maxTTL)
+	}
+	return nil
+}
+
+// Validate a base64 PEM bundle of CA certificates
+func caData(value interface{}) error {
+	s, _ := value.(string)
+	decoded, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	_, err = EncodeCaChain(decoded)
+	return err
+}
@@ -0,0 +1,61 @@
+package utils
+
+import (
+	"encoding/base64"
+	"github.com/go-ozzo/ozzo-validation"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestHttpsURL(t *testing.T) {
+
+	t.Run("an https url validates", func(t *testing.T) {
+		assert.Nil(t, validation.Validate("https://10.0.0.1:443", validation.By(httpsURL)))
+		assert.Nil(t, validation.Validate("https://kubernetes.default.svc", validation.By(httpsURL)))
+	})
+
+	t.Run("a plaintext url is rejected", func(t *testing.T) {
+		assert.NotNil(t, validation.Validate("http://10.0.0.1:6443", validation.By(httpsURL)))
+	})
+
+	t.Run("a url without scheme is rejected", func(t *testing.T) {
+		assert.NotNil(t, validation.Validate("10.0.0.1:443", validation.By(httpsURL)))
+	})
+}
+
+func TestTTLBounds(t *testing.T) {
+
+	t.Run("a minimum under the maximum validates", func(t *testing.T) {
+		assert.Nil(t, ttlBounds(5*time.Minute, 4*time.Hour))
+		assert.Nil(t, ttlBounds(0, 4*time.Hour))
+	})
+
+	t.Run("a minimum over the maximum is rejected", func(t *testing.T) {
+		assert.NotNil(t, ttlBounds(8*time.Hour, 4*time.Hour))
+	})
+
+	t.Run("negative bounds are rejected", func(t *testing.T) {
+		assert.NotNil(t, ttlBounds(-time.Minute, 4*time.Hour))
+		assert.NotNil(t, ttlBounds(0, -time.Hour))
+	})
+}
+
+func TestCaData(t *testing.T) {
+
+	t.Run("a base64 pem certificate validates", func(t *testing.T) {
+		ca := base64.StdEncoding.EncodeToString(newTestCertificate(t, "ca"))
+
+		assert.Nil(t, validation.Validate(ca, validation.By(caData)))
+	})
+
+	t.Run("a base64 value which is not a pem is rejected", func(t *testing.T) {
+		ca := base64.StdEncoding.EncodeToString([]byte("not a pem"))
+
+		assert.NotNil(t, validation.Validate(ca, validation.By(caData)))
+	})
+
+	t.Run("a value which is not base64 is rejected", func(t *testing.T) {
+		assert.NotNil(t, validation.Validate("not base64!", validation.By(caData)))
+	})
+}
@@ -1,6 +1,9 @@
 package utils
 
-import "os"
+import (
+	"os"
+	"strings"
+)
 
 func IsEmpty(value string) bool {
 	return len(value) == 0
@@ -25,3 +28,40 @@ func getEnv(key, fallback string) string {
 	}
 	return fallback
 }
+
+// Read an LDAP environment variable without surrounding whitespace,
+// often left when copied from a secret. Host urls also lose a trailing slash.
+// A warning is logged when the value is changed
+func getLdapEnv(key, fallback string) string {
+	value := getEnv(key, fallback)
+	trimmed := strings.TrimSpace(value)
+	if key == "LDAP_SERVER" {
+		trimmed = strings.TrimRight(trimmed, "/")
+	}
+	if trimmed != value {
+		Log.Warn().Msgf("%s has surrounding whitespace or a trailing slash, using %q", key, trimmed)
+	}
+	return trimmed
+}
+
+// Parse a "key=value,key=value" environment variable
+// Malformed pairs are ignored
+func getEnvMap(key string) map[string]string {
+	res := map[string]string{}
+	for _, pair := range strings.Split(os.Getenv(key), ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || IsEmpty(strings.TrimSpace(kv[0])) {
+			continue
+		}
+		res[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return res
+}
+
+// Parse a comma separated environment variable
+// Empty values are ignored
+func getEnvList(key string) []string {
+	return Filter(Map(strings.Split(os.Getenv(key), ","), strings.TrimSpace), func(value string) bool {
+		return !IsEmpty(value)
+	})
+}
@@ -0,0 +1,42 @@
+package utils
+
+import (
+	"github.com/go-ozzo/ozzo-validation"
+	"github.com/go-ozzo/ozzo-validation/is"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func TestGetLdapEnv(t *testing.T) {
+	defer os.Unsetenv("LDAP_SERVER")
+	defer os.Unsetenv("LDAP_USERBASE")
+
+	t.Run("host with whitespace and a trailing slash", func(t *testing.T) {
+		os.Setenv("LDAP_SERVER", " ldap.example.com/\n")
+
+		result := getLdapEnv("LDAP_SERVER", "")
+
+		assert.Equal(t, "ldap.example.com", result)
+		assert.Nil(t, validation.Validate(result, validation.Required, is.URL))
+	})
+
+	t.Run("base with whitespace", func(t *testing.T) {
+		os.Setenv("LDAP_USERBASE", "\tou=users,dc=example,dc=com \n")
+
+		result := getLdapEnv("LDAP_USERBASE", "")
+
+		assert.Equal(t, "ou=users,dc=example,dc=com", result)
+		assert.Nil(t, validation.Validate(result, validation.Required, validation.Length(2, 200)))
+	})
+
+	t.Run("clean values are unchanged", func(t *testing.T) {
+		os.Setenv("LDAP_USERBASE", "ou=users")
+
+		assert.Equal(t, "ou=users", getLdapEnv("LDAP_USERBASE", ""))
+	})
+
+	t.Run("fallback is used when unset", func(t *testing.T) {
+		assert.Equal(t, "389", getLdapEnv("LDAP_PORT", "389"))
+	})
+}
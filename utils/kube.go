@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"github.com/ca-gip/kubi/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	kubeClient     *kubernetes.Clientset
+	kubeClientErr  error
+	kubeClientOnce sync.Once
+)
+
+// KubeClient return the shared Kubernetes client, built once
+// from the configuration
+func KubeClient() (*kubernetes.Clientset, error) {
+	kubeClientOnce.Do(func() {
+		kubeClient, kubeClientErr = kubernetes.NewForConfig(kubeRestConfig(Config))
+	})
+	return kubeClient, kubeClientErr
+}
+
+// Rest configuration for the api server, using the in cluster
+// CA and the service account token file so a rotated token is reloaded
+func kubeRestConfig(config *types.Config) *rest.Config {
+	return &rest.Config{
+		Host:            config.ApiServerURL,
+		BearerToken:     config.KubeToken,
+		BearerTokenFile: TokenFile,
+		TLSClientConfig: rest.TLSClientConfig{
+			CAData: []byte(config.KubeCaText),
+		},
+		Timeout: config.KubeClientTimeout,
+		WrapTransport: func(rt http.RoundTripper) http.RoundTripper {
+			return &retryTransport{next: rt, retries: config.KubeClientRetries}
+		},
+	}
+}
+
+// A transport retrying idempotent requests on network
+// errors and server side failures
+type retryTransport struct {
+	next    http.RoundTripper
+	retries int
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if req.Method != http.MethodGet {
+		return resp, err
+	}
+	for attempt := 1; attempt <= t.retries && (err != nil || resp.StatusCode >= http.StatusInternalServerError); attempt++ {
+		if err == nil {
+			resp.Body.Close()
+		}
+		Log.Warn().Msgf("Kubernetes api %s %s failed, retry %d/%d", req.Method, req.URL.Path, attempt, t.retries)
+		time.Sleep(time.Duration(attempt) * 200 * time.Millisecond)
+		resp, err = t.next.RoundTrip(req)
+	}
+	return resp, err
+}
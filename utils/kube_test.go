@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"errors"
+	"github.com/ca-gip/kubi/types"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+type countingTransport struct {
+	calls  int
+	status []int
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.calls++
+	if t.calls > len(t.status) {
+		return nil, errors.New("unreachable")
+	}
+	return &http.Response{StatusCode: t.status[t.calls-1], Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+}
+
+func TestKubeRestConfig(t *testing.T) {
+	config := &types.Config{
+		ApiServerURL:      "https://10.0.0.1:443",
+		KubeCaText:        "-----BEGIN CERTIFICATE-----",
+		KubeToken:         "token",
+		KubeClientTimeout: 5 * time.Second,
+		KubeClientRetries: 2,
+	}
+
+	t.Run("with the host and CA from config", func(t *testing.T) {
+		result := kubeRestConfig(config)
+
+		assert.Equal(t, "https://10.0.0.1:443", result.Host)
+		assert.Equal(t, []byte("-----BEGIN CERTIFICATE-----"), result.TLSClientConfig.CAData)
+		assert.Equal(t, "token", result.BearerToken)
+		assert.Equal(t, 5*time.Second, result.Timeout)
+	})
+
+	t.Run("retry get requests on server failure", func(t *testing.T) {
+		next := &countingTransport{status: []int{http.StatusServiceUnavailable, http.StatusOK}}
+		transport := kubeRestConfig(config).WrapTransport(next)
+
+		resp, err := transport.RoundTrip(httptestRequest(http.MethodGet))
+
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, 2, next.calls)
+	})
+
+	t.Run("do not retry other methods", func(t *testing.T) {
+		next := &countingTransport{status: []int{http.StatusServiceUnavailable}}
+		transport := kubeRestConfig(config).WrapTransport(next)
+
+		resp, _ := transport.RoundTrip(httptestRequest(http.MethodPost))
+
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		assert.Equal(t, 1, next.calls)
+	})
+}
+
+func httptestRequest(method string) *http.Request {
+	req, _ := http.NewRequest(method, "https://10.0.0.1:443/api/v1/namespaces", nil)
+	return req
+}
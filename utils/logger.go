@@ -9,3 +9,9 @@ import (
 var output = zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339}
 
 var Log = zerolog.New(output).With().Timestamp().Logger()
+
+// Grant log, one json record per issued token, never the token itself
+var GrantLog = zerolog.New(os.Stdout).With().Timestamp().Str("log", "grant").Logger()
+
+// Access log, one json record per request with ACCESS_LOG
+var AccessLog = zerolog.New(os.Stdout).With().Timestamp().Str("log", "access").Logger()
@@ -0,0 +1,12 @@
+package utils
+
+import "expvar"
+
+// Build version, set with -ldflags "-X github.com/ca-gip/kubi/utils.Version=..."
+var Version = "dev"
+
+// Kubi counters, exposed on the ops endpoints
+var Metrics = expvar.NewMap("kubi")
+
+// Authentication failures counted by reason, kubi_auth_failures_total{reason}
+var AuthFailures = expvar.NewMap("kubi_auth_failures_total")
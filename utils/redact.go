@@ -0,0 +1,17 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// RedactUser return a stable salted hash of a username (or user DN)
+// for the general logs when LOG_REDACT_USERNAMES is enabled,
+// the username itself otherwise
+func RedactUser(username string) string {
+	if Config == nil || !Config.LogRedactUsernames {
+		return username
+	}
+	sum := sha256.Sum256([]byte(Config.LogRedactSalt + username))
+	return "user-" + hex.EncodeToString(sum[:6])
+}